@@ -0,0 +1,237 @@
+package main
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"regexp"
+	"strings"
+	"time"
+
+	"golang.org/x/oauth2"
+)
+
+// defaultAccount is used when no account is selected. Its tokens are stored
+// under the plain server/client key, so single-account setups keep their
+// existing entries.
+const defaultAccount = "default"
+
+// accountNamePattern restricts account names to characters that are safe in
+// store keys, keyring attributes and file names.
+var accountNamePattern = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9._@-]{0,63}$`)
+
+// accountOverride is the account selected with --account / ACCOUNT for this
+// invocation. It takes precedence over the active account.
+var accountOverride string
+
+// Identity holds the identity claims of an account, taken from the ID token
+// when the server issues one. The claims are for display only; they are not
+// used for any authorization decision, so the ID token signature is not
+// verified.
+type Identity struct {
+	Issuer            string `json:"iss,omitempty"`
+	Subject           string `json:"sub,omitempty"`
+	Email             string `json:"email,omitempty"`
+	Name              string `json:"name,omitempty"`
+	PreferredUsername string `json:"preferred_username,omitempty"`
+}
+
+// String returns the most readable identifier available.
+func (i *Identity) String() string {
+	switch {
+	case i == nil:
+		return ""
+	case i.Email != "":
+		return i.Email
+	case i.PreferredUsername != "":
+		return i.PreferredUsername
+	case i.Name != "":
+		return i.Name
+	default:
+		return i.Subject
+	}
+}
+
+// decodeIDTokenClaims decodes the claims of a JWT ID token into v without
+// verifying the signature. It reports whether that succeeded.
+func decodeIDTokenClaims(idToken string, v any) bool {
+	parts := strings.Split(idToken, ".")
+	if len(parts) != 3 {
+		return false
+	}
+	payload, err := base64.RawURLEncoding.DecodeString(strings.TrimRight(parts[1], "="))
+	if err != nil {
+		return false
+	}
+	return json.Unmarshal(payload, v) == nil
+}
+
+// identityFromIDToken extracts the identity claims from a JWT ID token. It
+// returns nil when there is no token or it cannot be decoded.
+func identityFromIDToken(idToken string) *Identity {
+	var id Identity
+	if !decodeIDTokenClaims(idToken, &id) || id == (Identity{}) {
+		return nil
+	}
+	return &id
+}
+
+// idTokenExpiry returns the exp claim of a JWT ID token, on the server's
+// clock, or the zero time when it has none.
+func idTokenExpiry(idToken string) time.Time {
+	var claims struct {
+		Exp int64 `json:"exp"`
+	}
+	if !decodeIDTokenClaims(idToken, &claims) || claims.Exp == 0 {
+		return time.Time{}
+	}
+	return time.Unix(claims.Exp, 0)
+}
+
+// idTokenValid reports whether storage holds an ID token that has not
+// expired, by the server's clock.
+func idTokenValid(storage *TokenStorage) bool {
+	return tokenNow(storage).Before(idTokenExpiry(storage.IDToken))
+}
+
+// tokenIDToken returns the ID token of a token response, if any.
+func tokenIDToken(token *oauth2.Token) string {
+	idToken, _ := token.Extra("id_token").(string)
+	return idToken
+}
+
+// tokenIdentity returns the identity claims of the ID token in a token
+// response, if any.
+func tokenIdentity(token *oauth2.Token) *Identity {
+	return identityFromIDToken(tokenIDToken(token))
+}
+
+func validateAccountName(name string) error {
+	if !accountNamePattern.MatchString(name) {
+		return fmt.Errorf(
+			"invalid account name %q: use up to 64 letters, digits, '.', '_', '@' or '-'",
+			name,
+		)
+	}
+	return nil
+}
+
+// accountState records the active account per server and client, keyed by
+// the default account's store key. It lives next to the token file, whichever
+// token store is used.
+type accountState struct {
+	Active map[string]string `json:"active"`
+}
+
+func accountStatePath() string {
+	return tokenFile + ".accounts"
+}
+
+func loadAccountState() (*accountState, error) {
+	state := &accountState{Active: make(map[string]string)}
+	data, err := os.ReadFile(accountStatePath())
+	if os.IsNotExist(err) {
+		return state, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(data, state); err != nil {
+		return nil, fmt.Errorf("failed to parse %s: %w", accountStatePath(), err)
+	}
+	if state.Active == nil {
+		state.Active = make(map[string]string)
+	}
+	return state, nil
+}
+
+// setActiveAccount makes name the account used by default for the configured
+// server and client.
+func setActiveAccount(name string) error {
+	path := accountStatePath()
+	lock, err := acquireFileLock(context.Background(), path)
+	if err != nil {
+		return fmt.Errorf("failed to acquire lock: %w", err)
+	}
+	defer func() { _ = lock.release() }()
+
+	state, err := loadAccountState()
+	if err != nil {
+		// The state only holds a preference; start over rather than fail.
+		state = &accountState{Active: make(map[string]string)}
+	}
+	key := tokenStoreKey(serverURL, clientID, defaultAccount)
+	if name == defaultAccount {
+		delete(state.Active, key)
+	} else {
+		state.Active[key] = name
+	}
+
+	data, err := json.MarshalIndent(state, "", "  ")
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(path, data, 0o600)
+}
+
+// activeAccount returns the account selected with "accounts use" (or the
+// last login) for the configured server and client.
+func activeAccount() string {
+	state, err := loadAccountState()
+	if err != nil {
+		return defaultAccount
+	}
+	if name := state.Active[tokenStoreKey(serverURL, clientID, defaultAccount)]; name != "" {
+		return name
+	}
+	return defaultAccount
+}
+
+// currentAccount returns the account this invocation works with: the
+// --account override, else the active account.
+func currentAccount() string {
+	if accountOverride != "" {
+		return accountOverride
+	}
+	return activeAccount()
+}
+
+// listAccounts returns the stored accounts of the configured server and
+// client, in store key order (the default account first).
+func listAccounts() ([]*TokenStorage, error) {
+	store := activeTokenStore()
+	keys, err := store.List()
+	if err != nil {
+		return nil, err
+	}
+
+	server := normalizeServerURL(serverURL)
+	var accounts []*TokenStorage
+	for _, key := range keys {
+		keyServer, keyClient, account := splitTokenStoreKey(key)
+		if keyClient != clientID || (keyServer != server && keyServer != "") {
+			continue
+		}
+		storage, err := store.Get(key)
+		if err != nil {
+			return nil, err
+		}
+		storage.Account = account
+		accounts = append(accounts, storage)
+	}
+	return accounts, nil
+}
+
+// touchLastUsed records that storage was just used, writing at most once a
+// minute so that frequent "token" calls do not rewrite the store each time.
+func touchLastUsed(diag io.Writer, storage *TokenStorage) {
+	if time.Since(storage.LastUsed) < time.Minute {
+		return
+	}
+	if err := saveTokens(storage); err != nil {
+		fmt.Fprintf(diag, "Warning: Failed to record last use: %v\n", err)
+	}
+}
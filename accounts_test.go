@@ -0,0 +1,157 @@
+package main
+
+import (
+	"encoding/base64"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// setupAccountsTest points the token globals at a memory store and a temp
+// token file, restoring them when the test ends.
+func setupAccountsTest(t *testing.T) *memoryTokenStore {
+	t.Helper()
+	origStore, origFile := tokenStore, tokenFile
+	origServer, origClient, origOverride := serverURL, clientID, accountOverride
+	t.Cleanup(func() {
+		tokenStore, tokenFile = origStore, origFile
+		serverURL, clientID, accountOverride = origServer, origClient, origOverride
+	})
+	store := newMemoryTokenStore()
+	tokenStore = store
+	tokenFile = filepath.Join(t.TempDir(), "tokens.json")
+	serverURL = "https://auth.example.com"
+	clientID = "accounts-client"
+	accountOverride = ""
+	return store
+}
+
+func TestIdentityFromIDToken(t *testing.T) {
+	payload := base64.RawURLEncoding.EncodeToString(
+		[]byte(`{"iss":"https://auth.example.com","sub":"42","email":"admin@example.com"}`),
+	)
+	id := identityFromIDToken("eyJhbGciOiJub25lIn0." + payload + ".sig")
+	if id == nil {
+		t.Fatal("identityFromIDToken() = nil")
+	}
+	if id.Subject != "42" || id.String() != "admin@example.com" {
+		t.Errorf("identityFromIDToken() = %+v", id)
+	}
+
+	for _, bad := range []string{"", "opaque-token", "a.!!!.c", "a." + payload} {
+		if id := identityFromIDToken(bad); id != nil {
+			t.Errorf("identityFromIDToken(%q) = %+v, want nil", bad, id)
+		}
+	}
+	if (*Identity)(nil).String() != "" {
+		t.Error("nil Identity String() is not empty")
+	}
+}
+
+func TestValidateAccountName(t *testing.T) {
+	for _, name := range []string{"admin", "default", "me@example.com", "ci-bot_2"} {
+		if err := validateAccountName(name); err != nil {
+			t.Errorf("validateAccountName(%q) error: %v", name, err)
+		}
+	}
+	for _, name := range []string{"", "a|b", "-lead", "with space", "../x"} {
+		if err := validateAccountName(name); err == nil {
+			t.Errorf("validateAccountName(%q) accepted", name)
+		}
+	}
+}
+
+func TestSaveTokens_SeparatesAccounts(t *testing.T) {
+	store := setupAccountsTest(t)
+
+	for _, account := range []string{defaultAccount, "admin"} {
+		accountOverride = account
+		if err := saveTokens(&TokenStorage{AccessToken: "token-" + account}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	keys, _ := store.List()
+	if len(keys) != 2 {
+		t.Fatalf("keys = %q, want one per account", keys)
+	}
+
+	accountOverride = "admin"
+	got, err := loadTokens()
+	if err != nil || got.AccessToken != "token-admin" || got.Account != "admin" {
+		t.Errorf("loadTokens(admin) = %+v, %v", got, err)
+	}
+	if got.LastUsed.IsZero() {
+		t.Error("saveTokens() did not set LastUsed")
+	}
+
+	accountOverride = ""
+	got, err = loadTokens()
+	if err != nil || got.AccessToken != "token-default" {
+		t.Errorf("loadTokens(default) = %+v, %v", got, err)
+	}
+}
+
+func TestActiveAccount(t *testing.T) {
+	setupAccountsTest(t)
+
+	if got := currentAccount(); got != defaultAccount {
+		t.Errorf("currentAccount() = %q, want %q", got, defaultAccount)
+	}
+	if err := setActiveAccount("admin"); err != nil {
+		t.Fatal(err)
+	}
+	if got := currentAccount(); got != "admin" {
+		t.Errorf("currentAccount() after use = %q, want admin", got)
+	}
+
+	// The active account is per server.
+	serverURL = "https://other.example.com"
+	if got := currentAccount(); got != defaultAccount {
+		t.Errorf("currentAccount() on other server = %q", got)
+	}
+	serverURL = "https://auth.example.com"
+
+	accountOverride = "ci"
+	if got := currentAccount(); got != "ci" {
+		t.Errorf("currentAccount() with override = %q, want ci", got)
+	}
+	accountOverride = ""
+
+	if err := setActiveAccount(defaultAccount); err != nil {
+		t.Fatal(err)
+	}
+	if got := currentAccount(); got != defaultAccount {
+		t.Errorf("currentAccount() after reset = %q", got)
+	}
+}
+
+func TestListAccounts(t *testing.T) {
+	store := setupAccountsTest(t)
+
+	for _, account := range []string{defaultAccount, "admin"} {
+		accountOverride = account
+		if err := saveTokens(&TokenStorage{
+			AccessToken: "token-" + account,
+			ExpiresAt:   time.Now().Add(time.Hour),
+		}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	accountOverride = ""
+	// Entries of other clients and servers are not listed.
+	_ = store.Put(tokenStoreKey(serverURL, "other-client", defaultAccount), &TokenStorage{})
+	_ = store.Put(tokenStoreKey("https://other.example.com", clientID, "x"), &TokenStorage{})
+
+	accounts, err := listAccounts()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var names []string
+	for _, a := range accounts {
+		names = append(names, a.Account)
+	}
+	if len(names) != 2 || names[0] != defaultAccount || names[1] != "admin" {
+		t.Errorf("listAccounts() = %q, want [default admin]", names)
+	}
+}
@@ -0,0 +1,357 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// agentSocketEnv points clients at a running token agent.
+const agentSocketEnv = "AUTHGATE_AGENT_SOCK"
+
+// agentRequestTimeout bounds a client request to the agent, which may include
+// one refresh.
+const agentRequestTimeout = refreshLockTimeout + refreshTokenTimeout
+
+// agentStatus is the response to GET /status.
+type agentStatus struct {
+	PID       int       `json:"pid"`
+	ServerURL string    `json:"server_url"`
+	ClientID  string    `json:"client_id"`
+	Account   string    `json:"account"`
+	LoggedIn  bool      `json:"logged_in"`
+	ExpiresAt time.Time `json:"expires_at,omitzero"` // on the local clock
+	Scope     string    `json:"scope,omitempty"`
+	Identity  *Identity `json:"identity,omitempty"`
+}
+
+// agentError is the body of an unsuccessful agent response.
+type agentError struct {
+	Error string `json:"error"`
+}
+
+// tokenAgent serves the tokens of one server, client and account, which it
+// holds in a storedTokenSource: the token store stays the source of truth,
+// so the agent picks up logins done by the CLI and writes refreshed tokens
+// back.
+type tokenAgent struct {
+	source *storedTokenSource
+}
+
+// handler serves the agent API. Every request names the server, client and
+// account it expects, so that a client configured differently falls back to
+// its own token store instead of receiving the wrong token.
+func (a *tokenAgent) handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /token", func(w http.ResponseWriter, r *http.Request) {
+		if !a.checkClient(w, r) {
+			return
+		}
+		storage, err := a.source.tokens(r.Context(), 0)
+		if storage == nil {
+			status := http.StatusBadGateway
+			if errors.Is(err, ErrTokenNotFound) {
+				status = http.StatusNotFound
+			}
+			writeAgentJSON(w, status, agentError{Error: err.Error()})
+			return
+		}
+		// The refresh token never leaves the agent.
+		served := *storage
+		served.RefreshToken = ""
+		writeAgentJSON(w, http.StatusOK, &served)
+	})
+	mux.HandleFunc("GET /status", func(w http.ResponseWriter, r *http.Request) {
+		status := agentStatus{
+			PID:       os.Getpid(),
+			ServerURL: normalizeServerURL(serverURL),
+			ClientID:  clientID,
+			Account:   currentAccount(),
+		}
+		if storage := a.source.peek(); storage != nil {
+			status.LoggedIn = true
+			status.ExpiresAt = localExpiry(storage)
+			status.Scope = storage.Scope
+			status.Identity = storage.Identity
+		}
+		writeAgentJSON(w, http.StatusOK, status)
+	})
+	mux.HandleFunc("POST /logout", func(w http.ResponseWriter, r *http.Request) {
+		if !a.checkClient(w, r) {
+			return
+		}
+		a.source.reset()
+		if err := deleteTokens(); err != nil {
+			writeAgentJSON(w, http.StatusInternalServerError, agentError{Error: err.Error()})
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	})
+	return mux
+}
+
+// checkClient rejects requests for another server, client or account.
+func (a *tokenAgent) checkClient(w http.ResponseWriter, r *http.Request) bool {
+	q := r.URL.Query()
+	if q.Get("server") != normalizeServerURL(serverURL) || q.Get("client_id") != clientID ||
+		q.Get("account") != currentAccount() {
+		writeAgentJSON(w, http.StatusConflict, agentError{Error: fmt.Sprintf(
+			"agent serves %s of %s on %s",
+			currentAccount(),
+			clientID,
+			normalizeServerURL(serverURL),
+		)})
+		return false
+	}
+	return true
+}
+
+func writeAgentJSON(w http.ResponseWriter, status int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	_ = json.NewEncoder(w).Encode(v)
+}
+
+// defaultAgentSocket returns $XDG_RUNTIME_DIR/authgate/agent.sock, or
+// agent.sock next to the token file when there is no runtime directory.
+func defaultAgentSocket() string {
+	if dir := os.Getenv("XDG_RUNTIME_DIR"); filepath.IsAbs(dir) {
+		return filepath.Join(dir, "authgate", "agent.sock")
+	}
+	return filepath.Join(filepath.Dir(tokenFile), "agent.sock")
+}
+
+// listenAgent creates the agent socket with 0600 permissions in a 0700
+// directory. A socket left behind by an agent that is no longer running is
+// replaced; a live one is an error.
+func listenAgent(socket string) (net.Listener, error) {
+	if err := os.MkdirAll(filepath.Dir(socket), 0o700); err != nil {
+		return nil, fmt.Errorf("failed to create socket directory: %w", err)
+	}
+	if _, err := os.Stat(socket); err == nil {
+		if conn, err := net.DialTimeout("unix", socket, time.Second); err == nil {
+			conn.Close()
+			return nil, fmt.Errorf("an agent is already listening on %s", socket)
+		}
+		if err := os.Remove(socket); err != nil {
+			return nil, fmt.Errorf("failed to remove stale socket: %w", err)
+		}
+	}
+
+	ln, err := net.Listen("unix", socket)
+	if err != nil {
+		return nil, err
+	}
+	if err := os.Chmod(socket, 0o600); err != nil {
+		ln.Close()
+		return nil, err
+	}
+	return peerCheckListener{ln}, nil
+}
+
+// peerCheckListener drops connections from other users where the platform
+// reports the peer's credentials (see checkPeerUID).
+type peerCheckListener struct {
+	net.Listener
+}
+
+func (l peerCheckListener) Accept() (net.Conn, error) {
+	for {
+		conn, err := l.Listener.Accept()
+		if err != nil {
+			return nil, err
+		}
+		if err := checkPeerUID(conn); err != nil {
+			fmt.Fprintf(os.Stderr, "Rejected agent connection: %v\n", err)
+			conn.Close()
+			continue
+		}
+		return conn, nil
+	}
+}
+
+// serveAgent serves the agent API on ln until ctx is done.
+func serveAgent(ctx context.Context, ln net.Listener) error {
+	agent := &tokenAgent{source: newStoredTokenSource(os.Stdout)}
+	if _, err := agent.source.tokens(ctx, 0); err != nil {
+		fmt.Printf("Warning: %v; waiting for a login\n", err)
+	}
+
+	go agent.source.refreshLoop(ctx)
+	return serveHTTP(ctx, ln, agent.handler())
+}
+
+// serveHTTP serves handler on ln until ctx is done, then shuts down gracefully.
+func serveHTTP(ctx context.Context, ln net.Listener, handler http.Handler) error {
+	srv := &http.Server{Handler: handler, ReadHeaderTimeout: 5 * time.Second}
+	go func() {
+		<-ctx.Done()
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		_ = srv.Shutdown(shutdownCtx)
+	}()
+	if err := srv.Serve(ln); !errors.Is(err, http.ErrServerClosed) {
+		return err
+	}
+	return nil
+}
+
+// runAgent runs the token agent in the foreground ("agent") or queries a
+// running one ("agent status").
+func runAgent(ctx context.Context, args []string) int {
+	if len(args) > 0 && args[0] == "status" {
+		return runAgentStatus(args[1:])
+	}
+
+	fs := flag.NewFlagSet("agent", flag.ContinueOnError)
+	socket := fs.String(
+		"socket",
+		"",
+		"Socket path (default: $"+agentSocketEnv+" or a per-user path)",
+	)
+	if code, ok := parseCommandFlags(fs, args); !ok {
+		return code
+	}
+	if *socket == "" {
+		*socket = getEnv(agentSocketEnv, defaultAgentSocket())
+	}
+
+	// Serve the account active now, even if "accounts use" switches later.
+	accountOverride = currentAccount()
+
+	ln, err := listenAgent(*socket)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to start agent: %v\n", err)
+		return 1
+	}
+	fmt.Printf("Agent listening on %s (account %s of %s)\n", *socket, accountOverride, clientID)
+	fmt.Printf("export %s=%s\n", agentSocketEnv, *socket)
+
+	if err := serveAgent(ctx, ln); err != nil {
+		fmt.Fprintf(os.Stderr, "Agent failed: %v\n", err)
+		return 1
+	}
+	return 0
+}
+
+// runAgentStatus prints the status of the agent at $AUTHGATE_AGENT_SOCK.
+func runAgentStatus(args []string) int {
+	fs := flag.NewFlagSet("agent status", flag.ContinueOnError)
+	if code, ok := parseCommandFlags(fs, args); !ok {
+		return code
+	}
+	var status agentStatus
+	if err := agentCall(context.Background(), http.MethodGet, "/status", &status); err != nil {
+		fmt.Fprintf(os.Stderr, "Agent status: %v\n", err)
+		return 1
+	}
+	fmt.Printf("Agent PID : %d\n", status.PID)
+	fmt.Printf(
+		"Serving   : account %s of %s on %s\n",
+		status.Account,
+		status.ClientID,
+		status.ServerURL,
+	)
+	if !status.LoggedIn {
+		fmt.Println("Tokens    : none (run \"login\")")
+		return 0
+	}
+	fmt.Printf("Expires In: %s\n", time.Until(status.ExpiresAt).Round(time.Second))
+	if status.Identity != nil {
+		fmt.Printf("Identity  : %s\n", status.Identity)
+	}
+	return 0
+}
+
+// -----------------------------------------------------------------------
+// Client
+// -----------------------------------------------------------------------
+
+// agentCall sends a request for the configured server, client and account to
+// the agent at $AUTHGATE_AGENT_SOCK and decodes a successful JSON response
+// into out (if non-nil).
+func agentCall(ctx context.Context, method, path string, out any) error {
+	q := url.Values{}
+	q.Set("server", normalizeServerURL(serverURL))
+	q.Set("client_id", clientID)
+	q.Set("account", currentAccount())
+	return agentDo(ctx, method, path, q, out)
+}
+
+// agentDo sends a request with query q to the agent at $AUTHGATE_AGENT_SOCK.
+func agentDo(ctx context.Context, method, path string, q url.Values, out any) error {
+	socket := os.Getenv(agentSocketEnv)
+	if socket == "" {
+		return fmt.Errorf("%s is not set", agentSocketEnv)
+	}
+	client := &http.Client{
+		Timeout: agentRequestTimeout,
+		Transport: &http.Transport{
+			DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+				var d net.Dialer
+				return d.DialContext(ctx, "unix", socket)
+			},
+		},
+	}
+
+	req, err := http.NewRequestWithContext(ctx, method, "http://agent"+path+"?"+q.Encode(), nil)
+	if err != nil {
+		return err
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return fmt.Errorf("agent at %s is not reachable: %w", socket, err)
+	}
+	defer resp.Body.Close()
+
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode >= 300 {
+		var e agentError
+		if json.Unmarshal(body, &e) == nil && e.Error != "" {
+			return fmt.Errorf("agent: %s", e.Error)
+		}
+		return fmt.Errorf("agent answered with status %d", resp.StatusCode)
+	}
+	if out == nil {
+		return nil
+	}
+	return json.Unmarshal(body, out)
+}
+
+// tokenFromAgent asks the agent for a valid token. It returns false when no
+// agent is configured or it cannot serve this client, and the caller falls
+// back to the token store.
+func tokenFromAgent(ctx context.Context, diag io.Writer) (*TokenStorage, bool) {
+	if os.Getenv(agentSocketEnv) == "" {
+		return nil, false
+	}
+	var storage TokenStorage
+	if err := agentCall(ctx, http.MethodGet, "/token", &storage); err != nil {
+		fmt.Fprintf(diag, "Not using the token agent: %v\n", err)
+		return nil, false
+	}
+	return &storage, true
+}
+
+// logoutAgent tells a configured agent to drop its tokens. It is best-effort:
+// the caller deletes the stored tokens itself.
+func logoutAgent() {
+	if os.Getenv(agentSocketEnv) == "" {
+		return
+	}
+	if err := agentCall(context.Background(), http.MethodPost, "/logout", nil); err != nil {
+		fmt.Printf("Warning: Failed to log out of the token agent: %v\n", err)
+	}
+}
@@ -0,0 +1,201 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// startTestAgent serves the agent on a socket in a temp dir with a memory
+// store holding storage, and points AUTHGATE_AGENT_SOCK at it.
+func startTestAgent(t *testing.T, tokenServer string, storage *TokenStorage) string {
+	t.Helper()
+	origStore, origFile := tokenStore, tokenFile
+	origServer, origClient, origOverride := serverURL, clientID, accountOverride
+	t.Cleanup(func() {
+		tokenStore, tokenFile = origStore, origFile
+		serverURL, clientID, accountOverride = origServer, origClient, origOverride
+	})
+	tokenStore = newMemoryTokenStore()
+	tokenFile = filepath.Join(t.TempDir(), "tokens.json")
+	serverURL = tokenServer
+	clientID = "agent-client"
+	accountOverride = ""
+	if storage != nil {
+		if err := saveTokens(storage); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	socket := filepath.Join(t.TempDir(), "agent.sock")
+	ln, err := listenAgent(socket)
+	if err != nil {
+		t.Fatalf("listenAgent() error: %v", err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		if err := serveAgent(ctx, ln); err != nil {
+			t.Errorf("serveAgent() error: %v", err)
+		}
+	}()
+	t.Cleanup(func() {
+		cancel()
+		<-done
+	})
+	t.Setenv(agentSocketEnv, socket)
+	return socket
+}
+
+// refreshServer counts refresh_token grants and answers each with a new
+// access token.
+func refreshServer(t *testing.T, count *atomic.Int32) *httptest.Server {
+	t.Helper()
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		n := count.Add(1)
+		w.Header().Set("Content-Type", "application/json")
+		_ = json.NewEncoder(w).Encode(map[string]interface{}{
+			"access_token":  fmt.Sprintf("refreshed-access-token-%d", n),
+			"refresh_token": "refreshed-refresh-token",
+			"token_type":    "Bearer",
+			"expires_in":    3600,
+		})
+	}))
+	t.Cleanup(srv.Close)
+	return srv
+}
+
+func TestAgent_ServesToken(t *testing.T) {
+	socket := startTestAgent(t, "https://auth.example.com", &TokenStorage{
+		AccessToken:  "agent-access-token",
+		RefreshToken: "agent-refresh-token",
+		TokenType:    "Bearer",
+		ExpiresAt:    time.Now().Add(time.Hour),
+		Scope:        "read write",
+	})
+
+	info, err := os.Stat(socket)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Mode().Perm() != 0o600 {
+		t.Errorf("socket mode = %v, want 0600", info.Mode().Perm())
+	}
+
+	storage, ok := tokenFromAgent(context.Background(), io.Discard)
+	if !ok {
+		t.Fatal("tokenFromAgent() = false, want the agent's token")
+	}
+	if storage.AccessToken != "agent-access-token" {
+		t.Errorf("AccessToken = %q", storage.AccessToken)
+	}
+	if storage.RefreshToken != "" {
+		t.Error("agent handed out the refresh token")
+	}
+
+	var status agentStatus
+	if err := agentCall(context.Background(), http.MethodGet, "/status", &status); err != nil {
+		t.Fatal(err)
+	}
+	if !status.LoggedIn || status.PID != os.Getpid() || status.ClientID != "agent-client" {
+		t.Errorf("status = %+v", status)
+	}
+}
+
+func TestAgent_RejectsOtherClient(t *testing.T) {
+	startTestAgent(t, "https://auth.example.com", &TokenStorage{
+		AccessToken: "agent-access-token",
+		ExpiresAt:   time.Now().Add(time.Hour),
+	})
+
+	// The agent's globals are shared with this test, so ask as another client
+	// by changing the query only.
+	for _, q := range []url.Values{
+		{"server": {"https://auth.example.com"}, "client_id": {"other"}, "account": {"default"}},
+		{"server": {"https://other.example.com"}, "client_id": {clientID}},
+		{"server": {"https://auth.example.com"}, "client_id": {clientID}, "account": {"admin"}},
+	} {
+		var storage TokenStorage
+		err := agentDo(context.Background(), http.MethodGet, "/token", q, &storage)
+		if err == nil {
+			t.Errorf("agent served %q to %v", storage.AccessToken, q)
+		}
+	}
+}
+
+func TestAgent_RefreshesExpiredToken(t *testing.T) {
+	var refreshes atomic.Int32
+	srv := refreshServer(t, &refreshes)
+	startTestAgent(t, srv.URL, &TokenStorage{
+		AccessToken:  "expired-access-token",
+		RefreshToken: "agent-refresh-token",
+		TokenType:    "Bearer",
+		ExpiresAt:    time.Now().Add(-time.Minute),
+	})
+
+	for range 3 {
+		storage, ok := tokenFromAgent(context.Background(), io.Discard)
+		if !ok || storage.AccessToken == "expired-access-token" {
+			t.Fatalf("tokenFromAgent() = %+v, %v; want a refreshed token", storage, ok)
+		}
+	}
+	if n := refreshes.Load(); n != 1 {
+		t.Errorf("refreshed %d times, want 1", n)
+	}
+	// The refreshed tokens are written back to the store.
+	stored, err := loadTokens()
+	if err != nil || stored.RefreshToken != "refreshed-refresh-token" {
+		t.Errorf("stored tokens = %+v, %v", stored, err)
+	}
+}
+
+func TestAgent_RefreshesAheadOfExpiry(t *testing.T) {
+	var refreshes atomic.Int32
+	srv := refreshServer(t, &refreshes)
+	startTestAgent(t, srv.URL, &TokenStorage{
+		AccessToken:  "expiring-access-token",
+		RefreshToken: "agent-refresh-token",
+		TokenType:    "Bearer",
+		ExpiresAt:    time.Now().Add(refreshLeeway / 2),
+	})
+
+	deadline := time.Now().Add(5 * time.Second)
+	for refreshes.Load() == 0 && time.Now().Before(deadline) {
+		time.Sleep(20 * time.Millisecond)
+	}
+	if refreshes.Load() == 0 {
+		t.Fatal("agent did not refresh a token about to expire")
+	}
+}
+
+func TestAgent_Logout(t *testing.T) {
+	startTestAgent(t, "https://auth.example.com", &TokenStorage{
+		AccessToken: "agent-access-token",
+		ExpiresAt:   time.Now().Add(time.Hour),
+	})
+
+	logoutAgent()
+	if _, ok := tokenFromAgent(context.Background(), io.Discard); ok {
+		t.Error("agent served a token after logout")
+	}
+	if _, err := loadTokens(); err == nil {
+		t.Error("tokens still stored after agent logout")
+	}
+}
+
+func TestAgent_RefusesSecondInstance(t *testing.T) {
+	socket := startTestAgent(t, "https://auth.example.com", nil)
+	if _, err := listenAgent(socket); err == nil {
+		t.Error("listenAgent() on a live socket succeeded")
+	}
+}
@@ -6,19 +6,36 @@ import (
 	"errors"
 	"fmt"
 	"io"
+	"net"
 	"net/http"
 	"net/url"
 	"strings"
 	"time"
 )
 
-// performBrowserFlow runs the Authorization Code Flow with PKCE.
+// performBrowserFlow runs the Authorization Code Flow with PKCE, serving the
+// callback on ln (as bound by checkBrowserAvailability) or, if ln is nil, on
+// a newly bound callback port. It closes ln.
 //
 // Returns:
 //   - (storage, true, nil)  on success
 //   - (nil, false, nil)     when openBrowser() fails — caller should fall back to Device Code Flow
 //   - (nil, false, err)     on a hard error (CSRF mismatch, token exchange failure, etc.)
-func performBrowserFlow(ctx context.Context) (*TokenStorage, bool, error) {
+func performBrowserFlow(
+	ctx context.Context,
+	diag io.Writer,
+	params authParams,
+	ln net.Listener,
+) (*TokenStorage, bool, error) {
+	if ln == nil {
+		var err error
+		if ln, err = listenCallback(ctx, callbackPorts); err != nil {
+			return nil, false, fmt.Errorf("failed to start callback server: %w", err)
+		}
+	}
+	defer ln.Close()
+	redirect := callbackRedirectURI(ln)
+
 	state, err := generateState()
 	if err != nil {
 		return nil, false, fmt.Errorf("failed to generate state: %w", err)
@@ -29,30 +46,37 @@ func performBrowserFlow(ctx context.Context) (*TokenStorage, bool, error) {
 		return nil, false, fmt.Errorf("failed to generate PKCE: %w", err)
 	}
 
-	authURL := buildAuthURL(state, pkce)
+	authURL := buildAuthURL(redirect, state, pkce, params)
 
-	fmt.Println("Step 1: Opening browser for authorization...")
-	fmt.Printf("\n  %s\n\n", authURL)
+	fmt.Fprintln(diag, "Step 1: Opening browser for authorization...")
+	fmt.Fprintf(diag, "\n  %s\n\n", authURL)
 
 	if err := openBrowser(ctx, authURL); err != nil {
 		// Browser failed to open — signal the caller to fall back immediately.
-		fmt.Printf("Could not open browser: %v\n", err)
+		fmt.Fprintf(diag, "Could not open browser: %v\n", err)
 		return nil, false, nil
 	}
 
-	fmt.Println("Browser opened. Please complete authorization in your browser.")
-	fmt.Printf("Step 2: Waiting for callback on http://localhost:%d/callback ...\n", callbackPort)
+	fmt.Fprintln(diag, "Browser opened. Please complete authorization in your browser.")
+	fmt.Fprintf(diag, "Step 2: Waiting for callback on %s ...\n", redirect)
 
-	storage, err := startCallbackServer(ctx, callbackPort, state,
+	storage, err := startCallbackServer(ctx, ln, state,
 		func(callbackCtx context.Context, code string) (*TokenStorage, error) {
-			fmt.Println("Step 3: Exchanging authorization code for tokens...")
-			return exchangeCode(callbackCtx, code, pkce.Verifier)
+			fmt.Fprintln(diag, "Step 3: Exchanging authorization code for tokens...")
+			storage, err := exchangeCode(callbackCtx, code, pkce.Verifier, redirect)
+			if err != nil {
+				return nil, err
+			}
+			// Before the callback page, which lists the granted scopes.
+			recordGrantedScope(diag, storage, params.requestedScope())
+			return storage, nil
 		})
 	if err != nil {
 		if errors.Is(err, ErrCallbackTimeout) {
 			// User opened the browser but didn't complete authorization in time.
 			// Fall back to Device Code Flow so they can still authenticate.
-			fmt.Printf(
+			fmt.Fprintf(
+				diag,
 				"Browser authorization timed out after %s, falling back to Device Code Flow...\n",
 				callbackTimeout,
 			)
@@ -63,21 +87,21 @@ func performBrowserFlow(ctx context.Context) (*TokenStorage, bool, error) {
 	storage.Flow = "browser"
 
 	if err := saveTokens(storage); err != nil {
-		fmt.Printf("Warning: Failed to save tokens: %v\n", err)
+		fmt.Fprintf(diag, "Warning: Failed to save tokens: %v\n", err)
 	} else {
-		fmt.Printf("Tokens saved to %s\n", tokenFile)
+		fmt.Fprintf(diag, "Tokens saved to %s\n", activeTokenStore())
 	}
 
 	return storage, true, nil
 }
 
 // buildAuthURL constructs the /oauth/authorize URL with all required parameters.
-func buildAuthURL(state string, pkce *PKCEParams) string {
+func buildAuthURL(redirect, state string, pkce *PKCEParams, ap authParams) string {
 	params := url.Values{}
 	params.Set("client_id", clientID)
-	params.Set("redirect_uri", redirectURI)
+	params.Set("redirect_uri", redirect)
 	params.Set("response_type", "code")
-	params.Set("scope", scope)
+	ap.setAuthParams(params)
 	params.Set("state", state)
 	params.Set("code_challenge", pkce.Challenge)
 	params.Set("code_challenge_method", pkce.Method)
@@ -85,14 +109,15 @@ func buildAuthURL(state string, pkce *PKCEParams) string {
 }
 
 // exchangeCode exchanges an authorization code for access + refresh tokens.
-func exchangeCode(ctx context.Context, code, codeVerifier string) (*TokenStorage, error) {
+// redirect must be the redirect URI of the authorization request.
+func exchangeCode(ctx context.Context, code, codeVerifier, redirect string) (*TokenStorage, error) {
 	ctx, cancel := context.WithTimeout(ctx, tokenExchangeTimeout)
 	defer cancel()
 
 	data := url.Values{}
 	data.Set("grant_type", "authorization_code")
 	data.Set("code", code)
-	data.Set("redirect_uri", redirectURI)
+	data.Set("redirect_uri", redirect)
 	data.Set("client_id", clientID)
 
 	if isPublicClient() {
@@ -136,12 +161,7 @@ func exchangeCode(ctx context.Context, code, codeVerifier string) (*TokenStorage
 		)
 	}
 
-	var tokenResp struct {
-		AccessToken  string `json:"access_token"`
-		RefreshToken string `json:"refresh_token"`
-		TokenType    string `json:"token_type"`
-		ExpiresIn    int    `json:"expires_in"`
-	}
+	var tokenResp tokenResponse
 	if err := json.Unmarshal(body, &tokenResp); err != nil {
 		return nil, fmt.Errorf("failed to parse token response: %w", err)
 	}
@@ -158,7 +178,12 @@ func exchangeCode(ctx context.Context, code, codeVerifier string) (*TokenStorage
 		AccessToken:  tokenResp.AccessToken,
 		RefreshToken: tokenResp.RefreshToken,
 		TokenType:    tokenResp.TokenType,
-		ExpiresAt:    time.Now().Add(time.Duration(tokenResp.ExpiresIn) * time.Second),
+		ExpiresAt:    serverNow().Add(time.Duration(tokenResp.ExpiresIn) * time.Second),
+		IssuedAt:     serverNow(),
+		ClockSkew:    currentClockSkew(),
 		ClientID:     clientID,
+		Scope:        tokenResp.Scope,
+		IDToken:      tokenResp.IDToken,
+		Identity:     identityFromIDToken(tokenResp.IDToken),
 	}, nil
 }
@@ -3,7 +3,6 @@ package main
 import (
 	"context"
 	"fmt"
-	"html"
 	"net"
 	"net/http"
 	"sync"
@@ -27,13 +26,13 @@ type callbackResult struct {
 	Desc    string
 }
 
-// startCallbackServer starts a local HTTP server on the given port and waits
-// for the OAuth callback. It validates the returned state against expectedState,
-// calls exchangeFn to exchange the code for tokens, and returns the resulting
-// TokenStorage (or an error).
+// startCallbackServer serves the OAuth callback on ln, at the path of the
+// redirect URI, and waits for it. It validates the returned state against
+// expectedState, calls exchangeFn to exchange the code for tokens, and returns
+// the resulting TokenStorage (or an error).
 //
-// The server shuts itself down after the first request.
-func startCallbackServer(ctx context.Context, port int, expectedState string,
+// The server shuts itself down (closing ln) after the first request.
+func startCallbackServer(ctx context.Context, ln net.Listener, expectedState string,
 	exchangeFn func(context.Context, string) (*TokenStorage, error),
 ) (*TokenStorage, error) {
 	resultCh := make(chan callbackResult, 1)
@@ -43,20 +42,24 @@ func startCallbackServer(ctx context.Context, port int, expectedState string,
 		once.Do(func() { resultCh <- r })
 	}
 
-	mux := http.NewServeMux()
-	mux.HandleFunc("/callback", func(w http.ResponseWriter, r *http.Request) {
+	path := callbackPath()
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != path {
+			http.NotFound(w, r)
+			return
+		}
 		q := r.URL.Query()
 
 		if oauthErr := q.Get("error"); oauthErr != "" {
 			desc := q.Get("error_description")
-			writeCallbackPage(w, false, oauthErr, desc)
+			writeCallbackPage(w, r, nil, oauthErr, desc)
 			sendResult(callbackResult{Error: oauthErr, Desc: desc})
 			return
 		}
 
 		state := q.Get("state")
 		if state != expectedState {
-			writeCallbackPage(w, false, "state_mismatch",
+			writeCallbackPage(w, r, nil, "state_mismatch",
 				"State parameter does not match. Possible CSRF attack.")
 			sendResult(callbackResult{
 				Error: "state_mismatch",
@@ -67,33 +70,27 @@ func startCallbackServer(ctx context.Context, port int, expectedState string,
 
 		code := q.Get("code")
 		if code == "" {
-			writeCallbackPage(w, false, "missing_code", "No authorization code in callback.")
+			writeCallbackPage(w, r, nil, "missing_code", "No authorization code in callback.")
 			sendResult(callbackResult{Error: "missing_code", Desc: "code parameter missing"})
 			return
 		}
 
 		storage, exchangeErr := exchangeFn(r.Context(), code)
 		if exchangeErr != nil {
-			writeCallbackPage(w, false, "token_exchange_failed", exchangeErr.Error())
+			writeCallbackPage(w, r, nil, "token_exchange_failed", exchangeErr.Error())
 			sendResult(callbackResult{Error: "token_exchange_failed", Desc: exchangeErr.Error()})
 			return
 		}
-		writeCallbackPage(w, true, "", "")
+		writeCallbackPage(w, r, storage, "", "")
 		sendResult(callbackResult{Storage: storage})
 	})
 
 	srv := &http.Server{
-		Addr:         fmt.Sprintf("127.0.0.1:%d", port),
-		Handler:      mux,
+		Handler:      handler,
 		ReadTimeout:  10 * time.Second,
 		WriteTimeout: 15 * time.Second,
 	}
 
-	ln, err := (&net.ListenConfig{}).Listen(ctx, "tcp", srv.Addr)
-	if err != nil {
-		return nil, fmt.Errorf("failed to start callback server on port %d: %w", port, err)
-	}
-
 	go func() {
 		_ = srv.Serve(ln)
 	}()
@@ -118,35 +115,3 @@ func startCallbackServer(ctx context.Context, port int, expectedState string,
 		return nil, fmt.Errorf("%w after %s", ErrCallbackTimeout, callbackTimeout)
 	}
 }
-
-// writeCallbackPage writes a minimal HTML response to the browser tab.
-func writeCallbackPage(w http.ResponseWriter, success bool, errCode, errDesc string) {
-	w.Header().Set("Content-Type", "text/html; charset=utf-8")
-
-	if success {
-		fmt.Fprint(w, `<!DOCTYPE html>
-<html>
-<head><title>Authorization Successful</title></head>
-<body style="font-family:sans-serif;text-align:center;padding:4rem">
-  <h1 style="color:#2ea44f">&#10003; Authorization Successful</h1>
-  <p>You have been successfully authorized.</p>
-  <p>You can close this tab and return to your terminal.</p>
-</body>
-</html>`)
-		return
-	}
-
-	msg := errCode
-	if errDesc != "" {
-		msg = errDesc
-	}
-	fmt.Fprintf(w, `<!DOCTYPE html>
-<html>
-<head><title>Authorization Failed</title></head>
-<body style="font-family:sans-serif;text-align:center;padding:4rem">
-  <h1 style="color:#cb2431">&#10007; Authorization Failed</h1>
-  <p>%s</p>
-  <p>You can close this tab and check your terminal for details.</p>
-</body>
-</html>`, html.EscapeString(msg))
-}
@@ -0,0 +1,113 @@
+package main
+
+import (
+	"bytes"
+	"embed"
+	"fmt"
+	"html/template"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+)
+
+//go:embed templates/callback_success.html templates/callback_failure.html
+var callbackTemplatesFS embed.FS
+
+// The pages shown in the browser tab after the callback. They are replaced by
+// CALLBACK_SUCCESS_TEMPLATE and CALLBACK_FAILURE_TEMPLATE, and not used when
+// CALLBACK_SUCCESS_URL or CALLBACK_FAILURE_URL is set.
+var (
+	callbackSuccessTemplate = template.Must(
+		template.ParseFS(callbackTemplatesFS, "templates/callback_success.html"),
+	)
+	callbackFailureTemplate = template.Must(
+		template.ParseFS(callbackTemplatesFS, "templates/callback_failure.html"),
+	)
+	callbackSuccessURL string
+	callbackFailureURL string
+)
+
+// callbackFailureDescription is the error_description sent to
+// CALLBACK_FAILURE_URL. That page is on another host, so the details, such as
+// the token endpoint's error message, stay in the terminal.
+const callbackFailureDescription = "Authorization failed; see the terminal for details."
+
+// callbackPageData is the data the callback page templates are executed with.
+type callbackPageData struct {
+	Error       string   // OAuth error code; empty on success
+	Description string   // human-readable error description
+	Account     string   // signed-in user from the ID token, if any
+	Scopes      []string // granted scopes
+	ServerURL   string
+	ClientID    string
+}
+
+// loadCallbackTemplate parses the html/template at path, or returns def if
+// path is empty.
+func loadCallbackTemplate(path string, def *template.Template) (*template.Template, error) {
+	if path == "" {
+		return def, nil
+	}
+	return template.ParseFiles(path)
+}
+
+// writeCallbackPage answers the browser after the callback: on success
+// (errCode empty) with the tokens in storage, otherwise with the error. It
+// redirects to CALLBACK_SUCCESS_URL or CALLBACK_FAILURE_URL (with the error
+// code and a generic error_description) when set, and renders the success or
+// failure template otherwise.
+func writeCallbackPage(
+	w http.ResponseWriter,
+	r *http.Request,
+	storage *TokenStorage,
+	errCode, errDesc string,
+) {
+	data := callbackPageData{
+		Error:       errCode,
+		Description: errDesc,
+		ServerURL:   serverURL,
+		ClientID:    clientID,
+	}
+	tmpl, redirect := callbackSuccessTemplate, callbackSuccessURL
+	if errCode != "" {
+		tmpl, redirect = callbackFailureTemplate, callbackFailureURL
+		if redirect != "" {
+			redirect = withQuery(redirect, url.Values{
+				"error":             {errCode},
+				"error_description": {callbackFailureDescription},
+			})
+		}
+	} else if storage != nil {
+		data.Account = storage.Identity.String()
+		data.Scopes = strings.Fields(storage.Scope)
+	}
+
+	if redirect != "" {
+		http.Redirect(w, r, redirect, http.StatusFound)
+		return
+	}
+
+	var buf bytes.Buffer
+	if err := tmpl.Execute(&buf, data); err != nil {
+		fmt.Fprintf(os.Stderr, "Warning: Failed to render callback page: %v\n", err)
+		http.Error(w, "failed to render page", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	_, _ = w.Write(buf.Bytes())
+}
+
+// withQuery returns rawURL with params added to its query.
+func withQuery(rawURL string, params url.Values) string {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return rawURL
+	}
+	q := u.Query()
+	for k, v := range params {
+		q[k] = v
+	}
+	u.RawQuery = q.Encode()
+	return u.String()
+}
@@ -4,7 +4,12 @@ import (
 	"context"
 	"fmt"
 	"io"
+	"net"
 	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
 	"strings"
 	"testing"
 	"time"
@@ -22,13 +27,15 @@ func startCallbackServerAsync(
 	exchangeFn func(context.Context, string) (*TokenStorage, error),
 ) chan callbackServerResult {
 	t.Helper()
+	ln, err := listenCallback(ctx, []int{port})
+	if err != nil {
+		t.Fatalf("failed to bind callback port %d: %v", port, err)
+	}
 	ch := make(chan callbackServerResult, 1)
 	go func() {
-		storage, err := startCallbackServer(ctx, port, state, exchangeFn)
+		storage, err := startCallbackServer(ctx, ln, state, exchangeFn)
 		ch <- callbackServerResult{storage, err}
 	}()
-	// Give the server a moment to bind.
-	time.Sleep(50 * time.Millisecond)
 	return ch
 }
 
@@ -52,6 +59,78 @@ func stubExchangeFn(wantCode string) func(context.Context, string) (*TokenStorag
 	}
 }
 
+func TestCallbackRedirectURI(t *testing.T) {
+	origRedirectURI := redirectURI
+	t.Cleanup(func() { redirectURI = origRedirectURI })
+
+	ln, err := listenCallback(context.Background(), []int{0})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	port := ln.Addr().(*net.TCPAddr).Port
+
+	for configured, want := range map[string]string{
+		"http://localhost/callback":          fmt.Sprintf("http://localhost:%d/callback", port),
+		"http://localhost:8888/callback":     fmt.Sprintf("http://localhost:%d/callback", port),
+		"http://127.0.0.1:8888/oauth/cb?x=1": fmt.Sprintf("http://127.0.0.1:%d/oauth/cb?x=1", port),
+		"http://[::1]/callback":              fmt.Sprintf("http://[::1]:%d/callback", port),
+	} {
+		redirectURI = configured
+		if got := callbackRedirectURI(ln); got != want {
+			t.Errorf("callbackRedirectURI() with %s = %s, want %s", configured, got, want)
+		}
+	}
+}
+
+func TestCallbackServer_RedirectURIPathAndDualStack(t *testing.T) {
+	if !ipv6LoopbackAvailable() {
+		t.Skip("IPv6 loopback unavailable")
+	}
+	origRedirectURI := redirectURI
+	t.Cleanup(func() { redirectURI = origRedirectURI })
+	redirectURI = "http://localhost/oauth/cb"
+
+	ln, err := listenCallback(context.Background(), []int{0})
+	if err != nil {
+		t.Fatal(err)
+	}
+	port := ln.Addr().(*net.TCPAddr).Port
+	ch := make(chan callbackServerResult, 1)
+	go func() {
+		storage, err := startCallbackServer(
+			context.Background(), ln, "state", stubExchangeFn("code"),
+		)
+		ch <- callbackServerResult{storage, err}
+	}()
+
+	// Only the path of the redirect URI is served, on both loopback addresses.
+	resp, err := http.Get(fmt.Sprintf("http://127.0.0.1:%d/callback", port)) //nolint:noctx
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusNotFound {
+		t.Errorf("GET /callback status = %d, want 404", resp.StatusCode)
+	}
+	resp, err = http.Get( //nolint:noctx
+		fmt.Sprintf("http://[::1]:%d/oauth/cb?code=code&state=state", port),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+
+	select {
+	case result := <-ch:
+		if result.err != nil || result.storage.AccessToken != "test-token" {
+			t.Errorf("callback over IPv6 = %+v, %v", result.storage, result.err)
+		}
+	case <-time.After(3 * time.Second):
+		t.Fatal("timed out waiting for callback result")
+	}
+}
+
 func TestCallbackServer_Success(t *testing.T) {
 	const port = 19101
 	state := "test-state-success"
@@ -262,3 +341,72 @@ func TestCallbackServer_MissingCode(t *testing.T) {
 		t.Fatal("timed out waiting for callback result")
 	}
 }
+
+// -----------------------------------------------------------------------
+// Callback pages
+// -----------------------------------------------------------------------
+
+func setCallbackPages(t *testing.T) {
+	t.Helper()
+	origSuccess, origFailure := callbackSuccessTemplate, callbackFailureTemplate
+	origSuccessURL, origFailureURL := callbackSuccessURL, callbackFailureURL
+	t.Cleanup(func() {
+		callbackSuccessTemplate, callbackFailureTemplate = origSuccess, origFailure
+		callbackSuccessURL, callbackFailureURL = origSuccessURL, origFailureURL
+	})
+}
+
+func TestWriteCallbackPage_Templates(t *testing.T) {
+	setCallbackPages(t)
+	path := filepath.Join(t.TempDir(), "success.html")
+	page := `<img src="/logo.png"><p>{{.Account}}</p>` +
+		`<ul>{{range .Scopes}}<li>{{.}}</li>{{end}}</ul><script>window.close()</script>`
+	if err := os.WriteFile(path, []byte(page), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	var err error
+	if callbackSuccessTemplate, err = loadCallbackTemplate(path, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	rec := httptest.NewRecorder()
+	writeCallbackPage(rec, httptest.NewRequest(http.MethodGet, "/callback", nil),
+		&TokenStorage{Scope: "read write", Identity: &Identity{Email: "me@example.com"}}, "", "")
+	want := `<img src="/logo.png"><p>me@example.com</p>` +
+		`<ul><li>read</li><li>write</li></ul><script>window.close()</script>`
+	if got := rec.Body.String(); got != want {
+		t.Errorf("success page = %s, want %s", got, want)
+	}
+
+	// The embedded failure page escapes the error description.
+	rec = httptest.NewRecorder()
+	writeCallbackPage(rec, httptest.NewRequest(http.MethodGet, "/callback", nil),
+		nil, "access_denied", "<script>alert(1)</script>")
+	if body := rec.Body.String(); !strings.Contains(body, "Authorization Failed") ||
+		strings.Contains(body, "<script>alert") {
+		t.Errorf("failure page = %s", body)
+	}
+}
+
+func TestWriteCallbackPage_Redirect(t *testing.T) {
+	setCallbackPages(t)
+	callbackSuccessURL = "https://auth.example.com/cli/success"
+	callbackFailureURL = "https://auth.example.com/cli/failure?lang=en"
+
+	rec := httptest.NewRecorder()
+	writeCallbackPage(rec, httptest.NewRequest(http.MethodGet, "/callback", nil),
+		&TokenStorage{}, "", "")
+	if rec.Code != http.StatusFound || rec.Header().Get("Location") != callbackSuccessURL {
+		t.Errorf("success: status %d, Location %q", rec.Code, rec.Header().Get("Location"))
+	}
+
+	// Error details are not sent to another host.
+	rec = httptest.NewRecorder()
+	writeCallbackPage(rec, httptest.NewRequest(http.MethodGet, "/callback", nil),
+		nil, "token_exchange_failed", "POST https://auth.example.com/token: secret detail")
+	want := "https://auth.example.com/cli/failure?error=token_exchange_failed" +
+		"&error_description=" + url.QueryEscape(callbackFailureDescription) + "&lang=en"
+	if rec.Code != http.StatusFound || rec.Header().Get("Location") != want {
+		t.Errorf("failure: status %d, Location %q", rec.Code, rec.Header().Get("Location"))
+	}
+}
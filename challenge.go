@@ -0,0 +1,184 @@
+package main
+
+import (
+	"net/http"
+	"strings"
+)
+
+// bearerChallenge is a parsed Bearer WWW-Authenticate challenge as returned
+// by a resource server (RFC 6750 §3, RFC 9470 §3).
+type bearerChallenge struct {
+	Error            string
+	ErrorDescription string
+	Scope            string
+	ACRValues        string
+	MaxAge           string
+}
+
+// requiresStepUp reports whether the challenge asks for a new authorization
+// (more scope or stronger authentication) rather than a fresh access token.
+func (c *bearerChallenge) requiresStepUp() bool {
+	return c.Error == "insufficient_scope" || c.Error == "insufficient_user_authentication"
+}
+
+// authParams converts the challenge into the parameters of the follow-up
+// authorization request. The requested scope is the union of currentScope and
+// the scope demanded by the resource server.
+func (c *bearerChallenge) authParams(currentScope string) authParams {
+	return authParams{
+		Scope:     mergeScopes(currentScope, c.Scope),
+		ACRValues: c.ACRValues,
+		MaxAge:    c.MaxAge,
+		NewLogin:  true,
+	}
+}
+
+// stepUpChallenge returns the Bearer challenge of resp when it demands step-up
+// authentication, or nil otherwise.
+func stepUpChallenge(resp *http.Response) *bearerChallenge {
+	if resp.StatusCode != http.StatusUnauthorized && resp.StatusCode != http.StatusForbidden {
+		return nil
+	}
+	ch := parseBearerChallenge(resp.Header.Values("WWW-Authenticate"))
+	if ch == nil || !ch.requiresStepUp() {
+		return nil
+	}
+	return ch
+}
+
+// parseBearerChallenge extracts the first Bearer challenge from the given
+// WWW-Authenticate header values. Challenges for other schemes are skipped.
+// Returns nil when no Bearer challenge is present.
+func parseBearerChallenge(headers []string) *bearerChallenge {
+	for _, h := range headers {
+		for _, c := range parseChallenges(h) {
+			if !strings.EqualFold(c.scheme, "Bearer") {
+				continue
+			}
+			return &bearerChallenge{
+				Error:            c.params["error"],
+				ErrorDescription: c.params["error_description"],
+				Scope:            c.params["scope"],
+				ACRValues:        c.params["acr_values"],
+				MaxAge:           c.params["max_age"],
+			}
+		}
+	}
+	return nil
+}
+
+// authChallenge is one challenge of a WWW-Authenticate header (RFC 9110 §11.6.1).
+type authChallenge struct {
+	scheme string
+	params map[string]string
+}
+
+// parseChallenges splits a WWW-Authenticate header value into its challenges.
+// Parameter names are lower-cased; quoted-string values are unescaped.
+// Malformed trailing input is ignored rather than rejected.
+func parseChallenges(header string) []authChallenge {
+	var challenges []authChallenge
+	p := &headerParser{s: header}
+
+	for {
+		p.skip(" \t,")
+		scheme := p.token()
+		if scheme == "" {
+			return challenges
+		}
+		c := authChallenge{scheme: scheme, params: make(map[string]string)}
+
+		for {
+			p.skip(" \t,")
+			start := p.pos
+			name := p.token()
+			if name == "" {
+				break
+			}
+			p.skip(" \t")
+			if !p.consume('=') {
+				// Not a parameter: the token starts the next challenge.
+				p.pos = start
+				break
+			}
+			p.skip(" \t")
+			c.params[strings.ToLower(name)] = p.value()
+		}
+		challenges = append(challenges, c)
+	}
+}
+
+// headerParser is a minimal cursor over an HTTP header value.
+type headerParser struct {
+	s   string
+	pos int
+}
+
+func (p *headerParser) skip(chars string) {
+	for p.pos < len(p.s) && strings.IndexByte(chars, p.s[p.pos]) >= 0 {
+		p.pos++
+	}
+}
+
+func (p *headerParser) consume(c byte) bool {
+	if p.pos < len(p.s) && p.s[p.pos] == c {
+		p.pos++
+		return true
+	}
+	return false
+}
+
+// token reads an RFC 9110 token (or token68, which additionally allows '/').
+func (p *headerParser) token() string {
+	start := p.pos
+	for p.pos < len(p.s) && isTokenChar(p.s[p.pos]) {
+		p.pos++
+	}
+	return p.s[start:p.pos]
+}
+
+// value reads a parameter value: either a token or a quoted-string.
+func (p *headerParser) value() string {
+	if !p.consume('"') {
+		return p.token()
+	}
+	var b strings.Builder
+	for p.pos < len(p.s) {
+		c := p.s[p.pos]
+		p.pos++
+		switch {
+		case c == '\\' && p.pos < len(p.s):
+			b.WriteByte(p.s[p.pos])
+			p.pos++
+		case c == '"':
+			return b.String()
+		default:
+			b.WriteByte(c)
+		}
+	}
+	return b.String()
+}
+
+func isTokenChar(c byte) bool {
+	switch {
+	case c >= 'a' && c <= 'z', c >= 'A' && c <= 'Z', c >= '0' && c <= '9':
+		return true
+	}
+	return strings.IndexByte("!#$%&'*+-.^_`|~/", c) >= 0
+}
+
+// mergeScopes returns the space-separated union of the given scope strings,
+// preserving first-seen order.
+func mergeScopes(scopes ...string) string {
+	seen := make(map[string]bool)
+	var merged []string
+	for _, s := range scopes {
+		for _, sc := range strings.Fields(s) {
+			if !seen[sc] {
+				seen[sc] = true
+				merged = append(merged, sc)
+			}
+		}
+	}
+	return strings.Join(merged, " ")
+}
@@ -0,0 +1,144 @@
+package main
+
+import (
+	"net/http"
+	"testing"
+)
+
+func TestParseBearerChallenge(t *testing.T) {
+	tests := []struct {
+		name    string
+		headers []string
+		want    *bearerChallenge
+	}{
+		{
+			name:    "no header",
+			headers: nil,
+			want:    nil,
+		},
+		{
+			name:    "bare bearer",
+			headers: []string{`Bearer`},
+			want:    &bearerChallenge{},
+		},
+		{
+			name: "insufficient scope",
+			headers: []string{
+				`Bearer realm="api", error="insufficient_scope", scope="admin deploy"`,
+			},
+			want: &bearerChallenge{Error: "insufficient_scope", Scope: "admin deploy"},
+		},
+		{
+			name: "step-up with acr and max_age",
+			headers: []string{
+				`Bearer error="insufficient_user_authentication", ` +
+					`error_description="A different authentication level is required", ` +
+					`acr_values="mfa", max_age=300`,
+			},
+			want: &bearerChallenge{
+				Error:            "insufficient_user_authentication",
+				ErrorDescription: "A different authentication level is required",
+				ACRValues:        "mfa",
+				MaxAge:           "300",
+			},
+		},
+		{
+			name: "bearer after another scheme in the same header",
+			headers: []string{
+				`Basic realm="legacy", Bearer error="insufficient_scope", scope=deploy`,
+			},
+			want: &bearerChallenge{Error: "insufficient_scope", Scope: "deploy"},
+		},
+		{
+			name:    "bearer in a second header",
+			headers: []string{`DPoP algs="ES256"`, `bearer ERROR="invalid_token"`},
+			want:    &bearerChallenge{Error: "invalid_token"},
+		},
+		{
+			name:    "escaped quotes",
+			headers: []string{`Bearer error_description="say \"hi\"", error=invalid_token`},
+			want:    &bearerChallenge{Error: "invalid_token", ErrorDescription: `say "hi"`},
+		},
+		{
+			name:    "other scheme only",
+			headers: []string{`Basic realm="x"`},
+			want:    nil,
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			got := parseBearerChallenge(tc.headers)
+			if (got == nil) != (tc.want == nil) {
+				t.Fatalf("parseBearerChallenge() = %+v, want %+v", got, tc.want)
+			}
+			if got != nil && *got != *tc.want {
+				t.Errorf("parseBearerChallenge() = %+v, want %+v", *got, *tc.want)
+			}
+		})
+	}
+}
+
+func TestStepUpChallenge(t *testing.T) {
+	tests := []struct {
+		name   string
+		status int
+		header string
+		want   bool
+	}{
+		{"401 expired token", http.StatusUnauthorized, `Bearer error="invalid_token"`, false},
+		{"401 no challenge", http.StatusUnauthorized, "", false},
+		{
+			"401 step-up",
+			http.StatusUnauthorized,
+			`Bearer error="insufficient_user_authentication", acr_values="mfa"`,
+			true,
+		},
+		{"403 insufficient scope", http.StatusForbidden, `Bearer error="insufficient_scope"`, true},
+		{"200 ignored", http.StatusOK, `Bearer error="insufficient_scope"`, false},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			resp := &http.Response{StatusCode: tc.status, Header: http.Header{}}
+			if tc.header != "" {
+				resp.Header.Set("WWW-Authenticate", tc.header)
+			}
+			if got := stepUpChallenge(resp) != nil; got != tc.want {
+				t.Errorf("stepUpChallenge() != nil = %v, want %v", got, tc.want)
+			}
+		})
+	}
+}
+
+func TestBearerChallenge_AuthParams(t *testing.T) {
+	ch := &bearerChallenge{
+		Error:     "insufficient_scope",
+		Scope:     "write deploy",
+		ACRValues: "mfa",
+		MaxAge:    "0",
+	}
+
+	got := ch.authParams("read write")
+	want := authParams{Scope: "read write deploy", ACRValues: "mfa", MaxAge: "0", NewLogin: true}
+	if got != want {
+		t.Errorf("authParams() = %+v, want %+v", got, want)
+	}
+}
+
+func TestMergeScopes(t *testing.T) {
+	tests := []struct {
+		in   []string
+		want string
+	}{
+		{[]string{"read write", "write deploy"}, "read write deploy"},
+		{[]string{"", "deploy"}, "deploy"},
+		{[]string{"  read   read "}, "read"},
+		{nil, ""},
+	}
+	for _, tc := range tests {
+		if got := mergeScopes(tc.in...); got != tc.want {
+			t.Errorf("mergeScopes(%q) = %q, want %q", tc.in, got, tc.want)
+		}
+	}
+}
@@ -0,0 +1,193 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"golang.org/x/oauth2"
+)
+
+// cibaAuthResponse is the backchannel authentication response (CIBA Core §7.3).
+type cibaAuthResponse struct {
+	AuthReqID string `json:"auth_req_id"`
+	ExpiresIn int    `json:"expires_in"`
+	Interval  int    `json:"interval"`
+}
+
+// performCIBAFlow runs OpenID Connect Client-Initiated Backchannel
+// Authentication (CIBA Core 1.0, poll mode) and returns tokens on success.
+//
+// The user identified by loginHint approves the request on their phone or
+// authenticator; the binding message shown there must match the one printed
+// in the terminal.
+func performCIBAFlow(
+	ctx context.Context,
+	diag io.Writer,
+	params authParams,
+) (*TokenStorage, error) {
+	if loginHint == "" {
+		return nil, fmt.Errorf("CIBA flow requires a user hint: set --login-hint or LOGIN_HINT")
+	}
+
+	message := bindingMessage
+	if message == "" {
+		var err error
+		message, err = generateBindingMessage()
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	fmt.Fprintln(diag, "Step 1: Sending backchannel authentication request...")
+	authResp, err := requestBackchannelAuth(ctx, params, message)
+	if err != nil {
+		return nil, fmt.Errorf("backchannel authentication request failed: %w", err)
+	}
+
+	fmt.Fprintf(diag, "\n----------------------------------------\n")
+	fmt.Fprintf(diag, "Approve the sign-in request sent to: %s\n", loginHint)
+	fmt.Fprintf(diag, "Confirm it shows this code: %s\n", message)
+	fmt.Fprintf(diag, "----------------------------------------\n\n")
+
+	fmt.Fprintln(diag, "Step 2: Waiting for approval...")
+	token, err := pollTokenEndpoint(
+		ctx,
+		diag,
+		int64(authResp.Interval),
+		"authentication request expired, please restart the flow",
+		func(ctx context.Context) (*oauth2.Token, error) {
+			return exchangeCIBARequest(ctx, authResp.AuthReqID)
+		},
+	)
+	if err != nil {
+		return nil, fmt.Errorf("token poll failed: %w", err)
+	}
+
+	fmt.Fprintln(diag, "\nAuthorization successful!")
+
+	storage := &TokenStorage{
+		AccessToken:  token.AccessToken,
+		RefreshToken: token.RefreshToken,
+		TokenType:    token.Type(),
+		ExpiresAt:    serverTime(token.Expiry),
+		IssuedAt:     serverNow(),
+		ClockSkew:    currentClockSkew(),
+		ClientID:     clientID,
+		Flow:         "ciba",
+		Scope:        tokenScope(token),
+		IDToken:      tokenIDToken(token),
+		Identity:     tokenIdentity(token),
+	}
+	recordGrantedScope(diag, storage, cibaScope(params))
+
+	if err := saveTokens(storage); err != nil {
+		fmt.Fprintf(diag, "Warning: Failed to save tokens: %v\n", err)
+	} else {
+		fmt.Fprintf(diag, "Tokens saved to %s\n", activeTokenStore())
+	}
+
+	return storage, nil
+}
+
+// cibaScope returns the scope for a CIBA request, which must include openid
+// (CIBA Core §7.1).
+func cibaScope(params authParams) string {
+	return mergeScopes("openid", params.requestedScope())
+}
+
+// requestBackchannelAuth posts the authentication request to the backchannel
+// authentication endpoint.
+func requestBackchannelAuth(
+	ctx context.Context,
+	params authParams,
+	message string,
+) (*cibaAuthResponse, error) {
+	reqCtx, cancel := context.WithTimeout(ctx, cibaRequestTimeout)
+	defer cancel()
+
+	data := url.Values{}
+	params.setAuthParams(data)
+	data.Set("scope", cibaScope(params))
+	data.Set("login_hint", loginHint)
+	data.Set("binding_message", message)
+	data.Set("client_id", clientID)
+	if !isPublicClient() {
+		data.Set("client_secret", clientSecret)
+	}
+
+	req, err := http.NewRequestWithContext(
+		reqCtx,
+		http.MethodPost,
+		serverURL+"/oauth/bc-authorize",
+		strings.NewReader(data.Encode()),
+	)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create request: %w", err)
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+
+	resp, err := retryClient.DoWithContext(reqCtx, req)
+	if err != nil {
+		return nil, fmt.Errorf("request failed: %w", err)
+	}
+	defer resp.Body.Close()
+
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read response: %w", err)
+	}
+
+	if resp.StatusCode != http.StatusOK {
+		var errResp ErrorResponse
+		if jsonErr := json.Unmarshal(body, &errResp); jsonErr == nil && errResp.Error != "" {
+			return nil, fmt.Errorf("%s: %s", errResp.Error, errResp.ErrorDescription)
+		}
+		return nil, fmt.Errorf(
+			"backchannel authentication failed with status %d: %s",
+			resp.StatusCode,
+			string(body),
+		)
+	}
+
+	var authResp cibaAuthResponse
+	if err := json.Unmarshal(body, &authResp); err != nil {
+		return nil, fmt.Errorf("failed to parse backchannel response: %w", err)
+	}
+	if authResp.AuthReqID == "" {
+		return nil, fmt.Errorf("backchannel response is missing auth_req_id")
+	}
+	return &authResp, nil
+}
+
+// exchangeCIBARequest polls the token endpoint for the outcome of a
+// backchannel authentication request.
+func exchangeCIBARequest(ctx context.Context, authReqID string) (*oauth2.Token, error) {
+	data := url.Values{}
+	data.Set("grant_type", "urn:openid:params:grant-type:ciba")
+	data.Set("auth_req_id", authReqID)
+	data.Set("client_id", clientID)
+	if !isPublicClient() {
+		data.Set("client_secret", clientSecret)
+	}
+	return postTokenRequest(ctx, serverURL+"/oauth/token", data)
+}
+
+// generateBindingMessage returns a short random code for the user to compare
+// between the terminal and the authentication device.
+func generateBindingMessage() (string, error) {
+	const alphabet = "ABCDEFGHJKLMNPQRSTUVWXYZ23456789"
+	b := make([]byte, 6)
+	if _, err := rand.Read(b); err != nil {
+		return "", fmt.Errorf("failed to generate binding message: %w", err)
+	}
+	for i := range b {
+		b[i] = alphabet[int(b[i])%len(alphabet)]
+	}
+	return string(b[:3]) + "-" + string(b[3:]), nil
+}
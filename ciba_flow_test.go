@@ -0,0 +1,126 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestPerformCIBAFlow(t *testing.T) {
+	origServerURL := serverURL
+	origClientID := clientID
+	origTokenFile := tokenFile
+	origLoginHint := loginHint
+	origBindingMessage := bindingMessage
+	t.Cleanup(func() {
+		serverURL = origServerURL
+		clientID = origClientID
+		tokenFile = origTokenFile
+		loginHint = origLoginHint
+		bindingMessage = origBindingMessage
+	})
+
+	tokenFile = filepath.Join(t.TempDir(), "tokens.json")
+	clientID = "test-client-ciba"
+	loginHint = "oncall@example.com"
+	bindingMessage = "DEPLOY-42"
+
+	var polls atomic.Int32
+	mux := http.NewServeMux()
+	mux.HandleFunc("/oauth/bc-authorize", func(w http.ResponseWriter, r *http.Request) {
+		if err := r.ParseForm(); err != nil {
+			http.Error(w, "bad form", http.StatusBadRequest)
+			return
+		}
+		if got := r.FormValue("login_hint"); got != loginHint {
+			t.Errorf("login_hint = %q, want %q", got, loginHint)
+		}
+		if got := r.FormValue("binding_message"); got != bindingMessage {
+			t.Errorf("binding_message = %q, want %q", got, bindingMessage)
+		}
+		if got := r.FormValue("scope"); !strings.HasPrefix(got, "openid ") {
+			t.Errorf("scope = %q, want openid first", got)
+		}
+		w.Header().Set("Content-Type", "application/json")
+		_ = json.NewEncoder(w).Encode(map[string]interface{}{
+			"auth_req_id": "req-123",
+			"expires_in":  120,
+			"interval":    1,
+		})
+	})
+	mux.HandleFunc("/oauth/token", func(w http.ResponseWriter, r *http.Request) {
+		if err := r.ParseForm(); err != nil {
+			http.Error(w, "bad form", http.StatusBadRequest)
+			return
+		}
+		if got := r.FormValue("grant_type"); got != "urn:openid:params:grant-type:ciba" {
+			t.Errorf("grant_type = %q", got)
+		}
+		if got := r.FormValue("auth_req_id"); got != "req-123" {
+			t.Errorf("auth_req_id = %q, want %q", got, "req-123")
+		}
+		w.Header().Set("Content-Type", "application/json")
+		if polls.Add(1) < 2 {
+			w.WriteHeader(http.StatusBadRequest)
+			_ = json.NewEncoder(w).Encode(map[string]string{"error": "authorization_pending"})
+			return
+		}
+		_ = json.NewEncoder(w).Encode(map[string]interface{}{
+			"access_token":  testAccessToken,
+			"refresh_token": "test-refresh-token",
+			"token_type":    "Bearer",
+			"expires_in":    3600,
+		})
+	})
+	srv := httptest.NewServer(mux)
+	defer srv.Close()
+	serverURL = srv.URL
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	storage, err := performCIBAFlow(ctx, io.Discard, authParams{Scope: "read"})
+	if err != nil {
+		t.Fatalf("performCIBAFlow() error: %v", err)
+	}
+	if storage.AccessToken != testAccessToken {
+		t.Errorf("AccessToken = %q, want %q", storage.AccessToken, testAccessToken)
+	}
+	if storage.Flow != "ciba" {
+		t.Errorf("Flow = %q, want %q", storage.Flow, "ciba")
+	}
+	if storage.Scope != "openid read" {
+		t.Errorf("Scope = %q, want requested scope", storage.Scope)
+	}
+	if polls.Load() < 2 {
+		t.Errorf("expected at least 2 polls, got %d", polls.Load())
+	}
+}
+
+func TestPerformCIBAFlow_RequiresLoginHint(t *testing.T) {
+	origLoginHint := loginHint
+	t.Cleanup(func() { loginHint = origLoginHint })
+	loginHint = ""
+
+	if _, err := performCIBAFlow(context.Background(), io.Discard, authParams{}); err == nil {
+		t.Fatal("expected error without login hint")
+	}
+}
+
+func TestGenerateBindingMessage(t *testing.T) {
+	msg, err := generateBindingMessage()
+	if err != nil {
+		t.Fatalf("generateBindingMessage() error: %v", err)
+	}
+	if !regexp.MustCompile(`^[A-Z2-9]{3}-[A-Z2-9]{3}$`).MatchString(msg) {
+		t.Errorf("unexpected binding message format: %q", msg)
+	}
+}
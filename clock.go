@@ -0,0 +1,140 @@
+package main
+
+import (
+	"net/http"
+	"net/url"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	// clockSkewNoise is the smallest skew taken seriously: the Date header has
+	// one-second resolution and the estimate includes network latency.
+	clockSkewNoise = 2 * time.Second
+	// clockSkewWarning is the skew beyond which status and doctor warn.
+	clockSkewWarning = time.Minute
+)
+
+// serverClockSkew is the last estimate of the server's clock minus the local
+// clock, in nanoseconds, taken from the Date header of a server response.
+// serverClockSkewMeasured is set once this process has taken one.
+var (
+	serverClockSkew         atomic.Int64
+	serverClockSkewMeasured atomic.Bool
+)
+
+// skewRecorder is an http.RoundTripper that estimates the server's clock skew
+// from the Date header of every response from SERVER_URL's host. Responses
+// from other hosts (e.g. a CI provider's assertion endpoint) are ignored:
+// token times are on the AuthGate server's clock.
+type skewRecorder struct {
+	base http.RoundTripper
+}
+
+func (t *skewRecorder) RoundTrip(req *http.Request) (*http.Response, error) {
+	resp, err := t.base.RoundTrip(req)
+	if err == nil && isServerHost(req.URL) {
+		if skew, ok := clockSkewFromDate(resp.Header.Get("Date"), time.Now()); ok {
+			serverClockSkew.Store(int64(skew))
+			serverClockSkewMeasured.Store(true)
+		}
+	}
+	return resp, err
+}
+
+// isServerHost reports whether u is on the scheme and host of serverURL.
+func isServerHost(u *url.URL) bool {
+	server, err := url.Parse(serverURL)
+	if err != nil {
+		return false
+	}
+	return strings.EqualFold(u.Scheme, server.Scheme) && strings.EqualFold(u.Host, server.Host)
+}
+
+// clockSkewFromDate estimates the server's clock skew from a Date header
+// received at the given local time. Estimates within clockSkewNoise are 0.
+func clockSkewFromDate(date string, received time.Time) (time.Duration, bool) {
+	if date == "" {
+		return 0, false
+	}
+	serverTime, err := http.ParseTime(date)
+	if err != nil {
+		return 0, false
+	}
+	// Date is truncated to the second; compare against the middle of it.
+	skew := serverTime.Add(500 * time.Millisecond).Sub(received)
+	if skew.Abs() < clockSkewNoise {
+		return 0, true
+	}
+	return skew.Round(time.Second), true
+}
+
+// currentClockSkew returns the last skew estimate, or 0 if none was taken.
+func currentClockSkew() time.Duration {
+	return time.Duration(serverClockSkew.Load())
+}
+
+// serverNow returns the current time on the server's clock, as far as known.
+// Token issue and expiry times are stored on that clock.
+func serverNow() time.Time {
+	return time.Now().Add(currentClockSkew())
+}
+
+// serverTime converts a local time to the server's clock. The zero time stays
+// zero.
+func serverTime(t time.Time) time.Time {
+	if t.IsZero() {
+		return t
+	}
+	return t.Add(currentClockSkew())
+}
+
+// tokenClockSkew returns the server's clock minus the local clock for
+// comparing against storage's times: the estimate of this process once it has
+// talked to the server, since the local clock may have been corrected since
+// the tokens were issued, and the skew recorded with the tokens before that.
+func tokenClockSkew(storage *TokenStorage) time.Duration {
+	if serverClockSkewMeasured.Load() {
+		return currentClockSkew()
+	}
+	return storage.ClockSkew
+}
+
+// tokenNow returns the current time on the clock storage's times are on.
+func tokenNow(storage *TokenStorage) time.Time {
+	return time.Now().Add(tokenClockSkew(storage))
+}
+
+// tokenExpired reports whether storage's access token has expired, by the
+// server's clock.
+func tokenExpired(storage *TokenStorage) bool {
+	return !tokenNow(storage).Before(storage.ExpiresAt)
+}
+
+// tokenRemaining returns how long storage's access token is still valid.
+func tokenRemaining(storage *TokenStorage) time.Duration {
+	return storage.ExpiresAt.Sub(tokenNow(storage))
+}
+
+// localExpiry returns when storage's access token expires on the local clock.
+func localExpiry(storage *TokenStorage) time.Time {
+	return storage.ExpiresAt.Add(-tokenClockSkew(storage))
+}
+
+// clockSkewExcessive reports whether skew is large enough to warn about.
+func clockSkewExcessive(skew time.Duration) bool {
+	return skew.Abs() > clockSkewWarning
+}
+
+// describeClockSkew describes skew for humans, e.g. "local clock is 3m0s
+// behind the server".
+func describeClockSkew(skew time.Duration) string {
+	switch {
+	case skew > 0:
+		return "local clock is " + skew.String() + " behind the server"
+	case skew < 0:
+		return "local clock is " + (-skew).String() + " ahead of the server"
+	}
+	return "in sync with the server"
+}
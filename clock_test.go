@@ -0,0 +1,163 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestClockSkewFromDate(t *testing.T) {
+	received := time.Date(2026, 1, 1, 12, 0, 0, 0, time.UTC)
+	tests := []struct {
+		date string
+		want time.Duration
+		ok   bool
+	}{
+		{"", 0, false},
+		{"yesterday", 0, false},
+		{received.Format(http.TimeFormat), 0, true},
+		{received.Add(time.Second).Format(http.TimeFormat), 0, true},
+		{received.Add(5 * time.Minute).Format(http.TimeFormat), 5 * time.Minute, true},
+		{received.Add(-5 * time.Minute).Format(http.TimeFormat), -5 * time.Minute, true},
+	}
+	for _, tt := range tests {
+		got, ok := clockSkewFromDate(tt.date, received)
+		// The estimate may be off by the half second added for truncation.
+		if ok != tt.ok || (got-tt.want).Abs() > time.Second {
+			t.Errorf("clockSkewFromDate(%q) = %v, %v; want %v", tt.date, got, ok, tt.want)
+		}
+	}
+}
+
+// skewedServer answers every request with a Date header skew ahead of the
+// local clock.
+func skewedServer(t *testing.T, skew time.Duration) *httptest.Server {
+	t.Helper()
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Date", time.Now().Add(skew).UTC().Format(http.TimeFormat))
+		w.WriteHeader(http.StatusUnauthorized)
+	}))
+	t.Cleanup(srv.Close)
+	return srv
+}
+
+func TestSkewRecorder(t *testing.T) {
+	orig, origMeasured := serverClockSkew.Load(), serverClockSkewMeasured.Load()
+	origServer := serverURL
+	t.Cleanup(func() {
+		serverClockSkew.Store(orig)
+		serverClockSkewMeasured.Store(origMeasured)
+		serverURL = origServer
+	})
+
+	srv := skewedServer(t, -10*time.Minute)
+	serverURL = srv.URL
+	client := &http.Client{Transport: &skewRecorder{base: http.DefaultTransport}}
+	resp, err := client.Get(srv.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+
+	// Another host's clock, e.g. a CI provider's, is not the server's.
+	other := skewedServer(t, time.Hour)
+	resp, err = client.Get(other.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+
+	if skew := currentClockSkew(); (skew + 10*time.Minute).Abs() > 2*time.Second {
+		t.Errorf("currentClockSkew() = %v, want about -10m", skew)
+	}
+	if d := time.Until(serverNow()); (d + 10*time.Minute).Abs() > 2*time.Second {
+		t.Errorf("serverNow() is %v from now, want about -10m", d)
+	}
+}
+
+func TestSkewAdjustedExpiry(t *testing.T) {
+	setRefreshLeeway(t, time.Minute, 0)
+	// Earlier tests may have measured the skew of a test server.
+	origMeasured := serverClockSkewMeasured.Load()
+	t.Cleanup(func() { serverClockSkewMeasured.Store(origMeasured) })
+	serverClockSkewMeasured.Store(false)
+
+	// Issued by a server 10 minutes ahead, valid for 5 minutes: by the local
+	// clock alone it would look valid for 15.
+	skew := 10 * time.Minute
+	issued := time.Now().Add(skew)
+	storage := &TokenStorage{
+		IssuedAt:  issued.Add(-4*time.Minute - 30*time.Second),
+		ExpiresAt: issued.Add(30 * time.Second),
+		ClockSkew: skew,
+	}
+	if tokenExpired(storage) {
+		t.Error("token with 30s left is expired")
+	}
+	if !refreshDue(storage) {
+		t.Error("token with 30s left is not due for refresh")
+	}
+	if r := tokenRemaining(storage); r <= 0 || r > 30*time.Second {
+		t.Errorf("tokenRemaining() = %v, want at most 30s", r)
+	}
+	if d := time.Until(localExpiry(storage)); d <= 0 || d > 30*time.Second {
+		t.Errorf("localExpiry() is %v from now, want at most 30s", d)
+	}
+
+	// Issued by a server 10 minutes behind: by the local clock alone it would
+	// look expired.
+	behind := &TokenStorage{ExpiresAt: time.Now().Add(-skew + time.Minute), ClockSkew: -skew}
+	if tokenExpired(behind) {
+		t.Error("token with a minute left on a server 10m behind is expired")
+	}
+}
+
+func TestCheckServer_ClockSkew(t *testing.T) {
+	origServer := serverURL
+	t.Cleanup(func() { serverURL = origServer })
+
+	for _, tt := range []struct {
+		skew  time.Duration
+		level string
+	}{
+		{0, "ok"},
+		{5 * time.Minute, "warn"},
+	} {
+		serverURL = skewedServer(t, tt.skew).URL
+		checks := checkServer(context.Background())
+		if len(checks) != 2 || checks[0].level != "ok" || checks[1].level != tt.level {
+			t.Errorf("checkServer() with skew %v = %+v, want clock %s", tt.skew, checks, tt.level)
+		}
+	}
+}
+
+func TestTokenNow_PrefersMeasuredSkew(t *testing.T) {
+	origSkew, origMeasured := serverClockSkew.Load(), serverClockSkewMeasured.Load()
+	t.Cleanup(func() {
+		serverClockSkew.Store(origSkew)
+		serverClockSkewMeasured.Store(origMeasured)
+	})
+
+	// Issued while the local clock was 10 minutes behind; it has since been
+	// corrected.
+	storage := &TokenStorage{
+		ExpiresAt: time.Now().Add(time.Minute),
+		ClockSkew: 10 * time.Minute,
+	}
+
+	serverClockSkewMeasured.Store(false)
+	if !tokenExpired(storage) {
+		t.Error("without a measurement, the recorded skew is not used")
+	}
+
+	serverClockSkew.Store(0)
+	serverClockSkewMeasured.Store(true)
+	if tokenExpired(storage) {
+		t.Error("with a measurement, the recorded skew is still used")
+	}
+	if d := time.Until(localExpiry(storage)); d <= 0 || d > time.Minute {
+		t.Errorf("localExpiry() is %v from now, want at most a minute", d)
+	}
+}
@@ -0,0 +1,398 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"text/tabwriter"
+	"time"
+)
+
+const commandUsage = `Commands:
+  (none)   Authenticate and demonstrate token verification and auto-refresh
+  login    Run an interactive login, optionally adding scopes to the current grant
+  token    Print a valid access token, refreshing or re-authenticating as needed
+  logout   Delete the stored tokens for the current account
+  accounts List accounts ("accounts list") or switch the active one ("accounts use NAME")
+  tokens   Maintain the token file ("tokens repair" backs up a damaged file)
+  agent    Serve tokens to other invocations over a Unix socket ("agent status" queries it)
+  proxy    Forward requests to an API with the access token ("proxy --upstream URL")
+  git-credential
+           Git credential helper answering with access tokens ("git-credential get")
+  docker-credential
+           Docker credential helper, also run as docker-credential-authgate
+  kube-credential
+           Kubernetes exec credential plugin ("kube-credential --profile CLUSTER")
+  env      Print shell statements exporting the access token ("env --shell fish")
+  netrc    Write the access token to a netrc entry ("netrc --host HOST")
+  status   Show the current account's stored tokens without contacting the server
+  doctor   Check the configuration, token store, server reachability and clock skew
+
+Global flags must precede the command; run "<command> -h" for command flags.
+`
+
+// runCommand dispatches a subcommand. args[0] is the command name.
+func runCommand(ctx context.Context, args []string) int {
+	switch args[0] {
+	case "login":
+		return runLogin(ctx, args[1:])
+	case "token":
+		return runToken(ctx, args[1:])
+	case "logout":
+		return runLogout(args[1:])
+	case "tokens":
+		return runTokens(args[1:])
+	case "accounts":
+		return runAccounts(args[1:])
+	case "agent":
+		return runAgent(ctx, args[1:])
+	case "proxy":
+		return runProxy(ctx, args[1:])
+	case "git-credential":
+		return runGitCredential(ctx, args[1:])
+	case "docker-credential":
+		return runDockerCredential(ctx, args[1:])
+	case "kube-credential":
+		return runKubeCredential(ctx, args[1:])
+	case "env":
+		return runEnv(ctx, args[1:])
+	case "netrc":
+		return runNetrc(ctx, args[1:])
+	case "status":
+		return runStatus(args[1:])
+	case "doctor":
+		return runDoctor(ctx, args[1:])
+	default:
+		fmt.Fprintf(os.Stderr, "Unknown command: %s\n\n%s", args[0], commandUsage)
+		return 2
+	}
+}
+
+// parseCommandFlags parses a subcommand's flags. It returns the exit code to
+// use and false when the command should not run (parse error or -h).
+func parseCommandFlags(fs *flag.FlagSet, args []string) (int, bool) {
+	if err := fs.Parse(args); err != nil {
+		if errors.Is(err, flag.ErrHelp) {
+			return 0, false
+		}
+		return 2, false
+	}
+	return 0, true
+}
+
+// isTerminal reports whether f is a terminal (a character device).
+func isTerminal(f *os.File) bool {
+	info, err := f.Stat()
+	return err == nil && info.Mode()&os.ModeCharDevice != 0
+}
+
+// runLogin always starts a new interactive flow. With --add-scope, the
+// requested scope is the union of the scopes already granted and the new ones
+// (incremental authorization).
+func runLogin(ctx context.Context, args []string) int {
+	fs := flag.NewFlagSet("login", flag.ContinueOnError)
+	addScope := fs.String(
+		"add-scope",
+		"",
+		"Space-separated scopes to request in addition to those already granted",
+	)
+	account := fs.String("account", "", "Account to log in to (becomes the active account)")
+	if code, ok := parseCommandFlags(fs, args); !ok {
+		return code
+	}
+	if *account != "" {
+		if err := validateAccountName(*account); err != nil {
+			fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+			return 2
+		}
+		accountOverride = *account
+	}
+
+	requested := scope
+	if *addScope != "" {
+		if existing, err := loadTokens(); err == nil {
+			requested = grantedScope(existing)
+		}
+		requested = mergeScopes(requested, *addScope)
+	}
+
+	storage, err := authenticate(ctx, os.Stdout, authParams{Scope: requested, NewLogin: true})
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Authentication failed: %v\n", err)
+		return 1
+	}
+
+	if err := setActiveAccount(storage.Account); err != nil {
+		fmt.Printf("Warning: Failed to make %s the active account: %v\n", storage.Account, err)
+	}
+
+	fmt.Printf("\nLogged in.\n")
+	fmt.Printf("Account      : %s\n", storage.Account)
+	if storage.Identity != nil {
+		fmt.Printf("Identity     : %s\n", storage.Identity)
+	}
+	fmt.Printf("Granted Scope: %s\n", storage.Scope)
+	fmt.Printf("Expires In   : %s\n", tokenRemaining(storage).Round(time.Second))
+	return 0
+}
+
+// runToken prints a valid access token to stdout so it can be used from
+// scripts, e.g. curl -H "Authorization: Bearer $(authgate-cli token)".
+func runToken(ctx context.Context, args []string) int {
+	fs := flag.NewFlagSet("token", flag.ContinueOnError)
+	required := fs.String(
+		"scope",
+		"",
+		"Space-separated scopes the token must carry; missing ones trigger incremental consent",
+	)
+	if code, ok := parseCommandFlags(fs, args); !ok {
+		return code
+	}
+
+	// Stdout is kept for the token; the auth flows report on stderr.
+	storage, err := obtainToken(ctx, os.Stderr, *required, true)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to obtain token: %v\n", err)
+		return 1
+	}
+
+	fmt.Println(storage.AccessToken)
+	return 0
+}
+
+// errLoginRequired is returned by obtainToken when only an interactive login
+// could produce a token but interaction is not allowed.
+var errLoginRequired = errors.New("an interactive login is required; run \"login\"")
+
+// obtainToken returns a valid token carrying at least requiredScope. It asks
+// the token agent first when $AUTHGATE_AGENT_SOCK is set. Otherwise it reuses
+// the cached token when possible, refreshes it when expired, and starts an
+// interactive flow only when there is no usable token or when scopes are
+// missing from the current grant. Unless interactive is set it returns
+// errLoginRequired instead of starting a flow that needs the user (the
+// federated flow needs none and always runs). Progress messages and prompts
+// go to diag, so that commands printing a result can keep stdout for it.
+func obtainToken(
+	ctx context.Context,
+	diag io.Writer,
+	requiredScope string,
+	interactive bool,
+) (*TokenStorage, error) {
+	login := func(params authParams) (*TokenStorage, error) {
+		if !interactive && authFlow != flowFederated {
+			return nil, errLoginRequired
+		}
+		return authenticate(ctx, diag, params)
+	}
+
+	if storage, ok := tokenFromAgent(ctx, diag); ok &&
+		len(missingScopes(grantedScope(storage), requiredScope)) == 0 {
+		return storage, nil
+	}
+
+	existing, err := loadTokens()
+	if err != nil || existing == nil {
+		return login(authParams{Scope: mergeScopes(scope, requiredScope)})
+	}
+
+	granted := grantedScope(existing)
+	if missing := missingScopes(granted, requiredScope); len(missing) > 0 {
+		fmt.Fprintf(diag, "Requesting additional scopes: %s\n", strings.Join(missing, " "))
+		return login(authParams{Scope: mergeScopes(granted, requiredScope)})
+	}
+
+	if storage, err := reuseStoredTokens(ctx, diag, existing); err == nil {
+		return storage, nil
+	}
+	return login(authParams{Scope: granted})
+}
+
+// runLogout removes the stored tokens for the current account. Logging out of
+// the active account makes the default account active again.
+func runLogout(args []string) int {
+	fs := flag.NewFlagSet("logout", flag.ContinueOnError)
+	if code, ok := parseCommandFlags(fs, args); !ok {
+		return code
+	}
+
+	account := currentAccount()
+	logoutAgent()
+	if err := deleteTokens(); err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to delete tokens: %v\n", err)
+		return 1
+	}
+	if account == activeAccount() && account != defaultAccount {
+		if err := setActiveAccount(defaultAccount); err != nil {
+			fmt.Printf("Warning: Failed to reset the active account: %v\n", err)
+		}
+	}
+	fmt.Printf(
+		"Logged out: removed tokens for account %s of %s from %s\n",
+		account,
+		clientID,
+		activeTokenStore(),
+	)
+	return 0
+}
+
+// runTokens dispatches the token file maintenance subcommands.
+func runTokens(args []string) int {
+	if len(args) == 0 {
+		fmt.Fprintln(os.Stderr, "Usage: tokens repair")
+		return 2
+	}
+	switch args[0] {
+	case "repair":
+		return runTokensRepair(args[1:])
+	default:
+		fmt.Fprintf(os.Stderr, "Unknown tokens command: %s\nUsage: tokens repair\n", args[0])
+		return 2
+	}
+}
+
+// runTokensRepair moves a token file that cannot be parsed to a timestamped
+// backup and keeps whatever entries can still be read.
+func runTokensRepair(args []string) int {
+	fs := flag.NewFlagSet("tokens repair", flag.ContinueOnError)
+	if code, ok := parseCommandFlags(fs, args); !ok {
+		return code
+	}
+
+	store := tokenFileStore()
+	if store == nil {
+		fmt.Fprintf(
+			os.Stderr,
+			"%s does not use a token file; nothing to repair\n",
+			activeTokenStore(),
+		)
+		return 1
+	}
+
+	backup, recovered, err := store.repair()
+	switch {
+	case os.IsNotExist(err):
+		fmt.Printf("No token file at %s; nothing to repair.\n", store.path)
+		return 0
+	case err != nil:
+		fmt.Fprintf(os.Stderr, "Failed to repair %s: %v\n", store.path, err)
+		return 1
+	case backup == "":
+		fmt.Printf("Token file %s is readable; nothing to repair.\n", store.path)
+		return 0
+	}
+
+	fmt.Printf("Moved unreadable token file to %s\n", backup)
+	fmt.Printf("Recovered %d entries into %s\n", recovered, store.path)
+	if recovered == 0 {
+		fmt.Println("Run \"login\" to sign in again.")
+	}
+	return 0
+}
+
+// runAccounts dispatches the account subcommands.
+func runAccounts(args []string) int {
+	const usage = "Usage: accounts list | accounts use NAME"
+	if len(args) == 0 {
+		fmt.Fprintln(os.Stderr, usage)
+		return 2
+	}
+	switch args[0] {
+	case "list":
+		return runAccountsList(args[1:])
+	case "use":
+		return runAccountsUse(args[1:])
+	default:
+		fmt.Fprintf(os.Stderr, "Unknown accounts command: %s\n%s\n", args[0], usage)
+		return 2
+	}
+}
+
+// runAccountsList prints the accounts stored for the configured server and
+// client. The account used by this invocation is marked with "*".
+func runAccountsList(args []string) int {
+	fs := flag.NewFlagSet("accounts list", flag.ContinueOnError)
+	if code, ok := parseCommandFlags(fs, args); !ok {
+		return code
+	}
+
+	accounts, err := listAccounts()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to list accounts: %v\n", err)
+		return 1
+	}
+	if len(accounts) == 0 {
+		fmt.Println("No accounts. Run \"login\" (optionally with --account NAME) to add one.")
+		return 0
+	}
+
+	current := currentAccount()
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "\tACCOUNT\tIDENTITY\tLAST USED\tEXPIRES")
+	for _, a := range accounts {
+		marker := ""
+		if a.Account == current {
+			marker = "*"
+		}
+		lastUsed := "never"
+		if !a.LastUsed.IsZero() {
+			lastUsed = a.LastUsed.Local().Format("2006-01-02 15:04")
+		}
+		expires := "expired"
+		if remaining := tokenRemaining(a); remaining > 0 {
+			expires = "in " + remaining.Round(time.Second).String()
+		}
+		identity := a.Identity.String()
+		if identity == "" {
+			identity = "-"
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\n", marker, a.Account, identity, lastUsed, expires)
+	}
+	if err := w.Flush(); err != nil {
+		return 1
+	}
+	return 0
+}
+
+// runAccountsUse makes an existing account the active one for later
+// invocations.
+func runAccountsUse(args []string) int {
+	fs := flag.NewFlagSet("accounts use", flag.ContinueOnError)
+	if code, ok := parseCommandFlags(fs, args); !ok {
+		return code
+	}
+	if fs.NArg() != 1 {
+		fmt.Fprintln(os.Stderr, "Usage: accounts use NAME")
+		return 2
+	}
+	name := fs.Arg(0)
+
+	accounts, err := listAccounts()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to list accounts: %v\n", err)
+		return 1
+	}
+	found := false
+	for _, a := range accounts {
+		found = found || a.Account == name
+	}
+	if !found {
+		fmt.Fprintf(
+			os.Stderr,
+			"No tokens for account %s; run \"login --account %s\" first\n",
+			name,
+			name,
+		)
+		return 1
+	}
+
+	if err := setActiveAccount(name); err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to switch account: %v\n", err)
+		return 1
+	}
+	fmt.Printf("Active account: %s\n", name)
+	return 0
+}
@@ -2,11 +2,14 @@ package main
 
 import (
 	"crypto/tls"
+	"errors"
 	"flag"
 	"fmt"
+	"io"
 	"net/http"
 	"net/url"
 	"os"
+	"strconv"
 	"strings"
 	"time"
 
@@ -20,29 +23,71 @@ var (
 	clientID          string
 	clientSecret      string
 	redirectURI       string
-	callbackPort      int
+	callbackPorts     []int
 	scope             string
 	tokenFile         string
+	profilesFile      string
 	forceDevice       bool
+	authFlow          string
+	loginHint         string
+	bindingMessage    string
 	configInitialized bool
 	retryClient       *retry.Client
 
+	// Tokens are refreshed once less than refreshLeeway, or
+	// refreshLeewayPercent of their lifetime if that is longer, remains.
+	refreshLeeway        = time.Minute
+	refreshLeewayPercent = 10
+
+	// Workload identity federation (--flow federated).
+	assertionFile         string
+	assertionEnv          string
+	assertionURL          string
+	assertionRequestToken string
+	assertionAudience     string
+	assertionGrant        string
+
 	flagServerURL    *string
 	flagClientID     *string
 	flagClientSecret *string
 	flagRedirectURI  *string
-	flagCallbackPort *int
+	flagCallbackPort *string
+	flagSuccessPage  *string
+	flagFailurePage  *string
+	flagSuccessURL   *string
+	flagFailureURL   *string
 	flagScope        *string
 	flagTokenFile    *string
 	flagDevice       *bool
 	flagNoBrowser    *bool
+	flagFlow         *string
+	flagLoginHint    *string
+	flagBindingMsg   *string
+	flagTokenStore   *string
+	flagTokenKeyFile *string
+	flagAccount      *string
+	flagProfiles     *string
+	flagLeeway       *string
+	flagLeewayPct    *string
 )
 
 const (
 	tokenExchangeTimeout     = 10 * time.Second
 	tokenVerificationTimeout = 10 * time.Second
 	refreshTokenTimeout      = 10 * time.Second
+	refreshLockTimeout       = 3 * refreshTokenTimeout
 	deviceCodeRequestTimeout = 10 * time.Second
+	cibaRequestTimeout       = 10 * time.Second
+	serverCheckTimeout       = 10 * time.Second
+)
+
+// Values accepted by --flow / AUTH_FLOW.
+const (
+	flowAuto      = "auto"
+	flowBrowser   = "browser"
+	flowDevice    = "device"
+	flowCIBA      = "ciba"
+	flowFederated = "federated"
 )
 
 func init() {
@@ -64,16 +109,68 @@ func init() {
 		"",
 		"Redirect URI registered with the OAuth server (default: http://localhost:PORT/callback)",
 	)
-	flagCallbackPort = flag.Int(
+	flagCallbackPort = flag.String(
 		"port",
-		0,
-		"Local callback port for browser flow (default: 8888 or CALLBACK_PORT env)",
+		"",
+		"Local callback port for browser flow: a port, 0 for an ephemeral port, "+
+			"or fallbacks like 8888,9000-9010 (default: 8888 or CALLBACK_PORT env)",
+	)
+	flagSuccessPage = flag.String(
+		"callback-success-template",
+		"",
+		"html/template file shown after a successful sign-in (or CALLBACK_SUCCESS_TEMPLATE env)",
+	)
+	flagFailurePage = flag.String(
+		"callback-failure-template",
+		"",
+		"html/template file shown when authorization fails (or CALLBACK_FAILURE_TEMPLATE env)",
+	)
+	flagSuccessURL = flag.String(
+		"callback-success-url",
+		"",
+		"Redirect the browser here after a successful sign-in (or CALLBACK_SUCCESS_URL env)",
+	)
+	flagFailureURL = flag.String(
+		"callback-failure-url",
+		"",
+		"Redirect the browser here when authorization fails (or CALLBACK_FAILURE_URL env)",
 	)
 	flagScope = flag.String("scope", "", "Space-separated OAuth scopes (default: \"read write\")")
 	flagTokenFile = flag.String(
 		"token-file",
 		"",
-		"Token storage file (default: .authgate-tokens.json or TOKEN_FILE env)",
+		"Token storage file (default: $XDG_STATE_HOME/authgate/tokens.json or TOKEN_FILE env)",
+	)
+	flagTokenStore = flag.String(
+		"token-store",
+		"",
+		"Token storage backend: file, memory, exec or keyring (default: file or TOKEN_STORE env)",
+	)
+	flagTokenKeyFile = flag.String(
+		"token-key-file",
+		"",
+		"File with a base64 256-bit key to encrypt the token file (default: TOKEN_KEY_FILE env)",
+	)
+	flagAccount = flag.String(
+		"account",
+		"",
+		"Account to use for this invocation (default: the active account or ACCOUNT env)",
+	)
+	flagProfiles = flag.String(
+		"profiles-file",
+		"",
+		"Profiles mapping hosts to servers and clients (or set PROFILES_FILE env)",
+	)
+	flagLeeway = flag.String(
+		"refresh-leeway",
+		"",
+		"Refresh tokens this long before they expire (default: 60s or REFRESH_LEEWAY env)",
+	)
+	flagLeewayPct = flag.String(
+		"refresh-leeway-percent",
+		"",
+		"Also refresh once this percentage of the token lifetime remains "+
+			"(default: 10 or REFRESH_LEEWAY_PERCENT env)",
 	)
 	flagDevice = flag.Bool(
 		"device",
@@ -85,6 +182,28 @@ func init() {
 		false,
 		"Alias for --device: skip browser and use Device Code Flow",
 	)
+	flagFlow = flag.String(
+		"flow",
+		"",
+		"Authentication flow: auto, browser, device, ciba or federated (default: AUTH_FLOW env)",
+	)
+	flagLoginHint = flag.String(
+		"login-hint",
+		"",
+		"User identifier sent as login_hint in the CIBA flow (or LOGIN_HINT env)",
+	)
+	flagBindingMsg = flag.String(
+		"binding-message",
+		"",
+		"Message shown on the authentication device in the CIBA flow (default: random code)",
+	)
+
+	flag.Usage = func() {
+		w := flag.CommandLine.Output()
+		fmt.Fprintf(w, "Usage: %s [flags] [command] [command flags]\n\nFlags:\n", os.Args[0])
+		flag.PrintDefaults()
+		fmt.Fprintf(w, "\n%s", commandUsage)
+	}
 }
 
 func initConfig() {
@@ -98,77 +217,225 @@ func initConfig() {
 	// --device or --no-browser forces Device Code Flow unconditionally.
 	forceDevice = *flagDevice || *flagNoBrowser
 
+	authFlow = strings.ToLower(getConfig(*flagFlow, "AUTH_FLOW", flowAuto))
+	switch authFlow {
+	case flowAuto, flowBrowser, flowDevice, flowCIBA, flowFederated:
+	default:
+		fmt.Fprintf(
+			os.Stderr,
+			"Error: Invalid AUTH_FLOW %q (must be auto, browser, device, ciba or federated)\n",
+			authFlow,
+		)
+		os.Exit(1)
+	}
+	if authFlow == flowDevice {
+		forceDevice = true
+	}
+	accountOverride = getConfig(*flagAccount, "ACCOUNT", "")
+	if accountOverride != "" {
+		if err := validateAccountName(accountOverride); err != nil {
+			fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+			os.Exit(1)
+		}
+	}
+	if err := parseRefreshLeeway(
+		getConfig(*flagLeeway, "REFRESH_LEEWAY", ""),
+		getConfig(*flagLeewayPct, "REFRESH_LEEWAY_PERCENT", ""),
+	); err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		os.Exit(1)
+	}
+	loginHint = getConfig(*flagLoginHint, "LOGIN_HINT", "")
+	bindingMessage = getConfig(*flagBindingMsg, "BINDING_MESSAGE", "")
+
+	assertionFile = getEnv("ASSERTION_FILE", "")
+	assertionEnv = getEnv("ASSERTION_ENV", "")
+	assertionURL = getEnv("ASSERTION_URL", "")
+	assertionRequestToken = getEnv("ASSERTION_REQUEST_TOKEN", "")
+	assertionAudience = getEnv("ASSERTION_AUDIENCE", "")
+	assertionGrant = getEnv("ASSERTION_GRANT", "jwt-bearer")
+	if assertionGrant != "jwt-bearer" && assertionGrant != "token-exchange" {
+		fmt.Fprintf(
+			os.Stderr,
+			"Error: Invalid ASSERTION_GRANT %q (must be jwt-bearer or token-exchange)\n",
+			assertionGrant,
+		)
+		os.Exit(1)
+	}
+
 	serverURL = getConfig(*flagServerURL, "SERVER_URL", "http://localhost:8080")
 	clientID = getConfig(*flagClientID, "CLIENT_ID", "")
 	clientSecret = getConfig(*flagClientSecret, "CLIENT_SECRET", "")
 	scope = getConfig(*flagScope, "SCOPE", "read write")
-	tokenFile = getConfig(*flagTokenFile, "TOKEN_FILE", ".authgate-tokens.json")
+	tokenFile = getConfig(*flagTokenFile, "TOKEN_FILE", "")
+	profilesFile = getConfig(*flagProfiles, "PROFILES_FILE", defaultProfilesFile())
+	tokenFileDefaulted := tokenFile == ""
+	if tokenFileDefaulted {
+		tokenFile = defaultTokenFile()
+	}
 
-	// Resolve callback port (int flag needs special handling).
-	portStr := ""
-	if *flagCallbackPort != 0 {
-		portStr = fmt.Sprintf("%d", *flagCallbackPort)
+	var err error
+	// Secrets are only read from the environment, never from flags, so they
+	// do not show up in process listings.
+	tokenCipher, err = newTokenEncryption(
+		getEnv("TOKEN_PASSPHRASE", ""),
+		getEnv("TOKEN_KEY", ""),
+		getConfig(*flagTokenKeyFile, "TOKEN_KEY_FILE", ""),
+	)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: Invalid token encryption settings: %v\n", err)
+		os.Exit(1)
 	}
-	portStr = getConfig(portStr, "CALLBACK_PORT", "8888")
-	if _, err := fmt.Sscanf(portStr, "%d", &callbackPort); err != nil || callbackPort <= 0 {
-		callbackPort = 8888
+
+	if tokenFileDefaulted {
+		if err := migrateLegacyTokenFile(legacyTokenFile, tokenFile); err != nil {
+			fmt.Fprintf(os.Stderr, "Warning: Failed to migrate %s: %v\n", legacyTokenFile, err)
+		}
 	}
 
-	// Resolve redirect URI (depends on port, so compute after port is known).
-	defaultRedirectURI := fmt.Sprintf("http://localhost:%d/callback", callbackPort)
-	redirectURI = getConfig(*flagRedirectURI, "REDIRECT_URI", defaultRedirectURI)
+	tokenStore, err = newTokenStore(
+		strings.ToLower(getConfig(*flagTokenStore, "TOKEN_STORE", tokenStoreFile)),
+		strings.Fields(getEnv("TOKEN_STORE_COMMAND", "")),
+	)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: Invalid TOKEN_STORE: %v\n", err)
+		os.Exit(1)
+	}
 
-	if err := validateServerURL(serverURL); err != nil {
-		fmt.Fprintf(os.Stderr, "Error: Invalid SERVER_URL: %v\n", err)
+	// Resolve the redirect URI and callback ports. The callback server listens
+	// on the host and path of the redirect URI; its port, unless
+	// CALLBACK_PORT says otherwise, too. The port of the redirect URI is then
+	// replaced by the port the callback server binds (see callbackRedirectURI).
+	redirectURI = getConfig(*flagRedirectURI, "REDIRECT_URI", "")
+	defaultPort := "8888"
+	if redirectURI != "" {
+		u, err := parseRedirectURI(redirectURI)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error: Invalid REDIRECT_URI: %v\n", err)
+			os.Exit(1)
+		}
+		if u.Port() != "" {
+			defaultPort = u.Port()
+		}
+	}
+	callbackPorts, err = parseCallbackPorts(
+		getConfig(*flagCallbackPort, "CALLBACK_PORT", defaultPort),
+	)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: Invalid CALLBACK_PORT: %v\n", err)
 		os.Exit(1)
 	}
+	if redirectURI == "" {
+		redirectURI = "http://localhost/callback"
+		if callbackPorts[0] != 0 {
+			redirectURI = fmt.Sprintf("http://localhost:%d/callback", callbackPorts[0])
+		}
+	}
 
-	if strings.HasPrefix(strings.ToLower(serverURL), "http://") {
-		fmt.Fprintln(
-			os.Stderr,
-			"WARNING: Using HTTP instead of HTTPS. Tokens will be transmitted in plaintext!",
-		)
-		fmt.Fprintln(
-			os.Stderr,
-			"WARNING: This is only safe for local development. Use HTTPS in production.",
-		)
-		fmt.Fprintln(os.Stderr)
+	// Resolve the pages shown after the browser callback.
+	callbackSuccessTemplate, err = loadCallbackTemplate(
+		getConfig(*flagSuccessPage, "CALLBACK_SUCCESS_TEMPLATE", ""), callbackSuccessTemplate,
+	)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: Invalid CALLBACK_SUCCESS_TEMPLATE: %v\n", err)
+		os.Exit(1)
+	}
+	callbackFailureTemplate, err = loadCallbackTemplate(
+		getConfig(*flagFailurePage, "CALLBACK_FAILURE_TEMPLATE", ""), callbackFailureTemplate,
+	)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: Invalid CALLBACK_FAILURE_TEMPLATE: %v\n", err)
+		os.Exit(1)
+	}
+	for _, page := range []struct {
+		name, flag string
+		value      *string
+	}{
+		{"CALLBACK_SUCCESS_URL", *flagSuccessURL, &callbackSuccessURL},
+		{"CALLBACK_FAILURE_URL", *flagFailureURL, &callbackFailureURL},
+	} {
+		*page.value = getConfig(page.flag, page.name, "")
+		if *page.value == "" {
+			continue
+		}
+		if err := validateServerURL(*page.value); err != nil {
+			fmt.Fprintf(os.Stderr, "Error: Invalid %s: %v\n", page.name, err)
+			os.Exit(1)
+		}
 	}
 
-	if clientID == "" {
-		fmt.Println("Error: CLIENT_ID not set. Please provide it via:")
-		fmt.Println("  1. Command-line flag: -client-id=<your-client-id>")
-		fmt.Println("  2. Environment variable: CLIENT_ID=<your-client-id>")
-		fmt.Println("  3. .env file: CLIENT_ID=<your-client-id>")
-		fmt.Println("\nYou can find the client_id in the server startup logs.")
+	if err := validateServerURL(serverURL); err != nil {
+		fmt.Fprintf(os.Stderr, "Error: Invalid SERVER_URL: %v\n", err)
 		os.Exit(1)
 	}
 
-	if _, err := uuid.Parse(clientID); err != nil {
-		fmt.Fprintf(
-			os.Stderr,
-			"WARNING: CLIENT_ID doesn't appear to be a valid UUID: %s\n",
-			clientID,
-		)
-		fmt.Fprintln(os.Stderr)
+	// Credential helpers may take the server and client from a profile, so
+	// they check the client configuration once the profile is applied.
+	if !isCredentialHelper() {
+		if err := checkClientConfig(os.Stderr); err != nil {
+			fmt.Fprintln(os.Stderr, "Error: CLIENT_ID not set. Please provide it via:")
+			fmt.Fprintln(os.Stderr, "  1. Command-line flag: -client-id=<your-client-id>")
+			fmt.Fprintln(os.Stderr, "  2. Environment variable: CLIENT_ID=<your-client-id>")
+			fmt.Fprintln(os.Stderr, "  3. .env file: CLIENT_ID=<your-client-id>")
+			fmt.Fprintln(os.Stderr, "\nYou can find the client_id in the server startup logs.")
+			os.Exit(1)
+		}
 	}
 
 	baseHTTPClient := &http.Client{
-		Transport: &http.Transport{
+		Transport: &skewRecorder{base: &http.Transport{
 			TLSClientConfig:     &tls.Config{MinVersion: tls.VersionTLS12},
 			MaxIdleConns:        10,
 			IdleConnTimeout:     90 * time.Second,
 			TLSHandshakeTimeout: 10 * time.Second,
-		},
+		}},
 	}
 
-	var err error
 	retryClient, err = retry.NewBackgroundClient(retry.WithHTTPClient(baseHTTPClient))
 	if err != nil {
 		panic(fmt.Sprintf("failed to create retry client: %v", err))
 	}
 }
 
+// isCredentialHelper reports whether the CLI runs as a credential helper for
+// git, docker or kubectl.
+func isCredentialHelper() bool {
+	if isDockerCredentialHelper() {
+		return true
+	}
+	switch flag.Arg(0) {
+	case "git-credential", "docker-credential", "kube-credential":
+		return true
+	}
+	return false
+}
+
+// checkClientConfig fails when no client ID is configured, and warns on diag
+// about a plaintext server URL or a client ID that is not a UUID.
+func checkClientConfig(diag io.Writer) error {
+	if clientID == "" {
+		return errors.New("CLIENT_ID not set")
+	}
+
+	if strings.HasPrefix(strings.ToLower(serverURL), "http://") {
+		fmt.Fprintln(
+			diag,
+			"WARNING: Using HTTP instead of HTTPS. Tokens will be transmitted in plaintext!",
+		)
+		fmt.Fprintln(
+			diag,
+			"WARNING: This is only safe for local development. Use HTTPS in production.",
+		)
+		fmt.Fprintln(diag)
+	}
+
+	if _, err := uuid.Parse(clientID); err != nil {
+		fmt.Fprintf(diag, "WARNING: CLIENT_ID doesn't appear to be a valid UUID: %s\n", clientID)
+		fmt.Fprintln(diag)
+	}
+	return nil
+}
+
 func getConfig(flagValue, envKey, defaultValue string) string {
 	if flagValue != "" {
 		return flagValue
@@ -183,6 +450,50 @@ func getEnv(key, defaultValue string) string {
 	return defaultValue
 }
 
+// parseCallbackPorts parses the callback ports to try in order: a
+// comma-separated list of ports and ranges such as "8888,9000-9010". Port 0
+// stands for an ephemeral port.
+func parseCallbackPorts(s string) ([]int, error) {
+	var ports []int
+	for item := range strings.SplitSeq(s, ",") {
+		item = strings.TrimSpace(item)
+		lo, hi, isRange := strings.Cut(item, "-")
+		first, err := parsePort(lo)
+		if err != nil {
+			return nil, err
+		}
+		last := first
+		if isRange {
+			if last, err = parsePort(hi); err != nil {
+				return nil, err
+			}
+			if first == 0 || last < first {
+				return nil, fmt.Errorf("invalid port range %q", item)
+			}
+		}
+		for port := first; port <= last; port++ {
+			ports = append(ports, port)
+		}
+	}
+	return ports, nil
+}
+
+func parsePort(s string) (int, error) {
+	port, err := strconv.Atoi(s)
+	if err != nil || port < 0 || port > 65535 {
+		return 0, fmt.Errorf("invalid port %q", s)
+	}
+	return port, nil
+}
+
+// formatPorts formats ports for messages, e.g. "8888" or "[8888 8889]".
+func formatPorts(ports []int) string {
+	if len(ports) == 1 {
+		return strconv.Itoa(ports[0])
+	}
+	return fmt.Sprint(ports)
+}
+
 func validateServerURL(rawURL string) error {
 	if rawURL == "" {
 		return fmt.Errorf("server URL cannot be empty")
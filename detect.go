@@ -12,6 +12,11 @@ import (
 type BrowserAvailability struct {
 	Available bool
 	Reason    string // non-empty when Available is false, for logging/debugging
+
+	// Listener is the bound callback listener when Available is true. It is
+	// kept open for the browser flow so that no other process can take the
+	// port in between; the caller must close it.
+	Listener net.Listener
 }
 
 // checkBrowserAvailability determines whether a browser can be opened in the
@@ -19,12 +24,13 @@ type BrowserAvailability struct {
 //
 //  1. Environment signals: SSH sessions without display forwarding, Linux
 //     hosts with no display server.
-//  2. Callback port availability: the local redirect server must be bindable.
+//  2. Callback port availability: the local redirect server must be bindable
+//     on one of ports.
 //
 // This function never attempts to open a browser itself; it only inspects
 // the environment. Callers that pass the check should still handle
 // openBrowser() failures as a secondary fallback.
-func checkBrowserAvailability(ctx context.Context, port int) BrowserAvailability {
+func checkBrowserAvailability(ctx context.Context, ports []int) BrowserAvailability {
 	// Stage 1a: SSH without X11/Wayland forwarding.
 	// SSH_TTY / SSH_CLIENT / SSH_CONNECTION indicate a remote shell.
 	// If a display is also present (X11 forwarding), the browser can still open.
@@ -35,25 +41,22 @@ func checkBrowserAvailability(ctx context.Context, port int) BrowserAvailability
 	hasDisplay := os.Getenv("DISPLAY") != "" || os.Getenv("WAYLAND_DISPLAY") != ""
 
 	if inSSH && !hasDisplay {
-		return BrowserAvailability{false, "SSH session without display forwarding"}
+		return BrowserAvailability{Reason: "SSH session without display forwarding"}
 	}
 
 	// Stage 1b: Linux with no display server at all (headless / Docker / CI).
 	if runtime.GOOS == "linux" && !hasDisplay {
-		return BrowserAvailability{false, "no display server (DISPLAY/WAYLAND_DISPLAY not set)"}
+		return BrowserAvailability{Reason: "no display server (DISPLAY/WAYLAND_DISPLAY not set)"}
 	}
 
-	// Stage 2: Verify the callback port can be bound.
-	// A busy port means the redirect server cannot start.
-	lc := &net.ListenConfig{}
-	ln, err := lc.Listen(ctx, "tcp", fmt.Sprintf("127.0.0.1:%d", port))
+	// Stage 2: Bind the callback port.
+	// Busy ports mean the redirect server cannot start.
+	ln, err := listenCallback(ctx, ports)
 	if err != nil {
 		return BrowserAvailability{
-			false,
-			fmt.Sprintf("callback port %d unavailable: %v", port, err),
+			Reason: fmt.Sprintf("callback port %s unavailable: %v", formatPorts(ports), err),
 		}
 	}
-	ln.Close()
 
-	return BrowserAvailability{Available: true}
+	return BrowserAvailability{Available: true, Listener: ln}
 }
@@ -13,7 +13,7 @@ func TestCheckBrowserAvailability_SSH_NoDisplay(t *testing.T) {
 	t.Setenv("DISPLAY", "")
 	t.Setenv("WAYLAND_DISPLAY", "")
 
-	avail := checkBrowserAvailability(context.Background(), 18888)
+	avail := checkBrowserAvailability(context.Background(), []int{18888})
 
 	if avail.Available {
 		t.Error("expected browser unavailable in SSH session without display")
@@ -30,7 +30,7 @@ func TestCheckBrowserAvailability_SSHClient_NoDisplay(t *testing.T) {
 	t.Setenv("DISPLAY", "")
 	t.Setenv("WAYLAND_DISPLAY", "")
 
-	avail := checkBrowserAvailability(context.Background(), 18888)
+	avail := checkBrowserAvailability(context.Background(), []int{18888})
 
 	if avail.Available {
 		t.Error("expected browser unavailable when SSH_CLIENT set and no display")
@@ -44,7 +44,7 @@ func TestCheckBrowserAvailability_SSHConnection_NoDisplay(t *testing.T) {
 	t.Setenv("DISPLAY", "")
 	t.Setenv("WAYLAND_DISPLAY", "")
 
-	avail := checkBrowserAvailability(context.Background(), 18888)
+	avail := checkBrowserAvailability(context.Background(), []int{18888})
 
 	if avail.Available {
 		t.Error("expected browser unavailable when SSH_CONNECTION set and no display")
@@ -66,7 +66,10 @@ func TestCheckBrowserAvailability_SSH_WithX11(t *testing.T) {
 	port := ln.Addr().(*net.TCPAddr).Port
 	ln.Close()
 
-	avail := checkBrowserAvailability(context.Background(), port)
+	avail := checkBrowserAvailability(context.Background(), []int{port})
+	if avail.Listener != nil {
+		defer avail.Listener.Close()
+	}
 
 	// X11 forwarding over SSH should be detected as browser-capable
 	// (DISPLAY is set, port is free).
@@ -93,7 +96,7 @@ func TestCheckBrowserAvailability_PortUnavailable(t *testing.T) {
 	t.Setenv("DISPLAY", ":0")
 	t.Setenv("WAYLAND_DISPLAY", "")
 
-	avail := checkBrowserAvailability(context.Background(), port)
+	avail := checkBrowserAvailability(context.Background(), []int{port})
 
 	if avail.Available {
 		t.Errorf("expected browser unavailable when port %d is busy", port)
@@ -118,7 +121,10 @@ func TestCheckBrowserAvailability_PortAvailable(t *testing.T) {
 	t.Setenv("DISPLAY", ":0")
 	t.Setenv("WAYLAND_DISPLAY", "")
 
-	avail := checkBrowserAvailability(context.Background(), port)
+	avail := checkBrowserAvailability(context.Background(), []int{port})
+	if avail.Listener != nil {
+		defer avail.Listener.Close()
+	}
 
 	if !avail.Available {
 		t.Errorf(
@@ -142,9 +148,45 @@ func TestCheckBrowserAvailability_ReasonIsEmptyWhenAvailable(t *testing.T) {
 	t.Setenv("DISPLAY", ":0")
 	t.Setenv("WAYLAND_DISPLAY", "")
 
-	avail := checkBrowserAvailability(context.Background(), port)
+	avail := checkBrowserAvailability(context.Background(), []int{port})
+	if avail.Listener != nil {
+		defer avail.Listener.Close()
+	}
 
 	if avail.Available && avail.Reason != "" {
 		t.Errorf("expected empty reason when browser is available, got: %s", avail.Reason)
 	}
 }
+
+func TestCheckBrowserAvailability_FallbackPort(t *testing.T) {
+	busy, err := (&net.ListenConfig{}).Listen(context.Background(), "tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Skip("cannot bind test port")
+	}
+	defer busy.Close()
+	busyPort := busy.Addr().(*net.TCPAddr).Port
+
+	t.Setenv("SSH_TTY", "")
+	t.Setenv("SSH_CLIENT", "")
+	t.Setenv("SSH_CONNECTION", "")
+	t.Setenv("DISPLAY", ":0")
+	t.Setenv("WAYLAND_DISPLAY", "")
+
+	// The busy port is skipped in favour of an ephemeral one, and the
+	// listener stays bound for the callback server.
+	avail := checkBrowserAvailability(context.Background(), []int{busyPort, 0})
+	if !avail.Available || avail.Listener == nil {
+		t.Fatalf("expected browser available on a fallback port, got reason: %s", avail.Reason)
+	}
+	defer avail.Listener.Close()
+
+	port := avail.Listener.Addr().(*net.TCPAddr).Port
+	if port == busyPort || port == 0 {
+		t.Errorf("callback listener bound port %d, want an ephemeral port", port)
+	}
+	if _, err := (&net.ListenConfig{}).Listen(
+		context.Background(), "tcp", avail.Listener.Addr().String(),
+	); err == nil {
+		t.Error("callback port was released after detection")
+	}
+}
@@ -16,62 +16,76 @@ import (
 
 // performDeviceFlow runs the OAuth 2.0 Device Authorization Grant (RFC 8628)
 // and returns tokens on success.
-func performDeviceFlow(ctx context.Context) (*TokenStorage, error) {
+func performDeviceFlow(
+	ctx context.Context,
+	diag io.Writer,
+	params authParams,
+) (*TokenStorage, error) {
 	config := &oauth2.Config{
 		ClientID: clientID,
 		Endpoint: oauth2.Endpoint{
 			DeviceAuthURL: serverURL + "/oauth/device/code",
 			TokenURL:      serverURL + "/oauth/token",
 		},
-		Scopes: strings.Fields(scope),
+		Scopes: strings.Fields(params.requestedScope()),
 	}
 
-	fmt.Println("Step 1: Requesting device code...")
-	deviceAuth, err := requestDeviceCode(ctx)
+	fmt.Fprintln(diag, "Step 1: Requesting device code...")
+	deviceAuth, err := requestDeviceCode(ctx, params)
 	if err != nil {
 		return nil, fmt.Errorf("device code request failed: %w", err)
 	}
 
-	fmt.Printf("\n----------------------------------------\n")
-	fmt.Printf("Please open this link to authorize:\n%s\n", deviceAuth.VerificationURIComplete)
-	fmt.Printf("\nOr visit : %s\n", deviceAuth.VerificationURI)
-	fmt.Printf("And enter: %s\n", deviceAuth.UserCode)
-	fmt.Printf("----------------------------------------\n\n")
+	fmt.Fprintf(diag, "\n----------------------------------------\n")
+	fmt.Fprintf(
+		diag,
+		"Please open this link to authorize:\n%s\n",
+		deviceAuth.VerificationURIComplete,
+	)
+	fmt.Fprintf(diag, "\nOr visit : %s\n", deviceAuth.VerificationURI)
+	fmt.Fprintf(diag, "And enter: %s\n", deviceAuth.UserCode)
+	fmt.Fprintf(diag, "----------------------------------------\n\n")
 
-	fmt.Println("Step 2: Waiting for authorization...")
-	token, err := pollForTokenWithProgress(ctx, config, deviceAuth)
+	fmt.Fprintln(diag, "Step 2: Waiting for authorization...")
+	token, err := pollForTokenWithProgress(ctx, diag, config, deviceAuth)
 	if err != nil {
 		return nil, fmt.Errorf("token poll failed: %w", err)
 	}
 
-	fmt.Println("\nAuthorization successful!")
+	fmt.Fprintln(diag, "\nAuthorization successful!")
 
 	storage := &TokenStorage{
 		AccessToken:  token.AccessToken,
 		RefreshToken: token.RefreshToken,
 		TokenType:    token.Type(),
-		ExpiresAt:    token.Expiry,
+		ExpiresAt:    serverTime(token.Expiry),
+		IssuedAt:     serverNow(),
+		ClockSkew:    currentClockSkew(),
 		ClientID:     clientID,
 		Flow:         "device",
+		Scope:        tokenScope(token),
+		IDToken:      tokenIDToken(token),
+		Identity:     tokenIdentity(token),
 	}
+	recordGrantedScope(diag, storage, params.requestedScope())
 
 	if err := saveTokens(storage); err != nil {
-		fmt.Printf("Warning: Failed to save tokens: %v\n", err)
+		fmt.Fprintf(diag, "Warning: Failed to save tokens: %v\n", err)
 	} else {
-		fmt.Printf("Tokens saved to %s\n", tokenFile)
+		fmt.Fprintf(diag, "Tokens saved to %s\n", activeTokenStore())
 	}
 
 	return storage, nil
 }
 
 // requestDeviceCode requests a device code from the OAuth server.
-func requestDeviceCode(ctx context.Context) (*oauth2.DeviceAuthResponse, error) {
+func requestDeviceCode(ctx context.Context, params authParams) (*oauth2.DeviceAuthResponse, error) {
 	reqCtx, cancel := context.WithTimeout(ctx, deviceCodeRequestTimeout)
 	defer cancel()
 
 	data := url.Values{}
 	data.Set("client_id", clientID)
-	data.Set("scope", scope)
+	params.setAuthParams(data)
 
 	req, err := http.NewRequestWithContext(
 		reqCtx,
@@ -129,10 +143,35 @@ func requestDeviceCode(ctx context.Context) (*oauth2.DeviceAuthResponse, error)
 // Implements exponential backoff for slow_down errors per RFC 8628.
 func pollForTokenWithProgress(
 	ctx context.Context,
+	diag io.Writer,
 	config *oauth2.Config,
 	deviceAuth *oauth2.DeviceAuthResponse,
 ) (*oauth2.Token, error) {
-	interval := deviceAuth.Interval
+	const expiredMsg = "device code expired, please restart the flow"
+	return pollTokenEndpoint(ctx, diag, deviceAuth.Interval, expiredMsg,
+		func(ctx context.Context) (*oauth2.Token, error) {
+			return exchangeDeviceCode(
+				ctx,
+				config.Endpoint.TokenURL,
+				config.ClientID,
+				deviceAuth.DeviceCode,
+			)
+		})
+}
+
+// pollTokenEndpoint calls exchange every interval seconds (default 5) until
+// it returns a token or a terminal error, printing progress dots meanwhile.
+// It handles the polling error codes shared by the Device Authorization Grant
+// (RFC 8628 §3.5) and CIBA (CIBA Core §11): authorization_pending, slow_down
+// (with exponential backoff up to 60 s), expired_token and access_denied.
+// expiredMsg is the error message returned for expired_token.
+func pollTokenEndpoint(
+	ctx context.Context,
+	diag io.Writer,
+	interval int64,
+	expiredMsg string,
+	exchange func(context.Context) (*oauth2.Token, error),
+) (*oauth2.Token, error) {
 	if interval == 0 {
 		interval = 5
 	}
@@ -153,16 +192,11 @@ func pollForTokenWithProgress(
 	for {
 		select {
 		case <-ctx.Done():
-			fmt.Println()
+			fmt.Fprintln(diag)
 			return nil, ctx.Err()
 
 		case <-pollTicker.C:
-			token, err := exchangeDeviceCode(
-				ctx,
-				config.Endpoint.TokenURL,
-				config.ClientID,
-				deviceAuth.DeviceCode,
-			)
+			token, err := exchange(ctx)
 			if err != nil {
 				var oauthErr *oauth2.RetrieveError
 				if errors.As(err, &oauthErr) {
@@ -183,15 +217,15 @@ func pollForTokenWithProgress(
 							continue
 
 						case "expired_token":
-							fmt.Println()
-							return nil, fmt.Errorf("device code expired, please restart the flow")
+							fmt.Fprintln(diag)
+							return nil, errors.New(expiredMsg)
 
 						case "access_denied":
-							fmt.Println()
+							fmt.Fprintln(diag)
 							return nil, fmt.Errorf("user denied authorization")
 
 						default:
-							fmt.Println()
+							fmt.Fprintln(diag)
 							return nil, fmt.Errorf(
 								"authorization failed: %s - %s",
 								errResp.Error,
@@ -200,20 +234,20 @@ func pollForTokenWithProgress(
 						}
 					}
 				}
-				fmt.Println()
+				fmt.Fprintln(diag)
 				return nil, fmt.Errorf("token exchange failed: %w", err)
 			}
 
-			fmt.Println()
+			fmt.Fprintln(diag)
 			return token, nil
 
 		case <-ticker.C:
 			if time.Since(lastUpdate) >= uiUpdateInterval {
-				fmt.Print(".")
+				fmt.Fprint(diag, ".")
 				dotCount++
 				lastUpdate = time.Now()
 				if dotCount%50 == 0 {
-					fmt.Println()
+					fmt.Fprintln(diag)
 				}
 			}
 		}
@@ -225,13 +259,23 @@ func exchangeDeviceCode(
 	ctx context.Context,
 	tokenURL, cID, deviceCode string,
 ) (*oauth2.Token, error) {
-	reqCtx, cancel := context.WithTimeout(ctx, tokenExchangeTimeout)
-	defer cancel()
-
 	data := url.Values{}
 	data.Set("grant_type", "urn:ietf:params:oauth:grant-type:device_code")
 	data.Set("device_code", deviceCode)
 	data.Set("client_id", cID)
+	return postTokenRequest(ctx, tokenURL, data)
+}
+
+// postTokenRequest sends a token request to tokenURL and parses the response.
+// A non-200 answer is returned as an *oauth2.RetrieveError so that pollers can
+// inspect the OAuth error code. The granted scope is available via tokenScope.
+func postTokenRequest(
+	ctx context.Context,
+	tokenURL string,
+	data url.Values,
+) (*oauth2.Token, error) {
+	reqCtx, cancel := context.WithTimeout(ctx, tokenExchangeTimeout)
+	defer cancel()
 
 	req, err := http.NewRequestWithContext(
 		reqCtx,
@@ -262,12 +306,7 @@ func exchangeDeviceCode(
 		}
 	}
 
-	var tokenResp struct {
-		AccessToken  string `json:"access_token"`
-		RefreshToken string `json:"refresh_token"`
-		TokenType    string `json:"token_type"`
-		ExpiresIn    int    `json:"expires_in"`
-	}
+	var tokenResp tokenResponse
 	if err := json.Unmarshal(body, &tokenResp); err != nil {
 		return nil, fmt.Errorf("failed to parse token response: %w", err)
 	}
@@ -280,10 +319,14 @@ func exchangeDeviceCode(
 		return nil, fmt.Errorf("invalid token response: %w", err)
 	}
 
-	return &oauth2.Token{
+	token := &oauth2.Token{
 		AccessToken:  tokenResp.AccessToken,
 		RefreshToken: tokenResp.RefreshToken,
 		TokenType:    tokenResp.TokenType,
 		Expiry:       time.Now().Add(time.Duration(tokenResp.ExpiresIn) * time.Second),
-	}, nil
+	}
+	return token.WithExtra(map[string]any{
+		"scope":    tokenResp.Scope,
+		"id_token": tokenResp.IDToken,
+	}), nil
 }
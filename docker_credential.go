@@ -0,0 +1,181 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// dockerCredentialHelperName is the executable name under which the CLI acts
+// as a docker credential helper (docker looks up "docker-credential-<name>"
+// for credsStore/credHelpers entries).
+const dockerCredentialHelperName = "docker-credential-authgate"
+
+// dockerIdentityTokenUser is the username that tells docker the secret is an
+// identity token rather than a password.
+const dockerIdentityTokenUser = "<token>"
+
+// errDockerCredentialsNotFound is the message docker recognizes as "no
+// credentials for this registry".
+var errDockerCredentialsNotFound = errors.New("credentials not found in native keychain")
+
+// dockerCredentials is the credential format of the helper protocol.
+type dockerCredentials struct {
+	ServerURL string `json:"ServerURL"`
+	Username  string `json:"Username"`
+	Secret    string `json:"Secret"`
+}
+
+// isDockerCredentialHelper reports whether the CLI was invoked as
+// docker-credential-authgate, e.g. through a symlink.
+func isDockerCredentialHelper() bool {
+	name := strings.TrimSuffix(filepath.Base(os.Args[0]), ".exe")
+	return name == dockerCredentialHelperName
+}
+
+// registryHost returns the host of a registry server URL as docker passes it:
+// "registry.example.com", "registry.example.com:5000" or
+// "https://registry.example.com/v2/".
+func registryHost(serverURL string) string {
+	serverURL = strings.TrimSpace(serverURL)
+	if !strings.Contains(serverURL, "://") {
+		serverURL = "https://" + serverURL
+	}
+	u, err := url.Parse(serverURL)
+	if err != nil {
+		return ""
+	}
+	return u.Host
+}
+
+// runDockerCredential implements the docker credential helper protocol. The
+// operation is args[0]; its input is read from stdin and its result written
+// to stdout. Errors are written to stdout too, which is where docker looks
+// for them.
+//
+// "get" answers for registries listed in a profile with the access token, or
+// with the refresh token as identity token when the profile sets
+// identity_token, unless the rotation journal shows that the server rotates
+// refresh tokens. "list" lists those registries. "store" and "erase" do
+// nothing: the credentials come from the token store, and removing them is
+// "logout".
+func runDockerCredential(ctx context.Context, args []string) int {
+	if len(args) != 1 {
+		fmt.Fprintf(os.Stderr, "Usage: %s get|store|erase|list\n", dockerCredentialHelperName)
+		return 2
+	}
+	out := os.Stdout
+
+	var err error
+	switch args[0] {
+	case "get":
+		err = dockerCredentialGet(ctx, os.Stdin, out, isTerminal(os.Stderr))
+	case "list":
+		err = dockerCredentialList(out)
+	case "store", "erase":
+		_, err = io.Copy(io.Discard, os.Stdin)
+	default:
+		err = fmt.Errorf("unknown credential action %q", args[0])
+	}
+	if err != nil {
+		fmt.Fprintln(out, err)
+		return 1
+	}
+	return 0
+}
+
+// dockerCredentialGet reads a registry server URL from in and writes its
+// credentials to out.
+func dockerCredentialGet(ctx context.Context, in io.Reader, out io.Writer, interactive bool) error {
+	data, err := io.ReadAll(in)
+	if err != nil {
+		return err
+	}
+	registry := strings.TrimSpace(string(data))
+	_, p, err := profileForHost(registryHost(registry))
+	if err != nil {
+		return err
+	}
+	if p == nil {
+		return errDockerCredentialsNotFound
+	}
+	p.apply()
+	if err := checkClientConfig(os.Stderr); err != nil {
+		return err
+	}
+
+	storage, err := obtainToken(ctx, os.Stderr, "", interactive)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "authgate: no token for %s: %v\n", registry, err)
+		return errDockerCredentialsNotFound
+	}
+
+	creds := dockerCredentials{
+		ServerURL: registry,
+		Username:  p.Username,
+		Secret:    storage.AccessToken,
+	}
+	if creds.Username == "" {
+		creds.Username = defaultCredentialUsername
+	}
+	if p.IdentityToken {
+		// The token agent never hands out refresh tokens; read the store.
+		if storage.RefreshToken == "" {
+			if stored, err := loadTokens(); err == nil {
+				storage = stored
+			}
+		}
+		if storage.RefreshToken == "" {
+			fmt.Fprintf(os.Stderr, "authgate: no refresh token for %s\n", registry)
+			return errDockerCredentialsNotFound
+		}
+		// With rotation, whichever of the registry and the CLI refreshes
+		// first invalidates the other's copy, and a replay of the old token
+		// may make the server revoke the whole grant.
+		if journal, err := loadRefreshJournal(); err == nil &&
+			issuedByRotation(journal, storage.RefreshToken) {
+			fmt.Fprintf(
+				os.Stderr,
+				"authgate: refusing identity_token for %s: the server rotates refresh tokens\n",
+				registry,
+			)
+			return errDockerCredentialsNotFound
+		}
+		fmt.Fprintf(
+			os.Stderr,
+			"authgate: WARNING: %s gets the refresh token; unsafe if the server rotates it\n",
+			registry,
+		)
+		creds.Username, creds.Secret = dockerIdentityTokenUser, storage.RefreshToken
+	}
+	return json.NewEncoder(out).Encode(creds)
+}
+
+// dockerCredentialList writes the registries listed in profiles, with the
+// username get would answer with.
+func dockerCredentialList(out io.Writer) error {
+	profiles, err := loadProfiles()
+	if err != nil {
+		return err
+	}
+	list := map[string]string{}
+	for _, p := range profiles {
+		username := p.Username
+		switch {
+		case p.IdentityToken:
+			username = dockerIdentityTokenUser
+		case username == "":
+			username = defaultCredentialUsername
+		}
+		for _, host := range p.Hosts {
+			list[host] = username
+		}
+	}
+	return json.NewEncoder(out).Encode(list)
+}
@@ -0,0 +1,160 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+// setupDockerCredential serves registry.example.com with plain access tokens
+// and id.example.com with identity tokens, both from the "git" account of
+// setupGitCredential.
+func setupDockerCredential(t *testing.T) {
+	t.Helper()
+	setupGitCredential(t, "https://auth.example.com")
+	profiles := `{"profiles": {
+		"registry": {
+			"server_url": "https://auth.example.com",
+			"client_id": "git-client",
+			"account": "git",
+			"hosts": ["registry.example.com:5000"]
+		},
+		"identity": {
+			"server_url": "https://auth.example.com",
+			"client_id": "git-client",
+			"account": "git",
+			"identity_token": true,
+			"hosts": ["id.example.com"]
+		}
+	}}`
+	if err := os.WriteFile(profilesFile, []byte(profiles), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	saveGitTokens(t, "https://auth.example.com", &TokenStorage{
+		AccessToken:  "registry-access-token",
+		RefreshToken: "registry-refresh-token",
+		TokenType:    "Bearer",
+		ExpiresAt:    time.Now().Add(time.Hour),
+	})
+}
+
+func TestRegistryHost(t *testing.T) {
+	for in, want := range map[string]string{
+		"registry.example.com":             "registry.example.com",
+		"registry.example.com:5000":        "registry.example.com:5000",
+		"https://registry.example.com/v2/": "registry.example.com",
+		" id.example.com\n":                "id.example.com",
+	} {
+		if got := registryHost(in); got != want {
+			t.Errorf("registryHost(%q) = %q, want %q", in, got, want)
+		}
+	}
+}
+
+func TestDockerCredentialGet(t *testing.T) {
+	setupDockerCredential(t)
+
+	tests := []struct {
+		registry string
+		username string
+		secret   string
+	}{
+		{"https://registry.example.com:5000", "oauth2", "registry-access-token"},
+		{"id.example.com", dockerIdentityTokenUser, "registry-refresh-token"},
+	}
+	for _, tt := range tests {
+		var out bytes.Buffer
+		in := strings.NewReader(tt.registry + "\n")
+		if err := dockerCredentialGet(context.Background(), in, &out, false); err != nil {
+			t.Fatalf("get %s: %v", tt.registry, err)
+		}
+		var creds dockerCredentials
+		if err := json.Unmarshal(out.Bytes(), &creds); err != nil {
+			t.Fatal(err)
+		}
+		if creds.ServerURL != tt.registry || creds.Username != tt.username ||
+			creds.Secret != tt.secret {
+			t.Errorf("get %s = %+v", tt.registry, creds)
+		}
+	}
+
+	var out bytes.Buffer
+	err := dockerCredentialGet(context.Background(), strings.NewReader("docker.io"), &out, false)
+	if !errors.Is(err, errDockerCredentialsNotFound) || out.Len() != 0 {
+		t.Errorf("get for an unconfigured registry = %q, %v", out.String(), err)
+	}
+}
+
+func TestDockerCredentialList(t *testing.T) {
+	setupDockerCredential(t)
+
+	var out bytes.Buffer
+	if err := dockerCredentialList(&out); err != nil {
+		t.Fatal(err)
+	}
+	var list map[string]string
+	if err := json.Unmarshal(out.Bytes(), &list); err != nil {
+		t.Fatal(err)
+	}
+	// The git profile of setupGitCredential was replaced.
+	want := map[string]string{
+		"registry.example.com:5000": "oauth2",
+		"id.example.com":            dockerIdentityTokenUser,
+	}
+	if len(list) != len(want) {
+		t.Errorf("list = %v, want %v", list, want)
+	}
+	for host, user := range want {
+		if list[host] != user {
+			t.Errorf("list[%s] = %q, want %q", host, list[host], user)
+		}
+	}
+}
+
+func TestDockerCredentialGet_RotatingIdentityToken(t *testing.T) {
+	setupDockerCredential(t)
+	// The memory store keeps no rotation journal; use the file store.
+	tokenStore = &fileTokenStore{path: tokenFile}
+	saveGitTokens(t, "https://auth.example.com", &TokenStorage{
+		AccessToken:  "registry-access-token",
+		RefreshToken: "registry-refresh-token",
+		TokenType:    "Bearer",
+		ExpiresAt:    time.Now().Add(time.Hour),
+	})
+
+	get := func(registry string) (string, error) {
+		var out bytes.Buffer
+		err := dockerCredentialGet(
+			context.Background(),
+			strings.NewReader(registry),
+			&out,
+			false,
+		)
+		return out.String(), err
+	}
+	if _, err := get("id.example.com"); err != nil {
+		t.Fatalf("get before any rotation: %v", err)
+	}
+
+	if err := appendRefreshJournal(journalEntry{
+		RotatedAt:            time.Now(),
+		ClientID:             "git-client",
+		ServerURL:            normalizeServerURL("https://auth.example.com"),
+		PreviousRefreshToken: "initial-refresh-token",
+		RefreshToken:         "registry-refresh-token",
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if out, err := get("id.example.com"); !errors.Is(err, errDockerCredentialsNotFound) ||
+		out != "" {
+		t.Errorf("get for a rotated refresh token = %q, %v; want it refused", out, err)
+	}
+	if _, err := get("registry.example.com:5000"); err != nil {
+		t.Errorf("get with the access token: %v", err)
+	}
+}
@@ -0,0 +1,154 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"net/http"
+	"os"
+	"time"
+)
+
+// runStatus prints the stored tokens of the current account without
+// contacting the server, and warns when they were issued by a server whose
+// clock was far off the local one.
+func runStatus(args []string) int {
+	fs := flag.NewFlagSet("status", flag.ContinueOnError)
+	if code, ok := parseCommandFlags(fs, args); !ok {
+		return code
+	}
+
+	fmt.Printf("Server       : %s\n", serverURL)
+	fmt.Printf("Client ID    : %s\n", clientID)
+	fmt.Printf("Account      : %s\n", currentAccount())
+	fmt.Printf("Token Store  : %s\n", activeTokenStore())
+
+	storage, err := loadTokens()
+	if errors.Is(err, ErrTokenNotFound) {
+		fmt.Println("Tokens       : none (run \"login\")")
+		return 1
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to load tokens: %v\n", err)
+		return 1
+	}
+
+	if storage.Identity != nil {
+		fmt.Printf("Identity     : %s\n", storage.Identity)
+	}
+	fmt.Printf("Granted Scope: %s\n", storage.Scope)
+	if tokenExpired(storage) {
+		fmt.Println("Expires In   : expired")
+	} else {
+		fmt.Printf("Expires In   : %s\n", tokenRemaining(storage).Round(time.Second))
+	}
+	fmt.Printf("Refreshable  : %t\n", storage.RefreshToken != "")
+	fmt.Printf("Clock Skew   : %s\n", describeClockSkew(storage.ClockSkew))
+	if clockSkewExcessive(storage.ClockSkew) {
+		fmt.Printf(
+			"Warning: The %s when the tokens were issued; check the system clock.\n",
+			describeClockSkew(storage.ClockSkew),
+		)
+	}
+	return 0
+}
+
+// doctorCheck is the outcome of one doctor check.
+type doctorCheck struct {
+	level   string // "ok", "warn" or "fail"
+	message string
+}
+
+// runDoctor checks the configuration, the token store, the current tokens and
+// the server, including how far the local clock is off the server's. It
+// exits non-zero when a check fails.
+func runDoctor(ctx context.Context, args []string) int {
+	fs := flag.NewFlagSet("doctor", flag.ContinueOnError)
+	if code, ok := parseCommandFlags(fs, args); !ok {
+		return code
+	}
+
+	checks := []doctorCheck{
+		{"ok", fmt.Sprintf("client %s of %s, account %s", clientID, serverURL, currentAccount())},
+		checkTokenStore(),
+		checkStoredTokens(),
+	}
+	checks = append(checks, checkServer(ctx)...)
+
+	failed := false
+	for _, c := range checks {
+		fmt.Printf("[%-4s] %s\n", c.level, c.message)
+		failed = failed || c.level == "fail"
+	}
+	if failed {
+		return 1
+	}
+	return 0
+}
+
+// checkTokenStore reports whether the token store can be read.
+func checkTokenStore() doctorCheck {
+	store := activeTokenStore()
+	if _, err := store.List(); err != nil {
+		return doctorCheck{"fail", fmt.Sprintf("token store %s: %v", store, err)}
+	}
+	return doctorCheck{"ok", fmt.Sprintf("token store %s is readable", store)}
+}
+
+// checkStoredTokens reports on the current account's tokens.
+func checkStoredTokens() doctorCheck {
+	storage, err := loadTokens()
+	if errors.Is(err, ErrTokenNotFound) {
+		return doctorCheck{"warn", "no tokens for the current account (run \"login\")"}
+	}
+	if err != nil {
+		return doctorCheck{"fail", fmt.Sprintf("tokens: %v", err)}
+	}
+	switch {
+	case clockSkewExcessive(storage.ClockSkew):
+		return doctorCheck{"warn", fmt.Sprintf(
+			"tokens were issued while the %s",
+			describeClockSkew(storage.ClockSkew),
+		)}
+	case tokenExpired(storage) && storage.RefreshToken == "":
+		return doctorCheck{"warn", "access token expired and there is no refresh token"}
+	case tokenExpired(storage):
+		return doctorCheck{"ok", "access token expired; it will be refreshed on next use"}
+	}
+	return doctorCheck{"ok", fmt.Sprintf(
+		"access token valid for %s",
+		tokenRemaining(storage).Round(time.Second),
+	)}
+}
+
+// checkServer contacts the server and compares its Date header with the local
+// clock. Any HTTP response counts as reachable.
+func checkServer(ctx context.Context) []doctorCheck {
+	ctx, cancel := context.WithTimeout(ctx, serverCheckTimeout)
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, serverURL+"/oauth/tokeninfo", nil)
+	if err != nil {
+		return []doctorCheck{{"fail", fmt.Sprintf("server %s: %v", serverURL, err)}}
+	}
+	resp, err := retryClient.DoWithContext(ctx, req)
+	if err != nil {
+		return []doctorCheck{{"fail", fmt.Sprintf("server %s is unreachable: %v", serverURL, err)}}
+	}
+	received := time.Now()
+	resp.Body.Close()
+
+	reachable := doctorCheck{"ok", fmt.Sprintf("server %s is reachable", serverURL)}
+	clock := doctorCheck{"warn", "no Date header from the server; clock not checked"}
+	if skew, ok := clockSkewFromDate(resp.Header.Get("Date"), received); ok {
+		clock = doctorCheck{"ok", "clock " + describeClockSkew(skew)}
+		if clockSkewExcessive(skew) {
+			clock = doctorCheck{"warn", fmt.Sprintf(
+				"%s; token expiry is checked on the server's clock, but check the system clock",
+				describeClockSkew(skew),
+			)}
+		}
+	}
+	return []doctorCheck{reachable, clock}
+}
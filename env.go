@@ -0,0 +1,97 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"time"
+)
+
+// Shells supported by "env --shell".
+const (
+	shellBash       = "bash"
+	shellZsh        = "zsh"
+	shellFish       = "fish"
+	shellPowerShell = "powershell"
+)
+
+// defaultShell guesses the user's shell from $SHELL, or PowerShell on
+// Windows. It falls back to bash.
+func defaultShell() string {
+	switch filepath.Base(os.Getenv("SHELL")) {
+	case shellZsh:
+		return shellZsh
+	case shellFish:
+		return shellFish
+	}
+	if runtime.GOOS == "windows" {
+		return shellPowerShell
+	}
+	return shellBash
+}
+
+// shellAssignment returns a statement that sets the environment variable name
+// to value in shell, quoting value so that it is taken literally.
+func shellAssignment(shell, name, value string) string {
+	switch shell {
+	case shellFish:
+		quoted := strings.NewReplacer(`\`, `\\`, `'`, `\'`).Replace(value)
+		return fmt.Sprintf("set -gx %s '%s';", name, quoted)
+	case shellPowerShell:
+		return fmt.Sprintf("$Env:%s = '%s'", name, strings.ReplaceAll(value, "'", "''"))
+	default: // POSIX shells
+		return fmt.Sprintf("export %s='%s'", name, strings.ReplaceAll(value, "'", `'\''`))
+	}
+}
+
+// runEnv prints statements that export the current access token for tools
+// that read it from the environment:
+//
+//	eval "$(authgate-cli env)"
+func runEnv(ctx context.Context, args []string) int {
+	fs := flag.NewFlagSet("env", flag.ContinueOnError)
+	shell := fs.String("shell", defaultShell(), "Shell syntax: bash, zsh, fish or powershell")
+	if code, ok := parseCommandFlags(fs, args); !ok {
+		return code
+	}
+	switch *shell {
+	case shellBash, shellZsh, shellFish, shellPowerShell:
+	default:
+		fmt.Fprintf(
+			os.Stderr,
+			"Error: invalid --shell %q (must be bash, zsh, fish or powershell)\n",
+			*shell,
+		)
+		return 2
+	}
+
+	storage, err := obtainToken(ctx, os.Stderr, "", true)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to obtain token: %v\n", err)
+		return 1
+	}
+	writeEnv(os.Stdout, *shell, storage)
+	return 0
+}
+
+// writeEnv writes the export statements for storage in shell syntax.
+func writeEnv(out io.Writer, shell string, storage *TokenStorage) {
+	tokenType := storage.TokenType
+	if tokenType == "" {
+		tokenType = "Bearer"
+	}
+	vars := []struct{ name, value string }{
+		{"AUTHGATE_ACCESS_TOKEN", storage.AccessToken},
+		{"AUTHGATE_TOKEN_TYPE", tokenType},
+		{"AUTHGATE_EXPIRES_AT", localExpiry(storage).UTC().Format(time.RFC3339)},
+		{"AUTHGATE_SERVER_URL", serverURL},
+	}
+	for _, v := range vars {
+		fmt.Fprintln(out, shellAssignment(shell, v.name, v.value))
+	}
+}
@@ -0,0 +1,53 @@
+package main
+
+import (
+	"bytes"
+	"os/exec"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestShellAssignment(t *testing.T) {
+	value := `it's a "token" with $HOME and \n`
+	tests := map[string]string{
+		shellBash:       `export X='it'\''s a "token" with $HOME and \n'`,
+		shellZsh:        `export X='it'\''s a "token" with $HOME and \n'`,
+		shellFish:       `set -gx X 'it\'s a "token" with $HOME and \\n';`,
+		shellPowerShell: `$Env:X = 'it''s a "token" with $HOME and \n'`,
+	}
+	for shell, want := range tests {
+		if got := shellAssignment(shell, "X", value); got != want {
+			t.Errorf("%s: got %s, want %s", shell, got, want)
+		}
+	}
+
+	// The POSIX quoting round-trips through a real shell.
+	sh, err := exec.LookPath("sh")
+	if err != nil {
+		t.Skip("no sh")
+	}
+	script := shellAssignment(shellBash, "X", value) + `; printf %s "$X"`
+	out, err := exec.Command(sh, "-c", script).Output()
+	if err != nil || string(out) != value {
+		t.Errorf("sh printed %q, %v; want %q", out, err, value)
+	}
+}
+
+func TestWriteEnv(t *testing.T) {
+	var out bytes.Buffer
+	writeEnv(&out, shellBash, &TokenStorage{
+		AccessToken: "env-access-token",
+		ExpiresAt:   time.Date(2026, 1, 1, 12, 0, 0, 0, time.UTC),
+	})
+	for _, want := range []string{
+		"export AUTHGATE_ACCESS_TOKEN='env-access-token'",
+		"export AUTHGATE_TOKEN_TYPE='Bearer'",
+		"export AUTHGATE_EXPIRES_AT='2026-01-01T12:00:00Z'",
+		"export AUTHGATE_SERVER_URL=",
+	} {
+		if !strings.Contains(out.String(), want) {
+			t.Errorf("output lacks %s:\n%s", want, out.String())
+		}
+	}
+}
@@ -0,0 +1,192 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+
+	"golang.org/x/oauth2"
+)
+
+// Grant types for exchanging an externally issued assertion.
+const (
+	grantTypeJWTBearer     = "urn:ietf:params:oauth:grant-type:jwt-bearer"
+	grantTypeTokenExchange = "urn:ietf:params:oauth:grant-type:token-exchange"
+)
+
+// performFederatedFlow exchanges an assertion issued by a trusted third party
+// (typically the OIDC ID token a CI platform hands to each job) for AuthGate
+// tokens, using either the JWT bearer grant (RFC 7523) or token exchange
+// (RFC 8693). It never prompts, so it is safe to run unattended.
+func performFederatedFlow(
+	ctx context.Context,
+	diag io.Writer,
+	params authParams,
+) (*TokenStorage, error) {
+	fmt.Fprintln(diag, "Step 1: Reading external assertion...")
+	assertion, source, err := readAssertion(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read assertion: %w", err)
+	}
+	fmt.Fprintf(diag, "Assertion source: %s\n", source)
+
+	data := url.Values{}
+	switch assertionGrant {
+	case "token-exchange":
+		data.Set("grant_type", grantTypeTokenExchange)
+		data.Set("subject_token", assertion)
+		data.Set("subject_token_type", "urn:ietf:params:oauth:token-type:jwt")
+		data.Set("requested_token_type", "urn:ietf:params:oauth:token-type:access_token")
+	default:
+		data.Set("grant_type", grantTypeJWTBearer)
+		data.Set("assertion", assertion)
+	}
+	data.Set("scope", params.requestedScope())
+	data.Set("client_id", clientID)
+	if !isPublicClient() {
+		data.Set("client_secret", clientSecret)
+	}
+
+	fmt.Fprintf(diag, "Step 2: Exchanging assertion (%s)...\n", data.Get("grant_type"))
+	token, err := postTokenRequest(ctx, serverURL+"/oauth/token", data)
+	if err != nil {
+		var oauthErr *oauth2.RetrieveError
+		if errors.As(err, &oauthErr) {
+			var errResp ErrorResponse
+			if jsonErr := json.Unmarshal(oauthErr.Body, &errResp); jsonErr == nil &&
+				errResp.Error != "" {
+				return nil, fmt.Errorf(
+					"assertion exchange failed: %s: %s",
+					errResp.Error,
+					errResp.ErrorDescription,
+				)
+			}
+		}
+		return nil, fmt.Errorf("assertion exchange failed: %w", err)
+	}
+
+	storage := &TokenStorage{
+		AccessToken:  token.AccessToken,
+		RefreshToken: token.RefreshToken,
+		TokenType:    token.Type(),
+		ExpiresAt:    serverTime(token.Expiry),
+		IssuedAt:     serverNow(),
+		ClockSkew:    currentClockSkew(),
+		ClientID:     clientID,
+		Flow:         "federated",
+		Scope:        tokenScope(token),
+		IDToken:      tokenIDToken(token),
+		Identity:     tokenIdentity(token),
+	}
+	recordGrantedScope(diag, storage, params.requestedScope())
+
+	if err := saveTokens(storage); err != nil {
+		fmt.Fprintf(diag, "Warning: Failed to save tokens: %v\n", err)
+	} else {
+		fmt.Fprintf(diag, "Tokens saved to %s\n", activeTokenStore())
+	}
+
+	return storage, nil
+}
+
+// readAssertion returns the external assertion and a description of where it
+// came from. Sources are tried in order: ASSERTION_FILE, the environment
+// variable named by ASSERTION_ENV, ASSERTION_URL, and finally the GitHub
+// Actions OIDC endpoint when running inside a workflow with id-token
+// permission.
+func readAssertion(ctx context.Context) (string, string, error) {
+	switch {
+	case assertionFile != "":
+		data, err := os.ReadFile(assertionFile)
+		if err != nil {
+			return "", "", err
+		}
+		return nonEmptyAssertion(string(data), "file "+assertionFile)
+
+	case assertionEnv != "":
+		return nonEmptyAssertion(os.Getenv(assertionEnv), "environment variable "+assertionEnv)
+
+	case assertionURL != "":
+		a, err := fetchAssertion(ctx, assertionURL, assertionRequestToken)
+		if err != nil {
+			return "", "", err
+		}
+		return nonEmptyAssertion(a, assertionURL)
+	}
+
+	if ghURL := os.Getenv("ACTIONS_ID_TOKEN_REQUEST_URL"); ghURL != "" {
+		a, err := fetchAssertion(ctx, ghURL, os.Getenv("ACTIONS_ID_TOKEN_REQUEST_TOKEN"))
+		if err != nil {
+			return "", "", err
+		}
+		return nonEmptyAssertion(a, "GitHub Actions OIDC")
+	}
+
+	return "", "", fmt.Errorf(
+		"no assertion source configured: set ASSERTION_FILE, ASSERTION_ENV or ASSERTION_URL",
+	)
+}
+
+func nonEmptyAssertion(assertion, source string) (string, string, error) {
+	assertion = strings.TrimSpace(assertion)
+	if assertion == "" {
+		return "", "", fmt.Errorf("assertion from %s is empty", source)
+	}
+	return assertion, source, nil
+}
+
+// fetchAssertion requests an assertion from an HTTP endpoint, authenticating
+// with requestToken as a bearer token. The audience (ASSERTION_AUDIENCE) is
+// passed as the "audience" query parameter. The response may either be the
+// raw assertion or a JSON object with a "value" field, as returned by GitHub
+// Actions.
+func fetchAssertion(ctx context.Context, rawURL, requestToken string) (string, error) {
+	ctx, cancel := context.WithTimeout(ctx, tokenExchangeTimeout)
+	defer cancel()
+
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return "", fmt.Errorf("invalid assertion URL: %w", err)
+	}
+	if assertionAudience != "" {
+		q := u.Query()
+		q.Set("audience", assertionAudience)
+		u.RawQuery = q.Encode()
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u.String(), nil)
+	if err != nil {
+		return "", fmt.Errorf("failed to create request: %w", err)
+	}
+	if requestToken != "" {
+		req.Header.Set("Authorization", "Bearer "+requestToken)
+	}
+
+	resp, err := retryClient.DoWithContext(ctx, req)
+	if err != nil {
+		return "", fmt.Errorf("request failed: %w", err)
+	}
+	defer resp.Body.Close()
+
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return "", fmt.Errorf("failed to read response: %w", err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("assertion endpoint returned status %d: %s", resp.StatusCode, body)
+	}
+
+	var wrapped struct {
+		Value string `json:"value"`
+	}
+	if err := json.Unmarshal(body, &wrapped); err == nil && wrapped.Value != "" {
+		return wrapped.Value, nil
+	}
+	return string(body), nil
+}
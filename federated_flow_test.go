@@ -0,0 +1,151 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// setAssertionConfig resets all assertion sources for the duration of a test.
+func setAssertionConfig(t *testing.T) {
+	t.Helper()
+	origFile, origEnv, origURL := assertionFile, assertionEnv, assertionURL
+	origToken, origAudience, origGrant := assertionRequestToken, assertionAudience, assertionGrant
+	t.Cleanup(func() {
+		assertionFile, assertionEnv, assertionURL = origFile, origEnv, origURL
+		assertionRequestToken = origToken
+		assertionAudience = origAudience
+		assertionGrant = origGrant
+	})
+	assertionFile, assertionEnv, assertionURL = "", "", ""
+	assertionRequestToken, assertionAudience, assertionGrant = "", "", "jwt-bearer"
+	t.Setenv("ACTIONS_ID_TOKEN_REQUEST_URL", "")
+	t.Setenv("ACTIONS_ID_TOKEN_REQUEST_TOKEN", "")
+}
+
+func TestReadAssertion_Sources(t *testing.T) {
+	setAssertionConfig(t)
+
+	path := filepath.Join(t.TempDir(), "id-token")
+	if err := os.WriteFile(path, []byte("jwt-from-file\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	assertionFile = path
+	if got, _, err := readAssertion(context.Background()); err != nil || got != "jwt-from-file" {
+		t.Errorf("file source: got %q, %v", got, err)
+	}
+
+	assertionFile = ""
+	assertionEnv = "CI_JOB_JWT_V2"
+	t.Setenv("CI_JOB_JWT_V2", "jwt-from-env")
+	if got, _, err := readAssertion(context.Background()); err != nil || got != "jwt-from-env" {
+		t.Errorf("env source: got %q, %v", got, err)
+	}
+
+	assertionEnv = ""
+	if _, _, err := readAssertion(context.Background()); err == nil {
+		t.Error("expected error when no source is configured")
+	}
+}
+
+func TestReadAssertion_GitHubActions(t *testing.T) {
+	setAssertionConfig(t)
+	assertionAudience = "authgate"
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if got := r.Header.Get("Authorization"); got != "Bearer request-token" {
+			t.Errorf("Authorization = %q", got)
+		}
+		if got := r.URL.Query().Get("audience"); got != "authgate" {
+			t.Errorf("audience = %q, want %q", got, "authgate")
+		}
+		_ = json.NewEncoder(w).Encode(map[string]string{"value": "jwt-from-github"})
+	}))
+	defer srv.Close()
+
+	t.Setenv("ACTIONS_ID_TOKEN_REQUEST_URL", srv.URL+"/token?api-version=2.0")
+	t.Setenv("ACTIONS_ID_TOKEN_REQUEST_TOKEN", "request-token")
+
+	got, _, err := readAssertion(context.Background())
+	if err != nil {
+		t.Fatalf("readAssertion() error: %v", err)
+	}
+	if got != "jwt-from-github" {
+		t.Errorf("assertion = %q, want %q", got, "jwt-from-github")
+	}
+}
+
+func TestPerformFederatedFlow(t *testing.T) {
+	origServerURL := serverURL
+	origClientID := clientID
+	origTokenFile := tokenFile
+	t.Cleanup(func() {
+		serverURL = origServerURL
+		clientID = origClientID
+		tokenFile = origTokenFile
+	})
+	setAssertionConfig(t)
+
+	tokenFile = filepath.Join(t.TempDir(), "tokens.json")
+	clientID = "test-client-federated"
+	assertionEnv = "TEST_ASSERTION"
+	t.Setenv("TEST_ASSERTION", "ci-issued-jwt")
+
+	tests := []struct {
+		grant     string
+		wantGrant string
+		wantField string
+	}{
+		{"jwt-bearer", grantTypeJWTBearer, "assertion"},
+		{"token-exchange", grantTypeTokenExchange, "subject_token"},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.grant, func(t *testing.T) {
+			assertionGrant = tc.grant
+
+			handler := func(w http.ResponseWriter, r *http.Request) {
+				if err := r.ParseForm(); err != nil {
+					http.Error(w, "bad form", http.StatusBadRequest)
+					return
+				}
+				if got := r.FormValue("grant_type"); got != tc.wantGrant {
+					t.Errorf("grant_type = %q, want %q", got, tc.wantGrant)
+				}
+				if got := r.FormValue(tc.wantField); got != "ci-issued-jwt" {
+					t.Errorf("%s = %q, want assertion", tc.wantField, got)
+				}
+				w.Header().Set("Content-Type", "application/json")
+				_ = json.NewEncoder(w).Encode(map[string]interface{}{
+					"access_token": testAccessToken,
+					"token_type":   "Bearer",
+					"expires_in":   600,
+				})
+			}
+			srv := httptest.NewServer(http.HandlerFunc(handler))
+			defer srv.Close()
+			serverURL = srv.URL
+
+			storage, err := performFederatedFlow(context.Background(), io.Discard, authParams{})
+			if err != nil {
+				t.Fatalf("performFederatedFlow() error: %v", err)
+			}
+			if storage.Flow != "federated" {
+				t.Errorf("Flow = %q, want %q", storage.Flow, "federated")
+			}
+
+			cached, err := loadTokens()
+			if err != nil {
+				t.Fatalf("loadTokens() error: %v", err)
+			}
+			if cached.AccessToken != testAccessToken {
+				t.Errorf("cached AccessToken = %q, want %q", cached.AccessToken, testAccessToken)
+			}
+		})
+	}
+}
@@ -1,64 +1,221 @@
 package main
 
 import (
+	"context"
+	"errors"
 	"fmt"
 	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
 	"time"
 )
 
-// fileLock represents a file lock.
+const (
+	// fileLockTimeout bounds lock acquisition when the context has no
+	// deadline of its own.
+	fileLockTimeout = 5 * time.Second
+	// fileLockRetryDelay is the polling interval while the lock is held.
+	fileLockRetryDelay = 50 * time.Millisecond
+	// fileLockOrphanAge is how long the PID-file fallback waits on a lock file
+	// that does not (yet) name its holder before treating it as abandoned.
+	fileLockOrphanAge = 10 * time.Second
+)
+
+var (
+	// errLockBusy is returned by tryFlock when another holder has the lock.
+	errLockBusy = errors.New("lock is held by another process")
+	// errFlockUnsupported is returned by tryFlock when the platform or file
+	// system has no advisory locks; the PID-file fallback is used instead.
+	errFlockUnsupported = errors.New("advisory file locks are not supported")
+)
+
+// fileLock is a lock on "<path>.lock" coordinating access to path across
+// processes. Where the kernel supports it this is an flock(2) advisory lock,
+// which is released automatically when the holder dies, so there are no stale
+// locks to clean up. Elsewhere the lock file is created with O_EXCL and holds
+// the owner's PID, and a lock whose owner is no longer running is taken over.
 type fileLock struct {
-	lockFile *os.File
-	lockPath string
+	lockFile  *os.File
+	lockPath  string
+	exclusive bool
+	pidFile   bool // O_EXCL fallback: the lock is the file's existence
+}
+
+// acquireFileLock takes an exclusive lock for modifying filePath. It waits
+// for other holders until ctx is done, or fileLockTimeout if ctx has no
+// deadline.
+func acquireFileLock(ctx context.Context, filePath string) (*fileLock, error) {
+	return lockFile(ctx, filePath, true)
 }
 
-// acquireFileLock acquires an exclusive lock on the token file.
-// Uses a separate lock file to coordinate access across processes.
-func acquireFileLock(filePath string) (*fileLock, error) {
+// acquireSharedFileLock takes a lock for reading filePath. Any number of
+// readers may hold it at once; it excludes writers only. The PID-file
+// fallback cannot share, so there it is exclusive.
+func acquireSharedFileLock(ctx context.Context, filePath string) (*fileLock, error) {
+	return lockFile(ctx, filePath, false)
+}
+
+func lockFile(ctx context.Context, filePath string, exclusive bool) (*fileLock, error) {
+	if _, ok := ctx.Deadline(); !ok {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, fileLockTimeout)
+		defer cancel()
+	}
 	lockPath := filePath + ".lock"
-	maxRetries := 50
-	retryDelay := 100 * time.Millisecond
+	// Locks such as the login and refresh locks may be taken before anything
+	// was written next to them.
+	if err := os.MkdirAll(filepath.Dir(lockPath), 0o700); err != nil {
+		return nil, fmt.Errorf("failed to create lock directory: %w", err)
+	}
+
+	for {
+		lock, err := tryLockFile(lockPath, exclusive)
+		switch {
+		case err == nil:
+			return lock, nil
+		case errors.Is(err, errFlockUnsupported):
+			return acquirePIDFileLock(ctx, lockPath)
+		case !errors.Is(err, errLockBusy):
+			return nil, fmt.Errorf("failed to acquire file lock: %w", err)
+		}
+		if err := waitForLock(ctx, lockPath); err != nil {
+			return nil, err
+		}
+	}
+}
+
+// tryLockFile makes one attempt at an flock lock. Exclusive holders remove the
+// lock file on release, so after locking it checks that the path still names
+// the file it locked; otherwise it lost a race with a releasing holder and the
+// attempt is reported as busy.
+func tryLockFile(lockPath string, exclusive bool) (*fileLock, error) {
+	created := true
+	f, err := os.OpenFile(lockPath, os.O_RDWR|os.O_CREATE|os.O_EXCL, 0o600)
+	if os.IsExist(err) {
+		created = false
+		f, err = os.OpenFile(lockPath, os.O_RDWR, 0o600)
+		if os.IsNotExist(err) {
+			return nil, errLockBusy // removed between the two opens
+		}
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if err := tryFlock(f, exclusive); err != nil {
+		f.Close()
+		if errors.Is(err, errFlockUnsupported) && created {
+			// Leave no PID-less file behind for the fallback to wait on.
+			_ = os.Remove(lockPath)
+		}
+		return nil, err
+	}
+
+	opened, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	current, err := os.Stat(lockPath)
+	if err != nil || !os.SameFile(opened, current) {
+		f.Close()
+		return nil, errLockBusy
+	}
 
-	for i := 0; i < maxRetries; i++ {
-		lockFile, err := os.OpenFile(lockPath, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0o600)
+	if exclusive {
+		// Record the holder for diagnostics and for the PID-file fallback.
+		if err := f.Truncate(0); err == nil {
+			_, _ = f.WriteAt([]byte(strconv.Itoa(os.Getpid())), 0)
+		}
+	}
+	return &fileLock{lockFile: f, lockPath: lockPath, exclusive: exclusive}, nil
+}
+
+// acquirePIDFileLock is the fallback for systems without advisory locks. The
+// lock file is created with O_EXCL and holds the owner's PID; a lock whose
+// owner is not running is removed and retried.
+func acquirePIDFileLock(ctx context.Context, lockPath string) (*fileLock, error) {
+	for {
+		f, err := os.OpenFile(lockPath, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0o600)
 		if err == nil {
-			fmt.Fprintf(lockFile, "%d", os.Getpid())
-			return &fileLock{
-				lockFile: lockFile,
-				lockPath: lockPath,
-			}, nil
+			fmt.Fprintf(f, "%d", os.Getpid())
+			return &fileLock{lockFile: f, lockPath: lockPath, exclusive: true, pidFile: true}, nil
+		}
+		if !os.IsExist(err) {
+			return nil, fmt.Errorf("failed to acquire file lock: %w", err)
 		}
 
-		if os.IsExist(err) {
-			if info, statErr := os.Stat(lockPath); statErr == nil {
-				if time.Since(info.ModTime()) > 30*time.Second {
-					if remErr := os.Remove(lockPath); remErr != nil && !os.IsNotExist(remErr) {
-						return nil, fmt.Errorf(
-							"failed to remove stale lock file %s: %w",
-							lockPath,
-							remErr,
-						)
-					}
-					continue
-				}
+		if pidFileLockAbandoned(lockPath) {
+			if err := os.Remove(lockPath); err != nil && !os.IsNotExist(err) {
+				return nil, fmt.Errorf("failed to remove stale lock file %s: %w", lockPath, err)
 			}
-			time.Sleep(retryDelay)
 			continue
 		}
+		if err := waitForLock(ctx, lockPath); err != nil {
+			return nil, err
+		}
+	}
+}
+
+// pidFileLockAbandoned reports whether the owner of a PID lock file is gone.
+// A file without a PID is only abandoned once it is fileLockOrphanAge old,
+// since its owner may not have written the PID yet.
+func pidFileLockAbandoned(lockPath string) bool {
+	data, err := os.ReadFile(lockPath)
+	if err != nil {
+		return false
+	}
+	if pid, err := strconv.Atoi(strings.TrimSpace(string(data))); err == nil && pid > 0 {
+		return pid != os.Getpid() && !processAlive(pid)
+	}
+	info, err := os.Stat(lockPath)
+	return err == nil && time.Since(info.ModTime()) > fileLockOrphanAge
+}
 
-		return nil, fmt.Errorf("failed to acquire file lock: %w", err)
+// waitForLock sleeps for one retry interval, or returns an error naming the
+// current holder once ctx is done.
+func waitForLock(ctx context.Context, lockPath string) error {
+	select {
+	case <-time.After(fileLockRetryDelay):
+		return nil
+	case <-ctx.Done():
+		holder := ""
+		if pid := lockHolder(lockPath); pid != "" {
+			holder = fmt.Sprintf(" (held by PID %s)", pid)
+		}
+		return fmt.Errorf("timeout waiting for file lock %s%s: %w", lockPath, holder, ctx.Err())
 	}
+}
 
-	return nil, fmt.Errorf(
-		"timeout waiting for file lock after %v",
-		time.Duration(maxRetries)*retryDelay,
-	)
+// lockHolder returns the PID recorded in an exclusively held lock file, or
+// "" if none is known.
+func lockHolder(lockPath string) string {
+	data, err := os.ReadFile(lockPath)
+	if err != nil {
+		return ""
+	}
+	return strings.TrimSpace(string(data))
 }
 
-// release releases the file lock.
+// release releases the file lock. An exclusive holder removes the lock file
+// while still holding the lock, so that the directory does not fill up with
+// lock files; waiters notice the removal and retry on a fresh file.
 func (fl *fileLock) release() error {
-	if fl.lockFile != nil {
-		fl.lockFile.Close()
+	if fl.lockFile == nil {
+		return nil
+	}
+	f := fl.lockFile
+	fl.lockFile = nil
+	if fl.pidFile {
+		// Some systems (Windows) cannot remove a file that is still open.
+		f.Close()
+		return os.Remove(fl.lockPath)
+	}
+	var err error
+	if fl.exclusive {
+		err = os.Remove(fl.lockPath)
 	}
-	return os.Remove(fl.lockPath)
+	f.Close()
+	return err
 }
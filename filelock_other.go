@@ -0,0 +1,31 @@
+//go:build !(darwin || dragonfly || freebsd || linux || netbsd || openbsd)
+
+package main
+
+import (
+	"errors"
+	"os"
+	"runtime"
+	"syscall"
+)
+
+// tryFlock always reports advisory locks as unsupported, so the PID-file
+// fallback is used.
+func tryFlock(*os.File, bool) error {
+	return errFlockUnsupported
+}
+
+// processAlive reports whether a process with the given PID exists. On
+// Windows FindProcess opens the process and fails if it has exited.
+func processAlive(pid int) bool {
+	p, err := os.FindProcess(pid)
+	if err != nil {
+		return false
+	}
+	if runtime.GOOS == "windows" {
+		_ = p.Release()
+		return true
+	}
+	err = p.Signal(syscall.Signal(0))
+	return err == nil || errors.Is(err, os.ErrPermission)
+}
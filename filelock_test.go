@@ -1,8 +1,12 @@
 package main
 
 import (
+	"context"
+	"errors"
 	"os"
+	"os/exec"
 	"path/filepath"
+	"strconv"
 	"sync"
 	"testing"
 	"time"
@@ -12,7 +16,7 @@ func TestAcquireAndRelease(t *testing.T) {
 	dir := t.TempDir()
 	target := filepath.Join(dir, "tokens.json")
 
-	lock, err := acquireFileLock(target)
+	lock, err := acquireFileLock(context.Background(), target)
 	if err != nil {
 		t.Fatalf("acquireFileLock() error: %v", err)
 	}
@@ -45,7 +49,7 @@ func TestConcurrentLocks(t *testing.T) {
 		go func(idx int) {
 			defer wg.Done()
 
-			lock, err := acquireFileLock(target)
+			lock, err := acquireFileLock(context.Background(), target)
 			if err != nil {
 				t.Errorf("goroutine %d: acquireFileLock() error: %v", idx, err)
 				return
@@ -85,9 +89,99 @@ func TestStaleLockRemoval(t *testing.T) {
 		t.Fatalf("os.Chtimes: %v", err)
 	}
 
-	lock, err := acquireFileLock(target)
+	lock, err := acquireFileLock(context.Background(), target)
 	if err != nil {
 		t.Fatalf("acquireFileLock() with stale lock: %v", err)
 	}
 	_ = lock.release()
 }
+
+func TestSharedLocks(t *testing.T) {
+	target := filepath.Join(t.TempDir(), "tokens.json")
+
+	first, err := acquireSharedFileLock(context.Background(), target)
+	if err != nil {
+		t.Fatalf("acquireSharedFileLock() error: %v", err)
+	}
+	if first.pidFile {
+		t.Skip("advisory locks are not supported here")
+	}
+	second, err := acquireSharedFileLock(context.Background(), target)
+	if err != nil {
+		t.Fatalf("second shared lock: %v", err)
+	}
+
+	// A writer waits for the readers.
+	ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+	defer cancel()
+	if _, err := acquireFileLock(ctx, target); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("exclusive lock while shared held: error = %v, want deadline exceeded", err)
+	}
+
+	_ = first.release()
+	_ = second.release()
+	lock, err := acquireFileLock(context.Background(), target)
+	if err != nil {
+		t.Fatalf("exclusive lock after readers released: %v", err)
+	}
+	_ = lock.release()
+}
+
+func TestLockReleasedWhenHolderDies(t *testing.T) {
+	target := filepath.Join(t.TempDir(), "tokens.json")
+
+	lock, err := acquireFileLock(context.Background(), target)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if lock.pidFile {
+		t.Skip("advisory locks are not supported here")
+	}
+	// Closing the descriptor without release() is what the kernel does when
+	// the holder exits: the lock file stays, the lock does not.
+	lock.lockFile.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	next, err := acquireFileLock(ctx, target)
+	if err != nil {
+		t.Fatalf("acquireFileLock() after holder died: %v", err)
+	}
+	_ = next.release()
+}
+
+func TestPIDFileLock(t *testing.T) {
+	lockPath := filepath.Join(t.TempDir(), "tokens.json.lock")
+
+	// A lock held by a running process (this one) is respected.
+	if err := os.WriteFile(lockPath, []byte(strconv.Itoa(os.Getpid())), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+	defer cancel()
+	if _, err := acquirePIDFileLock(ctx, lockPath); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("acquirePIDFileLock() with live holder: error = %v", err)
+	}
+
+	// A lock whose holder has exited is taken over at once.
+	cmd := exec.Command(os.Args[0], "-test.run=^$")
+	if err := cmd.Run(); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(lockPath, []byte(strconv.Itoa(cmd.Process.Pid)), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	lock, err := acquirePIDFileLock(context.Background(), lockPath)
+	if err != nil {
+		t.Fatalf("acquirePIDFileLock() with dead holder: %v", err)
+	}
+	if data, _ := os.ReadFile(lockPath); string(data) != strconv.Itoa(os.Getpid()) {
+		t.Errorf("lock file holds %q, want own PID", data)
+	}
+	if err := lock.release(); err != nil {
+		t.Errorf("release() error: %v", err)
+	}
+	if _, err := os.Stat(lockPath); !os.IsNotExist(err) {
+		t.Error("lock file was not removed after release")
+	}
+}
@@ -0,0 +1,150 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+)
+
+// gitCredential holds the attributes of a git credential helper request or
+// answer (gitcredentials(7), "credential" protocol).
+type gitCredential map[string]string
+
+// readGitCredential reads key=value lines up to a blank line or EOF.
+func readGitCredential(r io.Reader) (gitCredential, error) {
+	cred := gitCredential{}
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		line := strings.TrimSuffix(scanner.Text(), "\r")
+		if line == "" {
+			break
+		}
+		key, value, ok := strings.Cut(line, "=")
+		if !ok {
+			return nil, fmt.Errorf("malformed credential line %q", line)
+		}
+		cred[key] = value
+	}
+	return cred, scanner.Err()
+}
+
+// runGitCredential implements a git credential helper:
+//
+//	git config --global credential.https://git.example.com.helper \
+//	    "!authgate-cli git-credential"
+//
+// "get" answers with the access token of the profile listing the requested
+// host as password, refreshing it as needed. A login is only started when
+// stderr is a terminal and git allows prompting. "store" is a no-op, since
+// the tokens are already stored, and "erase" refreshes the access token if it
+// is the rejected password. Hosts no profile lists get no answer, so that git
+// tries its other helpers.
+func runGitCredential(ctx context.Context, args []string) int {
+	fs := flag.NewFlagSet("git-credential", flag.ContinueOnError)
+	username := fs.String(
+		"username",
+		defaultCredentialUsername,
+		"Username to answer with when the profile sets none",
+	)
+	if code, ok := parseCommandFlags(fs, args); !ok {
+		return code
+	}
+	if fs.NArg() != 1 {
+		fmt.Fprintln(os.Stderr, "Usage: git-credential [--username NAME] get|store|erase")
+		return 2
+	}
+
+	cred, err := readGitCredential(os.Stdin)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "authgate: %v\n", err)
+		return 1
+	}
+	switch fs.Arg(0) {
+	case "get":
+		interactive := isTerminal(os.Stderr) && os.Getenv("GIT_TERMINAL_PROMPT") != "0"
+		return gitCredentialGet(ctx, os.Stdout, cred, *username, interactive)
+	case "erase":
+		return gitCredentialErase(ctx, cred)
+	default:
+		// "store" has nothing to do; unknown operations must be ignored.
+		return 0
+	}
+}
+
+// gitProfile returns the profile for cred's host, or nil when the request is
+// not for an https host that a profile lists.
+func gitProfile(cred gitCredential) (*profile, error) {
+	if cred["protocol"] != "https" || cred["host"] == "" {
+		return nil, nil
+	}
+	_, p, err := profileForHost(cred["host"])
+	return p, err
+}
+
+// gitCredentialGet writes the credential for cred's host to out.
+func gitCredentialGet(
+	ctx context.Context,
+	out io.Writer,
+	cred gitCredential,
+	username string,
+	interactive bool,
+) int {
+	p, err := gitProfile(cred)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "authgate: %v\n", err)
+		return 1
+	}
+	if p == nil {
+		return 0
+	}
+	p.apply()
+	if err := checkClientConfig(os.Stderr); err != nil {
+		fmt.Fprintf(os.Stderr, "authgate: %v\n", err)
+		return 1
+	}
+	if p.Username != "" {
+		username = p.Username
+	}
+
+	// Everything but the answer goes to stderr, which git shows the user.
+	storage, err := obtainToken(ctx, os.Stderr, "", interactive)
+	if err != nil {
+		// No answer: git falls back to other helpers or prompts.
+		fmt.Fprintf(os.Stderr, "authgate: no token for %s: %v\n", cred["host"], err)
+		return 0
+	}
+
+	fmt.Fprintf(out, "protocol=%s\n", cred["protocol"])
+	fmt.Fprintf(out, "host=%s\n", cred["host"])
+	fmt.Fprintf(out, "username=%s\n", username)
+	fmt.Fprintf(out, "password=%s\n", storage.AccessToken)
+	// Git 2.41+ does not reuse a credential past its expiry.
+	fmt.Fprintf(out, "password_expiry_utc=%d\n", localExpiry(storage).Unix())
+	return 0
+}
+
+// gitCredentialErase refreshes the tokens when git reports that the current
+// access token was rejected, so that the next "get" answers with a new one.
+func gitCredentialErase(ctx context.Context, cred gitCredential) int {
+	p, err := gitProfile(cred)
+	if err != nil || p == nil || cred["password"] == "" {
+		return 0
+	}
+	p.apply()
+	if err := checkClientConfig(os.Stderr); err != nil {
+		return 0
+	}
+
+	storage, err := loadTokens()
+	if err != nil || storage.AccessToken != cred["password"] {
+		return 0
+	}
+	if _, err := refreshStoredTokens(ctx, os.Stderr, storage); err != nil {
+		fmt.Fprintf(os.Stderr, "authgate: refresh after rejected token failed: %v\n", err)
+	}
+	return 0
+}
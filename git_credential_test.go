@@ -0,0 +1,183 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// setupGitCredential writes a profiles file serving git.example.com with
+// authServer and a memory store, and restores the globals afterwards.
+func setupGitCredential(t *testing.T, authServer string) {
+	t.Helper()
+	origStore, origFile, origProfiles := tokenStore, tokenFile, profilesFile
+	origServer, origClient, origOverride := serverURL, clientID, accountOverride
+	origScope := scope
+	t.Cleanup(func() {
+		tokenStore, tokenFile, profilesFile = origStore, origFile, origProfiles
+		serverURL, clientID, accountOverride = origServer, origClient, origOverride
+		scope = origScope
+	})
+	tokenStore = newMemoryTokenStore()
+	tokenFile = filepath.Join(t.TempDir(), "tokens.json")
+	profilesFile = filepath.Join(t.TempDir(), "profiles.json")
+	serverURL, clientID, accountOverride = "https://other.example.com", "other-client", ""
+
+	profiles := `{"profiles": {"git": {
+		"server_url": "` + authServer + `",
+		"client_id": "git-client",
+		"account": "git",
+		"username": "x-token",
+		"hosts": ["Git.Example.com"]
+	}}}`
+	if err := os.WriteFile(profilesFile, []byte(profiles), 0o600); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// saveGitTokens stores storage for the "git" profile.
+func saveGitTokens(t *testing.T, authServer string, storage *TokenStorage) {
+	t.Helper()
+	storage.ServerURL = normalizeServerURL(authServer)
+	storage.ClientID = "git-client"
+	storage.Account = "git"
+	if err := saveTokens(storage); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestReadGitCredential(t *testing.T) {
+	cred, err := readGitCredential(strings.NewReader(
+		"protocol=https\nhost=git.example.com\npath=org/repo.git\n\nignored=1\n",
+	))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cred["host"] != "git.example.com" || cred["path"] != "org/repo.git" || len(cred) != 3 {
+		t.Errorf("readGitCredential() = %v", cred)
+	}
+	if _, err := readGitCredential(strings.NewReader("garbage\n")); err == nil {
+		t.Error("readGitCredential() accepted a line without =")
+	}
+}
+
+func TestGitCredentialGet(t *testing.T) {
+	setupGitCredential(t, "https://auth.example.com")
+	saveGitTokens(t, "https://auth.example.com", &TokenStorage{
+		AccessToken: "git-access-token",
+		TokenType:   "Bearer",
+		ExpiresAt:   time.Now().Add(time.Hour),
+	})
+	clientID = "" // only the profile names the client
+
+	var out bytes.Buffer
+	cred := gitCredential{"protocol": "https", "host": "git.example.com"}
+	if code := gitCredentialGet(context.Background(), &out, cred, "oauth2", false); code != 0 {
+		t.Fatalf("exit code %d", code)
+	}
+	answer, err := readGitCredential(&out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if answer["username"] != "x-token" || answer["password"] != "git-access-token" {
+		t.Errorf("answer = %v", answer)
+	}
+	if answer["password_expiry_utc"] == "" {
+		t.Error("answer has no password_expiry_utc")
+	}
+}
+
+func TestGitCredentialGet_NoAnswer(t *testing.T) {
+	setupGitCredential(t, "https://auth.example.com")
+
+	for name, cred := range map[string]gitCredential{
+		"unknown host":  {"protocol": "https", "host": "github.com"},
+		"plain http":    {"protocol": "http", "host": "git.example.com"},
+		"not logged in": {"protocol": "https", "host": "git.example.com"},
+	} {
+		var out bytes.Buffer
+		// Not interactive, so no login may start for "not logged in".
+		if code := gitCredentialGet(context.Background(), &out, cred, "oauth2", false); code != 0 {
+			t.Errorf("%s: exit code %d", name, code)
+		}
+		if out.Len() != 0 {
+			t.Errorf("%s: answered %q", name, out.String())
+		}
+	}
+}
+
+func TestGitCredentialGet_NoClientID(t *testing.T) {
+	setupGitCredential(t, "https://auth.example.com")
+	clientID = ""
+	profiles := `{"profiles": {"git": {"hosts": ["git.example.com"]}}}`
+	if err := os.WriteFile(profilesFile, []byte(profiles), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	var out bytes.Buffer
+	cred := gitCredential{"protocol": "https", "host": "git.example.com"}
+	if code := gitCredentialGet(context.Background(), &out, cred, "oauth2", false); code != 1 {
+		t.Errorf("exit code %d, want 1", code)
+	}
+	if out.Len() != 0 {
+		t.Errorf("answered %q", out.String())
+	}
+}
+
+func TestProfileApply_ClientSecret(t *testing.T) {
+	origServer, origClient, origSecret := serverURL, clientID, clientSecret
+	origOverride, origScope := accountOverride, scope
+	t.Cleanup(func() {
+		serverURL, clientID, clientSecret = origServer, origClient, origSecret
+		accountOverride, scope = origOverride, origScope
+	})
+
+	for _, tt := range []struct {
+		name string
+		p    profile
+		keep bool
+	}{
+		{"account only", profile{Account: "git"}, true},
+		{"same server", profile{ServerURL: "https://Auth.example.com/"}, true},
+		{"same client", profile{ClientID: "client"}, true},
+		{"other server", profile{ServerURL: "https://other.example.com"}, false},
+		{"other client", profile{ClientID: "other-client"}, false},
+	} {
+		serverURL, clientID, clientSecret = "https://auth.example.com", "client", "secret"
+		tt.p.apply()
+		if got := clientSecret == "secret"; got != tt.keep {
+			t.Errorf("%s: kept client secret = %v, want %v", tt.name, got, tt.keep)
+		}
+	}
+}
+
+func TestGitCredentialErase(t *testing.T) {
+	var refreshes atomic.Int32
+	authServer := refreshServer(t, &refreshes)
+	setupGitCredential(t, authServer.URL)
+	saveGitTokens(t, authServer.URL, &TokenStorage{
+		AccessToken:  "rejected-access-token",
+		RefreshToken: "refresh-token",
+		TokenType:    "Bearer",
+		ExpiresAt:    time.Now().Add(time.Hour),
+	})
+
+	cred := gitCredential{"protocol": "https", "host": "git.example.com"}
+	cred["password"] = "some-other-token"
+	gitCredentialErase(context.Background(), cred)
+	if n := refreshes.Load(); n != 0 {
+		t.Fatalf("erase of another password refreshed %d times", n)
+	}
+
+	cred["password"] = "rejected-access-token"
+	gitCredentialErase(context.Background(), cred)
+	stored, err := loadTokens()
+	if err != nil || stored.AccessToken != "refreshed-access-token-1" {
+		t.Errorf("tokens after erase = %+v, %v", stored, err)
+	}
+}
@@ -4,7 +4,9 @@ go 1.24.0
 
 require (
 	github.com/appleboy/go-httpretry v0.11.0
+	github.com/godbus/dbus/v5 v5.1.0
 	github.com/google/uuid v1.6.0
 	github.com/joho/godotenv v1.5.1
+	golang.org/x/crypto v0.40.0
 	golang.org/x/oauth2 v0.35.0
 )
@@ -0,0 +1,190 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"time"
+)
+
+// execCredentialAPIVersion is the client-go exec credential API the
+// kube-credential command speaks.
+const execCredentialAPIVersion = "client.authentication.k8s.io/v1"
+
+// kubeExecInfoEnv is set by kubectl to the ExecCredential with the request
+// (spec) for the plugin.
+const kubeExecInfoEnv = "KUBERNETES_EXEC_INFO"
+
+// execCredential is the ExecCredential object exchanged with kubectl.
+type execCredential struct {
+	APIVersion string                `json:"apiVersion"`
+	Kind       string                `json:"kind"`
+	Spec       *execCredentialSpec   `json:"spec,omitempty"`
+	Status     *execCredentialStatus `json:"status,omitempty"`
+}
+
+type execCredentialSpec struct {
+	Interactive bool `json:"interactive"`
+}
+
+type execCredentialStatus struct {
+	ExpirationTimestamp time.Time `json:"expirationTimestamp,omitzero"`
+	Token               string    `json:"token"`
+}
+
+// kubeInteractive reports whether kubectl allows the plugin to interact with
+// the user. Without KUBERNETES_EXEC_INFO (e.g. when run by hand) it allows
+// interaction when stderr is a terminal.
+func kubeInteractive() bool {
+	info := os.Getenv(kubeExecInfoEnv)
+	if info == "" {
+		return isTerminal(os.Stderr)
+	}
+	var cred execCredential
+	if err := json.Unmarshal([]byte(info), &cred); err != nil || cred.Spec == nil {
+		fmt.Fprintf(os.Stderr, "Warning: Ignoring malformed %s\n", kubeExecInfoEnv)
+		return false
+	}
+	return cred.Spec.Interactive
+}
+
+// kubeLoginForIDToken logs in again for a fresh ID token when a refresh
+// returned none, if kubectl allows interaction (the federated flow needs
+// none).
+func kubeLoginForIDToken(
+	ctx context.Context,
+	storage *TokenStorage,
+	interactive bool,
+) (*TokenStorage, error) {
+	if !interactive && authFlow != flowFederated {
+		return nil, errors.New(
+			"the refresh returned no valid ID token and a new login needs an " +
+				"interactive kubectl; run \"login\" or use \"kube-credential --token access\"",
+		)
+	}
+	fmt.Fprintln(os.Stderr, "The refresh returned no valid ID token; logging in again.")
+	return authenticate(
+		ctx,
+		os.Stderr,
+		authParams{Scope: mergeScopes(grantedScope(storage), "openid"), NewLogin: true},
+	)
+}
+
+// kubeToken returns the token to present to the cluster and when kubectl
+// should ask for a new one, on the local clock. That is the refresh time of
+// the tokens (see refreshTime), or the expiry of the ID token if earlier.
+func kubeToken(storage *TokenStorage, useIDToken bool) (string, time.Time) {
+	skew := tokenClockSkew(storage)
+	expiry := refreshTime(storage).Add(-skew)
+	if !useIDToken {
+		return storage.AccessToken, expiry
+	}
+	if exp := idTokenExpiry(storage.IDToken); !exp.IsZero() {
+		expiry = minTime(expiry, exp.Add(-skew))
+	}
+	return storage.IDToken, expiry
+}
+
+func minTime(a, b time.Time) time.Time {
+	if b.Before(a) {
+		return b
+	}
+	return a
+}
+
+// runKubeCredential implements a client-go exec credential plugin:
+//
+//	users:
+//	- name: prod
+//	  user:
+//	    exec:
+//	      apiVersion: client.authentication.k8s.io/v1
+//	      command: authgate-cli
+//	      args: [kube-credential, --profile, prod]
+//	      interactiveMode: IfAvailable
+//
+// It prints an ExecCredential with the ID token (or, with --token access, the
+// access token). Each cluster profile has its own tokens: the profile's
+// account, or an account named after the profile. Logins use the device flow
+// with all prompts on stderr, and only when kubectl allows interaction.
+func runKubeCredential(ctx context.Context, args []string) int {
+	fs := flag.NewFlagSet("kube-credential", flag.ContinueOnError)
+	profileName := fs.String("profile", "", "Cluster profile from PROFILES_FILE")
+	tokenKind := fs.String("token", "id", "Token to present: id or access")
+	if code, ok := parseCommandFlags(fs, args); !ok {
+		return code
+	}
+	if *tokenKind != "id" && *tokenKind != "access" {
+		fmt.Fprintf(os.Stderr, "Error: invalid --token %q (must be id or access)\n", *tokenKind)
+		return 2
+	}
+
+	if *profileName != "" {
+		p, err := profileByName(*profileName)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+			return 1
+		}
+		p.apply()
+		if p.Account == "" {
+			if err := validateAccountName(*profileName); err != nil {
+				fmt.Fprintf(os.Stderr, "Error: profile %q: %v\n", *profileName, err)
+				return 1
+			}
+			accountOverride = *profileName
+		}
+	}
+	if err := checkClientConfig(os.Stderr); err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		return 1
+	}
+	if authFlow != flowCIBA && authFlow != flowFederated {
+		forceDevice = true
+	}
+
+	useIDToken := *tokenKind == "id"
+	requiredScope := ""
+	if useIDToken {
+		requiredScope = "openid"
+	}
+
+	interactive := kubeInteractive()
+	storage, err := obtainToken(ctx, os.Stderr, requiredScope, interactive)
+	if err == nil && useIDToken && !idTokenValid(storage) {
+		// The access token is still valid but the ID token is not (or is
+		// missing); refreshing usually yields a new one.
+		storage, err = refreshStoredTokens(ctx, os.Stderr, storage)
+		if err == nil && !idTokenValid(storage) {
+			storage, err = kubeLoginForIDToken(ctx, storage, interactive)
+		}
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to obtain token: %v\n", err)
+		return 1
+	}
+
+	token, expiry := kubeToken(storage, useIDToken)
+	if token == "" {
+		fmt.Fprintln(
+			os.Stderr,
+			"The server issued no ID token; use \"kube-credential --token access\"",
+		)
+		return 1
+	}
+	cred := execCredential{
+		APIVersion: execCredentialAPIVersion,
+		Kind:       "ExecCredential",
+		Status: &execCredentialStatus{
+			ExpirationTimestamp: expiry.UTC().Truncate(time.Second),
+			Token:               token,
+		},
+	}
+	if err := json.NewEncoder(os.Stdout).Encode(cred); err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to write credential: %v\n", err)
+		return 1
+	}
+	return 0
+}
@@ -0,0 +1,212 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// testIDToken returns an unsigned JWT ID token expiring at exp.
+func testIDToken(sub string, exp time.Time) string {
+	claims, _ := json.Marshal(map[string]any{"sub": sub, "exp": exp.Unix()})
+	return "eyJhbGciOiJub25lIn0." + base64.RawURLEncoding.EncodeToString(claims) + ".sig"
+}
+
+// runKubeCredentialOutput runs kube-credential with args and decodes what it
+// printed to stdout.
+func runKubeCredentialOutput(t *testing.T, args ...string) (execCredential, int) {
+	t.Helper()
+	origStdout, origForce := os.Stdout, forceDevice
+	t.Cleanup(func() { os.Stdout, forceDevice = origStdout, origForce })
+	r, w, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	os.Stdout = w
+	code := runKubeCredential(t.Context(), args)
+	w.Close()
+	os.Stdout = origStdout
+
+	var cred execCredential
+	data, _ := io.ReadAll(r)
+	if code == 0 {
+		if err := json.Unmarshal(data, &cred); err != nil {
+			t.Fatalf("output %q: %v", data, err)
+		}
+	}
+	return cred, code
+}
+
+func TestKubeInteractive(t *testing.T) {
+	for info, want := range map[string]bool{
+		`{"apiVersion":"client.authentication.k8s.io/v1","spec":{"interactive":true}}`:  true,
+		`{"apiVersion":"client.authentication.k8s.io/v1","spec":{"interactive":false}}`: false,
+		`not json`: false,
+	} {
+		t.Setenv(kubeExecInfoEnv, info)
+		if got := kubeInteractive(); got != want {
+			t.Errorf("kubeInteractive() with %s = %v, want %v", info, got, want)
+		}
+	}
+}
+
+func TestKubeToken(t *testing.T) {
+	setRefreshLeeway(t, time.Minute, 0)
+	now := time.Now()
+	storage := &TokenStorage{
+		AccessToken: "kube-access-token",
+		IDToken:     testIDToken("user", now.Add(10*time.Minute)),
+		ExpiresAt:   now.Add(time.Hour),
+	}
+
+	token, expiry := kubeToken(storage, false)
+	if token != "kube-access-token" || !expiry.Equal(now.Add(59*time.Minute)) {
+		t.Errorf("access token = %q expiring %v", token, expiry)
+	}
+	token, expiry = kubeToken(storage, true)
+	if token != storage.IDToken || expiry.Unix() != now.Add(10*time.Minute).Unix() {
+		t.Errorf("ID token = %q expiring %v, want the ID token's exp", token, expiry)
+	}
+}
+
+func TestRunKubeCredential(t *testing.T) {
+	var refreshes atomic.Int32
+	authServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		n := refreshes.Add(1)
+		w.Header().Set("Content-Type", "application/json")
+		_ = json.NewEncoder(w).Encode(map[string]any{
+			"access_token":  fmt.Sprintf("kube-refreshed-access-token-%d", n),
+			"refresh_token": "kube-refresh-token",
+			"token_type":    "Bearer",
+			"expires_in":    3600,
+			"id_token":      testIDToken("refreshed", time.Now().Add(time.Hour)),
+		})
+	}))
+	defer authServer.Close()
+
+	setupGitCredential(t, authServer.URL)
+	origFlow := authFlow
+	t.Cleanup(func() { authFlow = origFlow })
+	authFlow = flowAuto
+	profiles := fmt.Sprintf(`{"profiles": {"prod": {
+		"server_url": %q, "client_id": "kube-client", "scope": "openid"
+	}}}`, authServer.URL)
+	if err := os.WriteFile(profilesFile, []byte(profiles), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv(kubeExecInfoEnv, `{"kind":"ExecCredential","spec":{"interactive":false}}`)
+
+	// Not logged in to the cluster's account and no interaction allowed.
+	if _, code := runKubeCredentialOutput(t, "--profile", "prod"); code == 0 {
+		t.Fatal("kube-credential succeeded without tokens")
+	}
+
+	// Tokens of the "prod" account with an expired ID token: refreshed.
+	if err := saveTokens(&TokenStorage{
+		AccessToken:  "kube-access-token",
+		RefreshToken: "kube-refresh-token",
+		TokenType:    "Bearer",
+		ExpiresAt:    time.Now().Add(time.Hour),
+		IDToken:      testIDToken("stale", time.Now().Add(-time.Minute)),
+		Scope:        "openid",
+		ServerURL:    normalizeServerURL(authServer.URL),
+		ClientID:     "kube-client",
+		Account:      "prod",
+	}); err != nil {
+		t.Fatal(err)
+	}
+	cred, code := runKubeCredentialOutput(t, "--profile", "prod")
+	if code != 0 || cred.Status == nil {
+		t.Fatalf("kube-credential exit code %d, credential %+v", code, cred)
+	}
+	if cred.APIVersion != execCredentialAPIVersion || cred.Kind != "ExecCredential" {
+		t.Errorf("credential = %+v", cred)
+	}
+	if identityFromIDToken(cred.Status.Token).Subject != "refreshed" {
+		t.Errorf("token = %q, want the refreshed ID token", cred.Status.Token)
+	}
+	if cred.Status.ExpirationTimestamp.Before(time.Now()) {
+		t.Errorf("expirationTimestamp = %v is in the past", cred.Status.ExpirationTimestamp)
+	}
+
+	cred, code = runKubeCredentialOutput(t, "--profile", "prod", "--token", "access")
+	if code != 0 || cred.Status.Token != "kube-refreshed-access-token-1" {
+		t.Errorf("access token credential = %+v (exit %d)", cred.Status, code)
+	}
+	if n := refreshes.Load(); n != 1 {
+		t.Errorf("refreshed %d times, want 1", n)
+	}
+}
+
+func TestRunKubeCredential_RefreshWithoutIDToken(t *testing.T) {
+	var refreshes atomic.Int32
+	authServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		refreshes.Add(1)
+		w.Header().Set("Content-Type", "application/json")
+		_ = json.NewEncoder(w).Encode(map[string]any{
+			"access_token":  "kube-refreshed-access-token",
+			"refresh_token": "kube-refresh-token",
+			"token_type":    "Bearer",
+			"expires_in":    3600,
+		})
+	}))
+	defer authServer.Close()
+
+	setupGitCredential(t, authServer.URL)
+	origFlow := authFlow
+	t.Cleanup(func() { authFlow = origFlow })
+	authFlow = flowAuto
+	profiles := fmt.Sprintf(`{"profiles": {"prod": {
+		"server_url": %q, "client_id": "kube-client", "scope": "openid"
+	}}}`, authServer.URL)
+	if err := os.WriteFile(profilesFile, []byte(profiles), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv(kubeExecInfoEnv, `{"kind":"ExecCredential","spec":{"interactive":false}}`)
+	save := func(idToken string, expiresAt time.Time) {
+		t.Helper()
+		if err := saveTokens(&TokenStorage{
+			AccessToken:  "kube-access-token",
+			RefreshToken: "kube-refresh-token",
+			TokenType:    "Bearer",
+			ExpiresAt:    expiresAt,
+			IDToken:      idToken,
+			Scope:        "openid",
+			ServerURL:    normalizeServerURL(authServer.URL),
+			ClientID:     "kube-client",
+			Account:      "prod",
+		}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Expired access token, unexpired ID token: the ID token survives the
+	// refresh.
+	idToken := testIDToken("user", time.Now().Add(time.Hour))
+	save(idToken, time.Now().Add(-time.Minute))
+	cred, code := runKubeCredentialOutput(t, "--profile", "prod")
+	if code != 0 || cred.Status == nil || cred.Status.Token != idToken {
+		t.Fatalf("kube-credential exit code %d, credential %+v; want the kept ID token",
+			code, cred.Status)
+	}
+	if stored, err := loadTokens(); err != nil || stored.IDToken != idToken {
+		t.Errorf("stored ID token = %v, %v; want it kept", stored, err)
+	}
+
+	// Expired ID token and none from the refresh: a login is needed, which
+	// kubectl does not allow here.
+	save(testIDToken("user", time.Now().Add(-time.Minute)), time.Now().Add(time.Hour))
+	if _, code := runKubeCredentialOutput(t, "--profile", "prod"); code == 0 {
+		t.Error("kube-credential succeeded without a valid ID token")
+	}
+	if n := refreshes.Load(); n != 2 {
+		t.Errorf("refreshed %d times, want 2", n)
+	}
+}
@@ -0,0 +1,141 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"time"
+)
+
+// Variables rather than constants so that tests can shorten them.
+var (
+	// loginWaitTimeout bounds how long a process waits for another process's
+	// interactive login before starting its own.
+	loginWaitTimeout = 10 * time.Minute
+	// loginStatusInterval is how often the waiting process reports that it is
+	// still waiting.
+	loginStatusInterval = 15 * time.Second
+)
+
+// loginLockPath returns the lock held for the duration of an interactive
+// login, or "" for the memory store, whose tokens no other process can reuse.
+// It is shared by all clients: concurrent logins would also compete for the
+// callback port.
+func loginLockPath() string {
+	if _, ok := activeTokenStore().(*memoryTokenStore); ok {
+		return ""
+	}
+	return tokenFile + ".login"
+}
+
+// acquireLoginLock marks a login as in progress. If another process is
+// already logging in, it waits for that login to finish, printing its status.
+// Once it holds the lock, it returns the stored tokens instead when they
+// satisfy params: another login may also have finished just before the lock
+// was free. Otherwise it returns the held lock (nil when locking is
+// unavailable), and the caller runs its own flow and releases the lock
+// afterwards.
+func acquireLoginLock(
+	ctx context.Context,
+	diag io.Writer,
+	params authParams,
+) (*fileLock, *TokenStorage, error) {
+	path := loginLockPath()
+	if path == "" {
+		return nil, nil, nil
+	}
+	before := storedAccessToken()
+
+	tryCtx, cancel := context.WithTimeout(ctx, fileLockRetryDelay)
+	lock, err := acquireFileLock(tryCtx, path)
+	cancel()
+	if err == nil {
+		return reuseOtherLogin(diag, lock, params, before)
+	}
+	if ctx.Err() != nil {
+		return nil, nil, ctx.Err()
+	}
+	if !errors.Is(err, context.DeadlineExceeded) {
+		fmt.Fprintf(diag, "Warning: Failed to acquire login lock: %v\n", err)
+		return nil, nil, nil
+	}
+
+	holder := lockHolder(path + ".lock")
+	if holder == "" {
+		holder = "another process"
+	} else {
+		holder = "PID " + holder
+	}
+	fmt.Fprintf(diag,
+		"Another login is in progress (%s), waiting up to %s for it to finish...\n",
+		holder,
+		loginWaitTimeout,
+	)
+
+	deadline := time.Now().Add(loginWaitTimeout)
+	for {
+		waitCtx, cancel := context.WithTimeout(ctx, min(loginStatusInterval, time.Until(deadline)))
+		lock, err = acquireFileLock(waitCtx, path)
+		cancel()
+		if err == nil {
+			break
+		}
+		if ctx.Err() != nil {
+			return nil, nil, ctx.Err()
+		}
+		if !errors.Is(err, context.DeadlineExceeded) {
+			fmt.Fprintf(diag, "Warning: Failed to acquire login lock: %v\n", err)
+			return nil, nil, nil
+		}
+		if !time.Now().Before(deadline) {
+			fmt.Fprintln(diag, "Gave up waiting for the other login, starting a new one.")
+			return nil, nil, nil
+		}
+		fmt.Fprintf(diag, "Still waiting for the login in %s...\n", holder)
+	}
+	return reuseOtherLogin(diag, lock, params, before)
+}
+
+// reuseOtherLogin returns the stored tokens instead of the held lock, which it
+// releases, when they satisfy params. For a NewLogin they must also have
+// replaced the access token before, which was stored when the caller asked
+// for the lock.
+func reuseOtherLogin(
+	diag io.Writer,
+	lock *fileLock,
+	params authParams,
+	before string,
+) (*fileLock, *TokenStorage, error) {
+	storage := reusableLogin(params)
+	if storage == nil || (params.NewLogin && storage.AccessToken == before) {
+		return lock, nil, nil
+	}
+	_ = lock.release()
+	fmt.Fprintln(diag, "Another login finished, using its tokens.")
+	return nil, storage, nil
+}
+
+// storedAccessToken returns the stored access token, or "" if there is none.
+func storedAccessToken() string {
+	if storage, err := loadTokens(); err == nil {
+		return storage.AccessToken
+	}
+	return ""
+}
+
+// reusableLogin returns the stored tokens if they are valid and satisfy
+// params. Step-up requests always need a fresh login.
+func reusableLogin(params authParams) *TokenStorage {
+	if params.ACRValues != "" || params.MaxAge != "" {
+		return nil
+	}
+	storage, err := loadTokens()
+	if err != nil || refreshDue(storage) {
+		return nil
+	}
+	if len(missingScopes(grantedScope(storage), params.requestedScope())) > 0 {
+		return nil
+	}
+	return storage
+}
@@ -0,0 +1,169 @@
+package main
+
+import (
+	"context"
+	"io"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// setupLoginLockTest points the token globals at a temp file store and
+// shortens the login wait, restoring everything when the test ends.
+func setupLoginLockTest(t *testing.T, wait time.Duration) {
+	t.Helper()
+	origStore, origFile := tokenStore, tokenFile
+	origServer, origClient, origScope := serverURL, clientID, scope
+	origWait, origInterval := loginWaitTimeout, loginStatusInterval
+	t.Cleanup(func() {
+		tokenStore, tokenFile = origStore, origFile
+		serverURL, clientID, scope = origServer, origClient, origScope
+		loginWaitTimeout, loginStatusInterval = origWait, origInterval
+	})
+	tokenStore = nil
+	tokenFile = filepath.Join(t.TempDir(), "tokens.json")
+	serverURL = "https://auth.example.com"
+	clientID = "login-lock-client"
+	scope = "read write"
+	loginWaitTimeout = wait
+	loginStatusInterval = 50 * time.Millisecond
+}
+
+// holdLoginLock simulates another process's login that saves storage (if
+// non-nil) and finishes after d.
+func holdLoginLock(t *testing.T, d time.Duration, storage *TokenStorage) {
+	t.Helper()
+	lock, err := acquireFileLock(context.Background(), loginLockPath())
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		time.Sleep(d)
+		if storage != nil {
+			if err := saveTokens(storage); err != nil {
+				t.Error(err)
+			}
+		}
+		_ = lock.release()
+	}()
+}
+
+func TestAcquireLoginLock_Uncontended(t *testing.T) {
+	setupLoginLockTest(t, time.Second)
+
+	lock, storage, err := acquireLoginLock(context.Background(), io.Discard, authParams{})
+	if err != nil || lock == nil || storage != nil {
+		t.Fatalf("acquireLoginLock() = %v, %v, %v; want a lock", lock, storage, err)
+	}
+	_ = lock.release()
+}
+
+func TestAcquireLoginLock_MissingDirectory(t *testing.T) {
+	setupLoginLockTest(t, time.Second)
+	tokenFile = filepath.Join(t.TempDir(), "not-yet-created", "tokens.json")
+
+	lock, _, err := acquireLoginLock(context.Background(), io.Discard, authParams{})
+	if err != nil || lock == nil {
+		t.Fatalf("acquireLoginLock() = %v, %v; want a lock", lock, err)
+	}
+	_ = lock.release()
+}
+
+func TestAcquireLoginLock_ReusesOtherLogin(t *testing.T) {
+	setupLoginLockTest(t, 5*time.Second)
+	holdLoginLock(t, 200*time.Millisecond, &TokenStorage{
+		AccessToken: "from-other-process",
+		ExpiresAt:   time.Now().Add(time.Hour),
+		Scope:       "read write",
+	})
+
+	lock, storage, err := acquireLoginLock(context.Background(), io.Discard, authParams{})
+	if err != nil {
+		t.Fatalf("acquireLoginLock() error: %v", err)
+	}
+	if lock != nil {
+		t.Error("acquireLoginLock() returned a lock although tokens were reused")
+	}
+	if storage == nil || storage.AccessToken != "from-other-process" {
+		t.Errorf("acquireLoginLock() storage = %+v, want the other login's tokens", storage)
+	}
+}
+
+func TestAcquireLoginLock_ReusesLoginFinishedBeforeAcquiring(t *testing.T) {
+	setupLoginLockTest(t, time.Second)
+	// Saved by a login that released the lock before this process asked.
+	if err := saveTokens(&TokenStorage{
+		AccessToken: "from-other-process",
+		ExpiresAt:   time.Now().Add(time.Hour),
+		Scope:       "read write",
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	lock, storage, err := acquireLoginLock(context.Background(), io.Discard, authParams{})
+	if err != nil || lock != nil || storage == nil {
+		t.Fatalf("acquireLoginLock() = %v, %+v, %v; want the stored tokens", lock, storage, err)
+	}
+
+	// A new login was asked for regardless of the stored tokens.
+	lock, storage, err = acquireLoginLock(
+		context.Background(),
+		io.Discard,
+		authParams{NewLogin: true},
+	)
+	if err != nil || lock == nil || storage != nil {
+		t.Fatalf("acquireLoginLock(NewLogin) = %v, %+v, %v; want a lock", lock, storage, err)
+	}
+	_ = lock.release()
+}
+
+func TestAcquireLoginLock_DoesNotReuseUnsuitableTokens(t *testing.T) {
+	tests := []struct {
+		name   string
+		params authParams
+	}{
+		{"missing scope", authParams{Scope: "read write admin"}},
+		{"step-up", authParams{ACRValues: "mfa"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			setupLoginLockTest(t, 5*time.Second)
+			holdLoginLock(t, 100*time.Millisecond, &TokenStorage{
+				AccessToken: "from-other-process",
+				ExpiresAt:   time.Now().Add(time.Hour),
+				Scope:       "read write",
+			})
+
+			lock, storage, err := acquireLoginLock(context.Background(), io.Discard, tt.params)
+			if err != nil || lock == nil || storage != nil {
+				t.Fatalf("acquireLoginLock() = %v, %+v, %v; want a lock", lock, storage, err)
+			}
+			_ = lock.release()
+		})
+	}
+}
+
+func TestAcquireLoginLock_Timeout(t *testing.T) {
+	setupLoginLockTest(t, 200*time.Millisecond)
+	holdLoginLock(t, 2*time.Second, nil)
+
+	start := time.Now()
+	lock, storage, err := acquireLoginLock(context.Background(), io.Discard, authParams{})
+	if err != nil || lock != nil || storage != nil {
+		t.Fatalf("acquireLoginLock() = %v, %+v, %v; want to give up", lock, storage, err)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("gave up after %v, want about 200ms", elapsed)
+	}
+}
+
+func TestAcquireLoginLock_Canceled(t *testing.T) {
+	setupLoginLockTest(t, 5*time.Second)
+	holdLoginLock(t, 2*time.Second, nil)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+	defer cancel()
+	if _, _, err := acquireLoginLock(ctx, io.Discard, authParams{}); err == nil {
+		t.Fatal("acquireLoginLock() with canceled context succeeded")
+	}
+}
@@ -0,0 +1,221 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// parseRedirectURI parses a loopback redirect URI (RFC 8252 §7.3): plain
+// http to localhost or a loopback IP address, optionally with a port and a
+// path. The callback server serves exactly that host, port and path.
+func parseRedirectURI(raw string) (*url.URL, error) {
+	u, err := url.Parse(raw)
+	if err != nil {
+		return nil, fmt.Errorf("invalid URL format: %w", err)
+	}
+	if u.Scheme != "http" {
+		return nil, fmt.Errorf("scheme must be http for a loopback redirect, got %q", u.Scheme)
+	}
+	if u.Fragment != "" || u.User != nil {
+		return nil, fmt.Errorf("must not contain a fragment or user information")
+	}
+	host := u.Hostname()
+	if ip := net.ParseIP(host); !strings.EqualFold(host, "localhost") &&
+		(ip == nil || !ip.IsLoopback()) {
+		return nil, fmt.Errorf(
+			"host %q is not a loopback address (use localhost, 127.0.0.1 or [::1])",
+			host,
+		)
+	}
+	if port := u.Port(); port != "" {
+		if _, err := parsePort(port); err != nil {
+			return nil, err
+		}
+	}
+	return u, nil
+}
+
+// ipv6LoopbackAvailable reports whether ::1 can be bound at all, so that a
+// failure to bind it on a given port means that the port is busy.
+var ipv6LoopbackAvailable = sync.OnceValue(func() bool {
+	ln, err := (&net.ListenConfig{}).Listen(context.Background(), "tcp", "[::1]:0")
+	if err != nil {
+		return false
+	}
+	ln.Close()
+	return true
+})
+
+// callbackHosts returns the addresses the callback server listens on for the
+// redirect URI: its IP address, or for localhost, which browsers may resolve
+// to either, both 127.0.0.1 and ::1.
+func callbackHosts() []string {
+	host := "localhost"
+	if u, err := url.Parse(redirectURI); err == nil {
+		host = u.Hostname()
+	}
+	if net.ParseIP(host) != nil {
+		return []string{host}
+	}
+	if ipv6LoopbackAvailable() {
+		return []string{"127.0.0.1", "::1"}
+	}
+	return []string{"127.0.0.1"}
+}
+
+// callbackPath returns the path of the redirect URI, which the callback
+// server serves.
+func callbackPath() string {
+	if u, err := url.Parse(redirectURI); err == nil && u.Path != "" {
+		return u.Path
+	}
+	return "/"
+}
+
+// listenCallback binds the callback server to the first available port of
+// ports on the loopback addresses of the redirect URI (see callbackHosts).
+// Port 0 binds an ephemeral port chosen by the OS, which RFC 8252 §7.3
+// requires servers to accept for loopback redirect URIs.
+func listenCallback(ctx context.Context, ports []int) (net.Listener, error) {
+	hosts := callbackHosts()
+	var errs []error
+	for _, port := range ports {
+		ln, err := listenLoopback(ctx, hosts, port)
+		if err == nil {
+			return ln, nil
+		}
+		errs = append(errs, err)
+	}
+	if len(errs) == 1 {
+		return nil, errs[0]
+	}
+	return nil, fmt.Errorf("no callback port available: %w", errors.Join(errs...))
+}
+
+// ephemeralBindAttempts is how often a dual-stack bind of port 0 is tried
+// before giving up on it: the port the OS picked for the first address may be
+// in use on another.
+const ephemeralBindAttempts = 5
+
+// listenTCP binds one address. It is a variable so that tests can make binds
+// fail.
+var listenTCP = func(ctx context.Context, address string) (net.Listener, error) {
+	return (&net.ListenConfig{}).Listen(ctx, "tcp", address)
+}
+
+// listenLoopback binds port on all of hosts. With port 0, the first host
+// picks the port and the others bind the same one; when that fails, a new
+// port is picked up to ephemeralBindAttempts times.
+func listenLoopback(ctx context.Context, hosts []string, port int) (net.Listener, error) {
+	attempts := 1
+	if port == 0 && len(hosts) > 1 {
+		attempts = ephemeralBindAttempts
+	}
+	var err error
+	for range attempts {
+		var ln net.Listener
+		if ln, err = bindLoopback(ctx, hosts, port); err == nil || ctx.Err() != nil {
+			return ln, err
+		}
+	}
+	return nil, err
+}
+
+// bindLoopback makes one attempt of listenLoopback.
+func bindLoopback(ctx context.Context, hosts []string, port int) (net.Listener, error) {
+	var listeners []net.Listener
+	for _, host := range hosts {
+		ln, err := listenTCP(ctx, net.JoinHostPort(host, strconv.Itoa(port)))
+		if err != nil {
+			for _, l := range listeners {
+				l.Close()
+			}
+			return nil, err
+		}
+		port = ln.Addr().(*net.TCPAddr).Port
+		listeners = append(listeners, ln)
+	}
+	if len(listeners) == 1 {
+		return listeners[0], nil
+	}
+	return newMultiListener(listeners), nil
+}
+
+// callbackRedirectURI returns the configured redirect URI with its port
+// replaced by the port ln is bound to.
+func callbackRedirectURI(ln net.Listener) string {
+	port := strconv.Itoa(ln.Addr().(*net.TCPAddr).Port)
+	u, err := url.Parse(redirectURI)
+	if err != nil {
+		return redirectURI
+	}
+	u.Host = net.JoinHostPort(u.Hostname(), port)
+	return u.String()
+}
+
+// multiListener accepts connections from several listeners, e.g. the IPv4
+// and IPv6 loopback listeners of a dual-stack callback server.
+type multiListener struct {
+	listeners []net.Listener
+	conns     chan net.Conn
+	done      chan struct{}
+	closeOnce sync.Once
+}
+
+func newMultiListener(listeners []net.Listener) *multiListener {
+	m := &multiListener{
+		listeners: listeners,
+		conns:     make(chan net.Conn),
+		done:      make(chan struct{}),
+	}
+	for _, ln := range listeners {
+		go m.acceptLoop(ln)
+	}
+	return m
+}
+
+func (m *multiListener) acceptLoop(ln net.Listener) {
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		select {
+		case m.conns <- conn:
+		case <-m.done:
+			conn.Close()
+			return
+		}
+	}
+}
+
+func (m *multiListener) Accept() (net.Conn, error) {
+	select {
+	case conn := <-m.conns:
+		return conn, nil
+	case <-m.done:
+		return nil, net.ErrClosed
+	}
+}
+
+func (m *multiListener) Close() error {
+	var errs []error
+	m.closeOnce.Do(func() {
+		close(m.done)
+		for _, ln := range m.listeners {
+			errs = append(errs, ln.Close())
+		}
+	})
+	return errors.Join(errs...)
+}
+
+// Addr returns the address of the first listener; all share the port.
+func (m *multiListener) Addr() net.Addr {
+	return m.listeners[0].Addr()
+}
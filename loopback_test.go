@@ -0,0 +1,56 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net"
+	"strings"
+	"syscall"
+	"testing"
+)
+
+func TestListenLoopback_RetriesEphemeralPort(t *testing.T) {
+	orig := listenTCP
+	t.Cleanup(func() { listenTCP = orig })
+
+	// "second" stands for ::1: its first bind finds the port taken.
+	var secondBinds int
+	listenTCP = func(ctx context.Context, address string) (net.Listener, error) {
+		if !strings.HasPrefix(address, "second:") {
+			return orig(ctx, address)
+		}
+		secondBinds++
+		if secondBinds == 1 {
+			return nil, syscall.EADDRINUSE
+		}
+		return orig(ctx, "127.0.0.1:0")
+	}
+	hosts := []string{"127.0.0.1", "second"}
+
+	ln, err := listenLoopback(context.Background(), hosts, 0)
+	if err != nil {
+		t.Fatalf("listenLoopback(0) error: %v", err)
+	}
+	ln.Close()
+	if secondBinds != 2 {
+		t.Errorf("bound the second address %d times, want 2", secondBinds)
+	}
+
+	// A configured port is not retried.
+	secondBinds = 0
+	probe, err := orig(context.Background(), "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	port := probe.Addr().(*net.TCPAddr).Port
+	probe.Close()
+	if _, err := listenLoopback(context.Background(), hosts, port); !errors.Is(
+		err,
+		syscall.EADDRINUSE,
+	) {
+		t.Errorf("listenLoopback(%d) error = %v, want EADDRINUSE", port, err)
+	}
+	if secondBinds != 1 {
+		t.Errorf("bound the second address %d times with a fixed port, want 1", secondBinds)
+	}
+}
@@ -3,8 +3,11 @@ package main
 import (
 	"context"
 	"encoding/json"
+	"errors"
+	"flag"
 	"fmt"
 	"io"
+	"net"
 	"net/http"
 	"net/url"
 	"os"
@@ -18,7 +21,14 @@ func main() {
 	initConfig()
 
 	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
-	exitCode := run(ctx)
+	var exitCode int
+	if isDockerCredentialHelper() {
+		exitCode = runDockerCredential(ctx, flag.Args())
+	} else if args := flag.Args(); len(args) > 0 {
+		exitCode = runCommand(ctx, args)
+	} else {
+		exitCode = run(ctx)
+	}
 	stop()
 	os.Exit(exitCode)
 }
@@ -40,19 +50,17 @@ func run(ctx context.Context) int {
 	existing, err := loadTokens()
 	if err == nil && existing != nil {
 		fmt.Println("Found existing tokens.")
-		if time.Now().Before(existing.ExpiresAt) {
+		if !refreshDue(existing) {
 			fmt.Println("Access token is still valid, using it.")
-			storage = existing
 		} else {
-			fmt.Println("Access token expired, attempting refresh...")
-			newStorage, err := refreshAccessToken(ctx, existing.RefreshToken)
-			if err != nil {
-				fmt.Printf("Refresh failed: %v\n", err)
-				fmt.Println("Starting new authentication flow...")
-			} else {
-				storage = newStorage
-				fmt.Println("Token refreshed successfully.")
-			}
+			fmt.Println("Access token expired or about to expire, attempting refresh...")
+		}
+		storage, err = reuseStoredTokens(ctx, os.Stdout, existing)
+		switch {
+		case err != nil:
+			fmt.Println("Starting new authentication flow...")
+		case storage != existing:
+			fmt.Println("Token refreshed successfully.")
 		}
 	} else {
 		fmt.Println("No existing tokens found, starting authentication flow...")
@@ -60,7 +68,7 @@ func run(ctx context.Context) int {
 
 	// No valid tokens — select and run the appropriate flow.
 	if storage == nil {
-		storage, err = authenticate(ctx)
+		storage, err = authenticate(ctx, os.Stdout, authParams{})
 		if err != nil {
 			fmt.Fprintf(os.Stderr, "Authentication failed: %v\n", err)
 			return 1
@@ -76,7 +84,7 @@ func run(ctx context.Context) int {
 	}
 	fmt.Printf("Access Token : %s...\n", preview)
 	fmt.Printf("Token Type   : %s\n", storage.TokenType)
-	fmt.Printf("Expires In   : %s\n", time.Until(storage.ExpiresAt).Round(time.Second))
+	fmt.Printf("Expires In   : %s\n", tokenRemaining(storage).Round(time.Second))
 	if storage.Flow != "" {
 		fmt.Printf("Auth Flow    : %s\n", storage.Flow)
 	}
@@ -92,15 +100,15 @@ func run(ctx context.Context) int {
 
 	// Demonstrate auto-refresh on 401.
 	fmt.Println("\nDemonstrating automatic refresh on API call...")
-	if err := makeAPICallWithAutoRefresh(ctx, storage); err != nil {
-		if err == ErrRefreshTokenExpired {
+	if err := makeAPICallWithAutoRefresh(ctx, os.Stdout, storage); err != nil {
+		if errors.Is(err, ErrRefreshTokenExpired) {
 			fmt.Println("Refresh token expired, re-authenticating...")
-			storage, err = authenticate(ctx)
+			storage, err = authenticate(ctx, os.Stdout, authParams{NewLogin: true})
 			if err != nil {
 				fmt.Fprintf(os.Stderr, "Re-authentication failed: %v\n", err)
 				return 1
 			}
-			if err := makeAPICallWithAutoRefresh(ctx, storage); err != nil {
+			if err := makeAPICallWithAutoRefresh(ctx, os.Stdout, storage); err != nil {
 				fmt.Fprintf(os.Stderr, "API call failed after re-authentication: %v\n", err)
 				return 1
 			}
@@ -112,33 +120,109 @@ func run(ctx context.Context) int {
 	return 0
 }
 
+// authParams carries optional overrides for an interactive authorization
+// request. The zero value requests the configured scope.
+type authParams struct {
+	Scope     string // space-separated scopes; empty means the configured scope
+	ACRValues string // requested authentication context classes (RFC 9470)
+	MaxAge    string // maximum authentication age in seconds (RFC 9470)
+	// NewLogin means the stored tokens were rejected or a login was asked
+	// for regardless of them: only tokens from another login may be reused.
+	NewLogin bool
+}
+
+// requestedScope returns the scope to request from the authorization server.
+func (p authParams) requestedScope() string {
+	if p.Scope != "" {
+		return p.Scope
+	}
+	return scope
+}
+
+// setAuthParams adds the scope and any step-up parameters to an
+// authorization request.
+func (p authParams) setAuthParams(v url.Values) {
+	v.Set("scope", p.requestedScope())
+	if p.ACRValues != "" {
+		v.Set("acr_values", p.ACRValues)
+	}
+	if p.MaxAge != "" {
+		v.Set("max_age", p.MaxAge)
+	}
+}
+
 // authenticate selects and runs the appropriate OAuth flow:
 //
-//  1. --device / --no-browser flag → Device Code Flow (forced)
-//  2. Environment signals (SSH, no display, port busy) → Device Code Flow
-//  3. Browser available → Authorization Code Flow with PKCE
+//  1. --flow ciba → Client-Initiated Backchannel Authentication;
+//     --flow federated → exchange of an external (CI-issued) assertion
+//  2. --device / --no-browser / --flow device → Device Code Flow (forced)
+//  3. Environment signals (SSH, no display, port busy) → Device Code Flow,
+//     unless --flow browser skips the detection
+//  4. Browser available → Authorization Code Flow with PKCE
 //     - openBrowser() error → immediate fallback to Device Code Flow
-func authenticate(ctx context.Context) (*TokenStorage, error) {
+//
+// Interactive logins are single-flight across processes: while another
+// process is logging in, authenticate waits for it and reuses its tokens.
+// Progress messages and prompts are written to diag.
+func authenticate(
+	ctx context.Context,
+	diag io.Writer,
+	params authParams,
+) (*TokenStorage, error) {
+	if authFlow != flowFederated {
+		lock, storage, err := acquireLoginLock(ctx, diag, params)
+		if err != nil {
+			return nil, err
+		}
+		if storage != nil {
+			return storage, nil
+		}
+		if lock != nil {
+			defer func() { _ = lock.release() }()
+		}
+	}
+	return runAuthFlow(ctx, diag, params)
+}
+
+// runAuthFlow selects and runs the authentication flow.
+func runAuthFlow(
+	ctx context.Context,
+	diag io.Writer,
+	params authParams,
+) (*TokenStorage, error) {
+	switch authFlow {
+	case flowCIBA:
+		fmt.Fprintln(diag, "Auth method : Client-Initiated Backchannel Authentication (CIBA)")
+		return performCIBAFlow(ctx, diag, params)
+	case flowFederated:
+		fmt.Fprintln(diag, "Auth method : Workload Identity Federation (assertion exchange)")
+		return performFederatedFlow(ctx, diag, params)
+	}
+
 	if forceDevice {
-		fmt.Println("Auth method : Device Code Flow (forced via flag)")
-		return performDeviceFlow(ctx)
+		fmt.Fprintln(diag, "Auth method : Device Code Flow (forced via flag)")
+		return performDeviceFlow(ctx, diag, params)
 	}
 
-	avail := checkBrowserAvailability(ctx, callbackPort)
-	if !avail.Available {
-		fmt.Printf("Auth method : Device Code Flow (%s)\n", avail.Reason)
-		return performDeviceFlow(ctx)
+	var ln net.Listener
+	if authFlow != flowBrowser {
+		avail := checkBrowserAvailability(ctx, callbackPorts)
+		if !avail.Available {
+			fmt.Fprintf(diag, "Auth method : Device Code Flow (%s)\n", avail.Reason)
+			return performDeviceFlow(ctx, diag, params)
+		}
+		ln = avail.Listener
 	}
 
-	fmt.Println("Auth method : Authorization Code Flow (browser)")
-	storage, ok, err := performBrowserFlow(ctx)
+	fmt.Fprintln(diag, "Auth method : Authorization Code Flow (browser)")
+	storage, ok, err := performBrowserFlow(ctx, diag, params, ln)
 	if err != nil {
 		return nil, err
 	}
 	if !ok {
 		// openBrowser() failed; fall back to Device Code Flow immediately.
-		fmt.Println("Auth method : Device Code Flow (browser unavailable)")
-		return performDeviceFlow(ctx)
+		fmt.Fprintln(diag, "Auth method : Device Code Flow (browser unavailable)")
+		return performDeviceFlow(ctx, diag, params)
 	}
 	return storage, nil
 }
@@ -147,7 +231,140 @@ func authenticate(ctx context.Context) (*TokenStorage, error) {
 // Token refresh
 // -----------------------------------------------------------------------
 
-func refreshAccessToken(ctx context.Context, refreshToken string) (*TokenStorage, error) {
+// reuseStoredTokens returns existing while it is not due for refresh, and
+// refreshed tokens otherwise. When the refresh fails but the access token has
+// not expired yet and the refresh token was not rejected, the failure is
+// probably transient and existing is returned, since it still works for now.
+// An error means a new login is needed.
+func reuseStoredTokens(
+	ctx context.Context,
+	diag io.Writer,
+	existing *TokenStorage,
+) (*TokenStorage, error) {
+	if !refreshDue(existing) {
+		touchLastUsed(diag, existing)
+		return existing, nil
+	}
+
+	refreshed, err := refreshStoredTokens(ctx, diag, existing)
+	if err == nil {
+		return refreshed, nil
+	}
+	fmt.Fprintf(diag, "Refresh failed: %v\n", err)
+	if !tokenExpired(existing) && !errors.Is(err, ErrRefreshTokenExpired) {
+		fmt.Fprintln(diag, "Access token has not expired yet, using it for now.")
+		return existing, nil
+	}
+	return nil, err
+}
+
+// refreshStoredTokens refreshes the expired or rejected tokens in stale,
+// coordinating with other processes so that concurrent invocations cause a
+// single refresh. It holds the refresh lock while it re-reads the store: if
+// another process already replaced stale with a valid token, that token is
+// returned; otherwise the newest stored refresh token is used.
+func refreshStoredTokens(
+	ctx context.Context,
+	diag io.Writer,
+	stale *TokenStorage,
+) (*TokenStorage, error) {
+	if path := refreshLockPath(); path != "" {
+		lockCtx, cancel := context.WithTimeout(ctx, refreshLockTimeout)
+		lock, err := acquireFileLock(lockCtx, path)
+		cancel()
+		if err != nil {
+			// Refresh anyway; the rotation journal covers a lost race.
+			fmt.Fprintf(diag, "Warning: Failed to acquire refresh lock: %v\n", err)
+		} else {
+			defer func() { _ = lock.release() }()
+		}
+	}
+
+	refreshToken := stale.RefreshToken
+	if current, err := loadTokens(); err == nil {
+		if current.AccessToken != stale.AccessToken && !refreshDue(current) {
+			fmt.Fprintln(diag, "Tokens were refreshed by another process, using them.")
+			return current, nil
+		}
+		if current.RefreshToken != "" {
+			refreshToken = current.RefreshToken
+		}
+	}
+	return refreshAccessToken(ctx, diag, refreshToken)
+}
+
+// refreshLockPath returns the lock that serializes refreshes of this token
+// store across processes, or "" for the memory store, which no other process
+// can see.
+func refreshLockPath() string {
+	if _, ok := activeTokenStore().(*memoryTokenStore); ok {
+		return ""
+	}
+	return tokenFile + ".refresh"
+}
+
+// refreshAccessToken exchanges refreshToken for new tokens and persists them.
+// Callers holding stored tokens use refreshStoredTokens instead.
+//
+// With refresh token rotation, the previous refresh token is dead once the
+// server answers, so refresh is treated as a transaction: every rotation is
+// first recorded in the rotation journal, and success is only reported after
+// the new tokens were written to the token file. A token that the journal
+// shows as already rotated is never presented again; the newest one from the
+// journal is used instead.
+func refreshAccessToken(
+	ctx context.Context,
+	diag io.Writer,
+	refreshToken string,
+) (*TokenStorage, error) {
+	if refreshToken == "" {
+		// Grants such as jwt-bearer usually issue no refresh token.
+		return nil, ErrRefreshTokenExpired
+	}
+
+	journal, err := loadRefreshJournal()
+	if err != nil {
+		fmt.Fprintf(diag, "Warning: Failed to read refresh journal: %v\n", err)
+	}
+	presented := latestRotation(journal, refreshToken)
+	if presented != refreshToken {
+		fmt.Fprintln(diag, "Using newer refresh token recovered from the rotation journal.")
+	}
+
+	storage, err := requestTokenRefresh(ctx, presented)
+	if err != nil {
+		if errors.Is(err, ErrRefreshTokenExpired) && issuedByRotation(journal, presented) {
+			return nil, ErrRefreshTokenReused
+		}
+		return nil, err
+	}
+
+	// An omitted scope means the original grant is unchanged (RFC 6749 §5.1),
+	// and identity claims only change with a new login. Servers need not
+	// return an ID token on refresh (OIDC Core §12.2); the previous one stays
+	// usable until it expires.
+	if prev, err := loadTokens(); err == nil &&
+		(prev.RefreshToken == refreshToken || prev.RefreshToken == presented) {
+		if storage.Scope == "" {
+			storage.Scope = prev.Scope
+		}
+		if storage.Identity == nil {
+			storage.Identity = prev.Identity
+		}
+		if storage.IDToken == "" && idTokenValid(prev) {
+			storage.IDToken = prev.IDToken
+		}
+	}
+
+	if err := persistRefreshedTokens(diag, storage, presented); err != nil {
+		return nil, err
+	}
+	return storage, nil
+}
+
+// requestTokenRefresh performs the refresh_token grant against the token
+// endpoint without persisting anything.
+func requestTokenRefresh(ctx context.Context, refreshToken string) (*TokenStorage, error) {
 	ctx, cancel := context.WithTimeout(ctx, refreshTokenTimeout)
 	defer cancel()
 
@@ -192,12 +409,7 @@ func refreshAccessToken(ctx context.Context, refreshToken string) (*TokenStorage
 		return nil, fmt.Errorf("refresh failed with status %d: %s", resp.StatusCode, string(body))
 	}
 
-	var tokenResp struct {
-		AccessToken  string `json:"access_token"`
-		RefreshToken string `json:"refresh_token"`
-		TokenType    string `json:"token_type"`
-		ExpiresIn    int    `json:"expires_in"`
-	}
+	var tokenResp tokenResponse
 	if err := json.Unmarshal(body, &tokenResp); err != nil {
 		return nil, fmt.Errorf("failed to parse token response: %w", err)
 	}
@@ -216,18 +428,58 @@ func refreshAccessToken(ctx context.Context, refreshToken string) (*TokenStorage
 		newRefreshToken = refreshToken
 	}
 
-	storage := &TokenStorage{
+	return &TokenStorage{
 		AccessToken:  tokenResp.AccessToken,
 		RefreshToken: newRefreshToken,
 		TokenType:    tokenResp.TokenType,
-		ExpiresAt:    time.Now().Add(time.Duration(tokenResp.ExpiresIn) * time.Second),
+		ExpiresAt:    serverNow().Add(time.Duration(tokenResp.ExpiresIn) * time.Second),
+		IssuedAt:     serverNow(),
+		ClockSkew:    currentClockSkew(),
 		ClientID:     clientID,
+		Scope:        tokenResp.Scope,
+		IDToken:      tokenResp.IDToken,
+		Identity:     identityFromIDToken(tokenResp.IDToken),
+	}, nil
+}
+
+// persistRefreshedTokens saves the result of a refresh. In fixed mode a
+// failed save only loses the new access token, so it is a warning. After a
+// rotation the old refresh token is no longer usable, so the rotation is
+// journaled first and a failed save is an error.
+func persistRefreshedTokens(
+	diag io.Writer,
+	storage *TokenStorage,
+	previousRefreshToken string,
+) error {
+	rotated := storage.RefreshToken != previousRefreshToken
+	if rotated {
+		if err := appendRefreshJournal(journalEntry{
+			RotatedAt:            time.Now().UTC(),
+			ClientID:             storage.ClientID,
+			ServerURL:            normalizeServerURL(serverURL),
+			PreviousRefreshToken: previousRefreshToken,
+			RefreshToken:         storage.RefreshToken,
+		}); err != nil {
+			fmt.Fprintf(diag, "Warning: Failed to record refresh token rotation: %v\n", err)
+		}
 	}
 
-	if err := saveTokens(storage); err != nil {
-		fmt.Printf("Warning: Failed to save refreshed tokens: %v\n", err)
+	err := saveTokensWithRetry(storage)
+	if err == nil {
+		return nil
 	}
-	return storage, nil
+	if !rotated {
+		fmt.Fprintf(diag, "Warning: Failed to save refreshed tokens: %v\n", err)
+		return nil
+	}
+	if path := refreshJournalPath(); path != "" {
+		return fmt.Errorf(
+			"refresh token was rotated but could not be saved: %w (recovery copy in %s)",
+			err,
+			path,
+		)
+	}
+	return fmt.Errorf("refresh token was rotated but could not be saved: %w", err)
 }
 
 // -----------------------------------------------------------------------
@@ -268,48 +520,62 @@ func verifyToken(ctx context.Context, accessToken string) error {
 }
 
 // makeAPICallWithAutoRefresh demonstrates the 401 → refresh → retry pattern.
-func makeAPICallWithAutoRefresh(ctx context.Context, storage *TokenStorage) error {
-	req, err := http.NewRequestWithContext(ctx, http.MethodGet, serverURL+"/oauth/tokeninfo", nil)
-	if err != nil {
-		return fmt.Errorf("failed to create request: %w", err)
-	}
-	req.Header.Set("Authorization", "Bearer "+storage.AccessToken)
-
-	resp, err := retryClient.DoWithContext(ctx, req)
+//
+// When the resource server answers with a Bearer challenge asking for more
+// scope or stronger authentication (insufficient_scope /
+// insufficient_user_authentication), refreshing would only yield another
+// token with the same grant. Instead a new interactive flow is started with
+// the parameters from the challenge, and the call is retried once.
+func makeAPICallWithAutoRefresh(
+	ctx context.Context,
+	diag io.Writer,
+	storage *TokenStorage,
+) error {
+	resp, err := doAPIRequest(ctx, storage.AccessToken)
 	if err != nil {
 		return fmt.Errorf("API request failed: %w", err)
 	}
 	defer resp.Body.Close()
 
-	if resp.StatusCode == http.StatusUnauthorized {
-		fmt.Println("Access token rejected (401), refreshing...")
+	if ch := stepUpChallenge(resp); ch != nil {
+		fmt.Fprintf(
+			diag,
+			"Server requires step-up authentication (%s), re-authenticating...\n",
+			ch.Error,
+		)
+		if ch.ErrorDescription != "" {
+			fmt.Fprintf(diag, "  %s\n", ch.ErrorDescription)
+		}
 
-		newStorage, err := refreshAccessToken(ctx, storage.RefreshToken)
+		newStorage, err := authenticate(ctx, diag, ch.authParams(grantedScope(storage)))
 		if err != nil {
-			if err == ErrRefreshTokenExpired {
-				return ErrRefreshTokenExpired
-			}
-			return fmt.Errorf("refresh failed: %w", err)
+			return fmt.Errorf("step-up authentication failed: %w", err)
 		}
+		*storage = *newStorage
 
-		storage.AccessToken = newStorage.AccessToken
-		storage.RefreshToken = newStorage.RefreshToken
-		storage.ExpiresAt = newStorage.ExpiresAt
+		fmt.Fprintln(diag, "Step-up authentication complete, retrying API call...")
 
-		fmt.Println("Token refreshed, retrying API call...")
+		resp, err = doAPIRequest(ctx, storage.AccessToken)
+		if err != nil {
+			return fmt.Errorf("retry failed: %w", err)
+		}
+		defer resp.Body.Close()
+	} else if resp.StatusCode == http.StatusUnauthorized {
+		fmt.Fprintln(diag, "Access token rejected (401), refreshing...")
 
-		req, err = http.NewRequestWithContext(
-			ctx,
-			http.MethodGet,
-			serverURL+"/oauth/tokeninfo",
-			nil,
-		)
+		newStorage, err := refreshStoredTokens(ctx, diag, storage)
 		if err != nil {
-			return fmt.Errorf("failed to create retry request: %w", err)
+			if errors.Is(err, ErrRefreshTokenExpired) {
+				return err
+			}
+			return fmt.Errorf("refresh failed: %w", err)
 		}
-		req.Header.Set("Authorization", "Bearer "+storage.AccessToken)
 
-		resp, err = retryClient.DoWithContext(ctx, req)
+		*storage = *newStorage
+
+		fmt.Fprintln(diag, "Token refreshed, retrying API call...")
+
+		resp, err = doAPIRequest(ctx, storage.AccessToken)
 		if err != nil {
 			return fmt.Errorf("retry failed: %w", err)
 		}
@@ -325,6 +591,16 @@ func makeAPICallWithAutoRefresh(ctx context.Context, storage *TokenStorage) erro
 		return fmt.Errorf("API call failed with status %d: %s", resp.StatusCode, string(body))
 	}
 
-	fmt.Println("API call successful!")
+	fmt.Fprintln(diag, "API call successful!")
 	return nil
 }
+
+// doAPIRequest sends an authenticated request to the demo API endpoint.
+func doAPIRequest(ctx context.Context, accessToken string) (*http.Response, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, serverURL+"/oauth/tokeninfo", nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create request: %w", err)
+	}
+	req.Header.Set("Authorization", "Bearer "+accessToken)
+	return retryClient.DoWithContext(ctx, req)
+}
@@ -3,11 +3,14 @@ package main
 import (
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
 	"net/http"
 	"net/http/httptest"
 	"os"
 	"path/filepath"
+	"slices"
 	"sync"
 	"sync/atomic"
 	"testing"
@@ -30,6 +33,9 @@ func init() {
 	if scope == "" {
 		scope = "read write"
 	}
+	if redirectURI == "" {
+		redirectURI = "http://localhost:8888/callback"
+	}
 	if retryClient == nil {
 		var err error
 		retryClient, err = retry.NewClient()
@@ -43,6 +49,54 @@ func init() {
 // Config helpers
 // -----------------------------------------------------------------------
 
+func TestParseCallbackPorts(t *testing.T) {
+	tests := []struct {
+		in      string
+		want    []int
+		wantErr bool
+	}{
+		{"8888", []int{8888}, false},
+		{"0", []int{0}, false},
+		{"8888, 9000-9002,0", []int{8888, 9000, 9001, 9002, 0}, false},
+		{"", nil, true},
+		{"http", nil, true},
+		{"70000", nil, true},
+		{"9002-9000", nil, true},
+		{"0-10", nil, true},
+	}
+	for _, tt := range tests {
+		got, err := parseCallbackPorts(tt.in)
+		if (err != nil) != tt.wantErr || !slices.Equal(got, tt.want) {
+			t.Errorf("parseCallbackPorts(%q) = %v, %v; want %v", tt.in, got, err, tt.want)
+		}
+	}
+}
+
+func TestParseRedirectURI(t *testing.T) {
+	for _, valid := range []string{
+		"http://localhost/callback",
+		"http://LOCALHOST:9999/oauth/cb",
+		"http://127.0.0.1:8888/callback",
+		"http://[::1]/callback",
+	} {
+		if _, err := parseRedirectURI(valid); err != nil {
+			t.Errorf("parseRedirectURI(%q) error: %v", valid, err)
+		}
+	}
+	for _, invalid := range []string{
+		"https://localhost/callback",
+		"http://example.com/callback",
+		"http://10.0.0.1:8888/callback",
+		"http://localhost:99999/callback",
+		"http://localhost/callback#frag",
+		"com.example.app:/callback",
+	} {
+		if _, err := parseRedirectURI(invalid); err == nil {
+			t.Errorf("parseRedirectURI(%q) succeeded, want an error", invalid)
+		}
+	}
+}
+
 func TestValidateServerURL(t *testing.T) {
 	tests := []struct {
 		name    string
@@ -259,18 +313,15 @@ func TestSaveTokens_ConcurrentWrites(t *testing.T) {
 func TestBuildAuthURL_ContainsRequiredParams(t *testing.T) {
 	origServerURL := serverURL
 	origClientID := clientID
-	origRedirectURI := redirectURI
 	origScope := scope
 	t.Cleanup(func() {
 		serverURL = origServerURL
 		clientID = origClientID
-		redirectURI = origRedirectURI
 		scope = origScope
 	})
 
 	serverURL = "http://localhost:8080"
 	clientID = "my-client-id"
-	redirectURI = "http://localhost:8888/callback"
 	scope = "read write"
 
 	pkce := &PKCEParams{
@@ -280,7 +331,7 @@ func TestBuildAuthURL_ContainsRequiredParams(t *testing.T) {
 	}
 	state := "random-state"
 
-	u := buildAuthURL(state, pkce)
+	u := buildAuthURL("http://localhost:8888/callback", state, pkce, authParams{})
 
 	for _, want := range []string{
 		"client_id=my-client-id",
@@ -311,8 +362,6 @@ func TestRefreshAccessToken_RotationMode(t *testing.T) {
 		tokenFile = origTokenFile
 	})
 
-	tempDir := t.TempDir()
-	tokenFile = filepath.Join(tempDir, "tokens.json")
 	clientID = "test-client-rotation"
 
 	tests := []struct {
@@ -337,6 +386,9 @@ func TestRefreshAccessToken_RotationMode(t *testing.T) {
 
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
+			// Each case starts from a fresh token file and rotation journal.
+			tokenFile = filepath.Join(t.TempDir(), "tokens.json")
+
 			srv := httptest.NewServer(
 				http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 					if err := r.ParseForm(); err != nil {
@@ -361,7 +413,7 @@ func TestRefreshAccessToken_RotationMode(t *testing.T) {
 
 			serverURL = srv.URL
 
-			storage, err := refreshAccessToken(context.Background(), tt.oldRefreshToken)
+			storage, err := refreshAccessToken(context.Background(), io.Discard, tt.oldRefreshToken)
 			if err != nil {
 				t.Fatalf("refreshAccessToken() error: %v", err)
 			}
@@ -376,6 +428,135 @@ func TestRefreshAccessToken_RotationMode(t *testing.T) {
 	}
 }
 
+func TestRefreshStoredTokens_SingleFlight(t *testing.T) {
+	origServerURL, origClientID, origTokenFile := serverURL, clientID, tokenFile
+	origStore := tokenStore
+	t.Cleanup(func() {
+		serverURL, clientID, tokenFile = origServerURL, origClientID, origTokenFile
+		tokenStore = origStore
+	})
+	clientID = "test-client-single-flight"
+	// Like the keyring and exec stores, keep the tokens away from TOKEN_FILE,
+	// whose directory the refresh lock must create.
+	dir := t.TempDir()
+	tokenStore = &fileTokenStore{path: filepath.Join(dir, "store", "tokens.json")}
+	tokenFile = filepath.Join(dir, "not-yet-created", "tokens.json")
+
+	// The server rotates refresh tokens and rejects any token but the newest.
+	var mu sync.Mutex
+	var refreshes int
+	current := "refresh-0"
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_ = r.ParseForm()
+		time.Sleep(50 * time.Millisecond)
+		mu.Lock()
+		defer mu.Unlock()
+		w.Header().Set("Content-Type", "application/json")
+		if r.PostForm.Get("refresh_token") != current {
+			w.WriteHeader(http.StatusBadRequest)
+			_ = json.NewEncoder(w).Encode(map[string]string{"error": "invalid_grant"})
+			return
+		}
+		refreshes++
+		current = fmt.Sprintf("refresh-%d", refreshes)
+		_ = json.NewEncoder(w).Encode(map[string]interface{}{
+			"access_token":  fmt.Sprintf("access-token-%d", refreshes),
+			"refresh_token": current,
+			"token_type":    "Bearer",
+			"expires_in":    3600,
+		})
+	}))
+	defer srv.Close()
+	serverURL = srv.URL
+
+	stale := &TokenStorage{
+		AccessToken:  "access-0",
+		RefreshToken: "refresh-0",
+		TokenType:    "Bearer",
+		ExpiresAt:    time.Now().Add(-time.Minute),
+	}
+	if err := saveTokens(stale); err != nil {
+		t.Fatal(err)
+	}
+
+	const callers = 5
+	var wg sync.WaitGroup
+	results := make([]*TokenStorage, callers)
+	for i := range callers {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			copied := *stale
+			storage, err := refreshStoredTokens(context.Background(), io.Discard, &copied)
+			if err != nil {
+				t.Errorf("caller %d: refreshStoredTokens() error: %v", i, err)
+				return
+			}
+			results[i] = storage
+		}()
+	}
+	wg.Wait()
+
+	if refreshes != 1 {
+		t.Errorf("token endpoint refreshed %d times, want 1", refreshes)
+	}
+	for i, storage := range results {
+		if storage != nil && storage.AccessToken != "access-token-1" {
+			t.Errorf("caller %d got access token %q, want access-token-1", i, storage.AccessToken)
+		}
+	}
+}
+
+func TestReuseStoredTokens_RefreshFailure(t *testing.T) {
+	origServerURL, origClientID, origTokenFile := serverURL, clientID, tokenFile
+	t.Cleanup(func() {
+		serverURL, clientID, tokenFile = origServerURL, origClientID, origTokenFile
+	})
+	clientID = "test-client-reuse"
+	tokenFile = filepath.Join(t.TempDir(), "tokens.json")
+
+	var errCode atomic.Value
+	errCode.Store("temporarily_unavailable")
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusBadRequest)
+		_ = json.NewEncoder(w).Encode(map[string]string{"error": errCode.Load().(string)})
+	}))
+	defer srv.Close()
+	serverURL = srv.URL
+
+	// Inside the refresh leeway, but not expired yet.
+	existing := &TokenStorage{
+		AccessToken:  "still-valid",
+		RefreshToken: "refresh",
+		TokenType:    "Bearer",
+		ExpiresAt:    time.Now().Add(refreshLeeway / 2),
+	}
+	if err := saveTokens(existing); err != nil {
+		t.Fatal(err)
+	}
+
+	storage, err := reuseStoredTokens(context.Background(), io.Discard, existing)
+	if err != nil || storage != existing {
+		t.Errorf("transient failure: reuseStoredTokens() = %v, %v; want the existing token",
+			storage, err)
+	}
+
+	errCode.Store("invalid_grant")
+	if _, err := reuseStoredTokens(context.Background(), io.Discard, existing); !errors.Is(
+		err,
+		ErrRefreshTokenExpired,
+	) {
+		t.Errorf("rejected refresh token: error = %v, want ErrRefreshTokenExpired", err)
+	}
+
+	existing.ExpiresAt = time.Now().Add(-time.Minute)
+	errCode.Store("temporarily_unavailable")
+	if _, err := reuseStoredTokens(context.Background(), io.Discard, existing); err == nil {
+		t.Error("expired token: reuseStoredTokens() succeeded, want an error")
+	}
+}
+
 // -----------------------------------------------------------------------
 // Device code request with retry
 // -----------------------------------------------------------------------
@@ -415,7 +596,7 @@ func TestRequestDeviceCode_WithRetry(t *testing.T) {
 
 	serverURL = testServer.URL
 
-	resp, err := requestDeviceCode(context.Background())
+	resp, err := requestDeviceCode(context.Background(), authParams{})
 	if err != nil {
 		t.Fatalf("requestDeviceCode() error: %v", err)
 	}
@@ -0,0 +1,186 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"time"
+	"unicode"
+)
+
+// defaultNetrcFile returns $NETRC, or .netrc (_netrc on Windows) in the home
+// directory.
+func defaultNetrcFile() string {
+	if path := os.Getenv("NETRC"); path != "" {
+		return path
+	}
+	name := ".netrc"
+	if runtime.GOOS == "windows" {
+		name = "_netrc"
+	}
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return name
+	}
+	return filepath.Join(home, name)
+}
+
+// netrcToken is a token of a netrc file and its offset in the file.
+type netrcToken struct {
+	text  string
+	start int
+}
+
+// netrcTokens splits a netrc file into tokens, skipping comments and the
+// bodies of macdef macros (which run to the next blank line).
+func netrcTokens(data string) []netrcToken {
+	var tokens []netrcToken
+	for i := 0; i < len(data); {
+		if unicode.IsSpace(rune(data[i])) {
+			i++
+			continue
+		}
+		if data[i] == '#' {
+			if end := strings.IndexByte(data[i:], '\n'); end >= 0 {
+				i += end
+			} else {
+				i = len(data)
+			}
+			continue
+		}
+		start := i
+		for i < len(data) && !unicode.IsSpace(rune(data[i])) {
+			i++
+		}
+		tokens = append(tokens, netrcToken{data[start:i], start})
+
+		// "macdef NAME" is followed by the macro body up to a blank line.
+		if n := len(tokens); n >= 2 && tokens[n-2].text == "macdef" {
+			if end := strings.Index(data[i:], "\n\n"); end >= 0 {
+				i += end
+			} else {
+				i = len(data)
+			}
+		}
+	}
+	return tokens
+}
+
+// netrcEntrySpan returns the byte range of the "machine host" entry in data,
+// up to the next machine, default or macdef, or -1, -1 if there is none.
+func netrcEntrySpan(data, host string) (int, int) {
+	tokens := netrcTokens(data)
+	for i := 0; i+1 < len(tokens); i++ {
+		if tokens[i].text != "machine" || tokens[i+1].text != host {
+			continue
+		}
+		for _, t := range tokens[i+2:] {
+			switch t.text {
+			case "machine", "default", "macdef":
+				return tokens[i].start, t.start
+			}
+		}
+		return tokens[i].start, len(data)
+	}
+	return -1, -1
+}
+
+// netrcDefaultStart returns the offset of the default entry in data, or -1
+// if there is none.
+func netrcDefaultStart(data string) int {
+	tokens := netrcTokens(data)
+	for i := 0; i < len(tokens); i++ {
+		switch tokens[i].text {
+		case "default":
+			return tokens[i].start
+		case "machine", "login", "password", "account", "macdef":
+			i++ // skip the value, which may itself read "default"
+		}
+	}
+	return -1
+}
+
+// updateNetrc returns data with the entry for host replaced by, or extended
+// with, one for login and password. Other entries are kept as they are. A new
+// entry goes before the default entry, since netrc readers stop looking for
+// machines there.
+func updateNetrc(data, host, login, password string) string {
+	entry := fmt.Sprintf("machine %s login %s password %s\n", host, login, password)
+	if start, end := netrcEntrySpan(data, host); start >= 0 {
+		return data[:start] + entry + data[end:]
+	}
+	if start := netrcDefaultStart(data); start >= 0 {
+		return data[:start] + entry + data[start:]
+	}
+	if data != "" && !strings.HasSuffix(data, "\n") {
+		data += "\n"
+	}
+	return data + entry
+}
+
+// writeNetrcEntry writes the entry for host to the netrc file at path,
+// atomically and with 0600 permissions. When path is a symlink (e.g. into a
+// dotfiles repository), the file it points to is replaced and the link kept.
+func writeNetrcEntry(path, host, login, password string) error {
+	if resolved, err := filepath.EvalSymlinks(path); err == nil {
+		path = resolved
+	} else if !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+
+	lock, err := acquireFileLock(context.Background(), path)
+	if err != nil {
+		return err
+	}
+	defer func() { _ = lock.release() }()
+
+	data, err := os.ReadFile(path)
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	updated := updateNetrc(string(data), host, login, password)
+	return writeFileAtomic(path, []byte(updated), 0o600)
+}
+
+// runNetrc writes the current access token to a netrc entry for tools that
+// read credentials from ~/.netrc. The entry is not refreshed: run the command
+// again once the token expires.
+func runNetrc(ctx context.Context, args []string) int {
+	fs := flag.NewFlagSet("netrc", flag.ContinueOnError)
+	host := fs.String("host", "", "Machine name of the entry (required)")
+	login := fs.String("login", defaultCredentialUsername, "Login of the entry")
+	file := fs.String("file", defaultNetrcFile(), "netrc file to update")
+	if code, ok := parseCommandFlags(fs, args); !ok {
+		return code
+	}
+	if *host == "" {
+		fmt.Fprintln(os.Stderr, "Usage: netrc --host HOST [--login NAME] [--file PATH]")
+		return 2
+	}
+	if strings.ContainsFunc(*host+*login, unicode.IsSpace) {
+		fmt.Fprintln(os.Stderr, "Error: --host and --login must not contain whitespace")
+		return 2
+	}
+
+	storage, err := obtainToken(ctx, os.Stdout, "", true)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to obtain token: %v\n", err)
+		return 1
+	}
+	if err := writeNetrcEntry(*file, *host, *login, storage.AccessToken); err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to update %s: %v\n", *file, err)
+		return 1
+	}
+	fmt.Printf(
+		"Wrote the access token for %s to %s (expires in %s)\n",
+		*host,
+		*file,
+		tokenRemaining(storage).Round(time.Second),
+	)
+	return 0
+}
@@ -0,0 +1,137 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestUpdateNetrc(t *testing.T) {
+	tests := []struct {
+		name, data, want string
+	}{
+		{
+			"empty file",
+			"",
+			"machine api.example.com login oauth2 password new\n",
+		},
+		{
+			"append",
+			"machine other.com login me password pw",
+			"machine other.com login me password pw\n" +
+				"machine api.example.com login oauth2 password new\n",
+		},
+		{
+			"replace multi-line entry",
+			"# work\nmachine api.example.com\n  login old\n  password old\n" +
+				"machine other.com login me password pw\n",
+			"# work\nmachine api.example.com login oauth2 password new\n" +
+				"machine other.com login me password pw\n",
+		},
+		{
+			"replace before macdef",
+			"machine api.example.com login old password old\n" +
+				"macdef init\nmachine api.example.com\n\ndefault login anonymous\n",
+			"machine api.example.com login oauth2 password new\n" +
+				"macdef init\nmachine api.example.com\n\ndefault login anonymous\n",
+		},
+		{
+			"insert before default",
+			"machine other.com login me password pw\ndefault login anonymous password x\n",
+			"machine other.com login me password pw\n" +
+				"machine api.example.com login oauth2 password new\n" +
+				"default login anonymous password x\n",
+		},
+		{
+			"default as a value",
+			"machine other.com login default password pw\n",
+			"machine other.com login default password pw\n" +
+				"machine api.example.com login oauth2 password new\n",
+		},
+		{
+			"host only in a comment",
+			"# machine api.example.com\n",
+			"# machine api.example.com\n" +
+				"machine api.example.com login oauth2 password new\n",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := updateNetrc(tt.data, "api.example.com", "oauth2", "new")
+			if got != tt.want {
+				t.Errorf("updateNetrc() =\n%q\nwant\n%q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestWriteNetrcEntry_KeepsSymlink(t *testing.T) {
+	dir := t.TempDir()
+	target := filepath.Join(dir, "dotfiles", "netrc")
+	if err := os.MkdirAll(filepath.Dir(target), 0o700); err != nil {
+		t.Fatal(err)
+	}
+	existing := []byte("machine other.com login me password pw\n")
+	if err := os.WriteFile(target, existing, 0o600); err != nil {
+		t.Fatal(err)
+	}
+	link := filepath.Join(dir, ".netrc")
+	if err := os.Symlink(target, link); err != nil {
+		t.Skipf("symlinks unavailable: %v", err)
+	}
+
+	if err := writeNetrcEntry(link, "api.example.com", "oauth2", "token-1"); err != nil {
+		t.Fatal(err)
+	}
+
+	info, err := os.Lstat(link)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Mode()&os.ModeSymlink == 0 {
+		t.Error("writeNetrcEntry() replaced the symlink with a regular file")
+	}
+	data, err := os.ReadFile(target)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := "machine other.com login me password pw\n" +
+		"machine api.example.com login oauth2 password token-1\n"
+	if string(data) != want {
+		t.Errorf("link target =\n%s\nwant\n%s", data, want)
+	}
+}
+
+func TestWriteNetrcEntry(t *testing.T) {
+	path := filepath.Join(t.TempDir(), ".netrc")
+	existing := []byte("machine other.com login me password pw\n")
+	if err := os.WriteFile(path, existing, 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if err := writeNetrcEntry(path, "api.example.com", "oauth2", "token-1"); err != nil {
+		t.Fatal(err)
+	}
+	if err := writeNetrcEntry(path, "api.example.com", "oauth2", "token-2"); err != nil {
+		t.Fatal(err)
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := "machine other.com login me password pw\n" +
+		"machine api.example.com login oauth2 password token-2\n"
+	if string(data) != want {
+		t.Errorf("netrc =\n%s\nwant\n%s", data, want)
+	}
+	info, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Mode().Perm() != 0o600 {
+		t.Errorf("netrc mode = %v, want 0600", info.Mode().Perm())
+	}
+	if _, err := os.Stat(path + ".lock"); !os.IsNotExist(err) {
+		t.Errorf("lock file left behind: %v", err)
+	}
+}
@@ -4,6 +4,7 @@ import (
 	"context"
 	"encoding/json"
 	"errors"
+	"io"
 	"net/http"
 	"net/http/httptest"
 	"sync/atomic"
@@ -56,7 +57,7 @@ func TestPollForToken_AuthorizationPending(t *testing.T) {
 	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
 	defer cancel()
 
-	token, err := pollForTokenWithProgress(ctx, config, deviceAuth)
+	token, err := pollForTokenWithProgress(ctx, io.Discard, config, deviceAuth)
 	if err != nil {
 		t.Fatalf("expected success, got error: %v", err)
 	}
@@ -124,7 +125,7 @@ func TestPollForToken_SlowDown(t *testing.T) {
 	ctx, cancel := context.WithTimeout(context.Background(), 15*time.Second)
 	defer cancel()
 
-	token, err := pollForTokenWithProgress(ctx, config, deviceAuth)
+	token, err := pollForTokenWithProgress(ctx, io.Discard, config, deviceAuth)
 	if err != nil {
 		t.Fatalf("expected success, got error: %v", err)
 	}
@@ -164,7 +165,7 @@ func pollForTokenErrorTest(t *testing.T, errCode, errDesc, expectedMsg string) {
 	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
 	defer cancel()
 
-	_, err := pollForTokenWithProgress(ctx, config, deviceAuth)
+	_, err := pollForTokenWithProgress(ctx, io.Discard, config, deviceAuth)
 	if err == nil {
 		t.Fatal("expected error, got nil")
 	}
@@ -214,7 +215,7 @@ func TestPollForToken_ContextTimeout(t *testing.T) {
 	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
 	defer cancel()
 
-	_, err := pollForTokenWithProgress(ctx, config, deviceAuth)
+	_, err := pollForTokenWithProgress(ctx, io.Discard, config, deviceAuth)
 	if err == nil {
 		t.Fatal("expected context timeout error, got nil")
 	}
@@ -0,0 +1,127 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// defaultCredentialUsername is the username sent with the access token to git
+// servers and registries. Servers accepting bearer tokens as passwords
+// usually ignore it.
+const defaultCredentialUsername = "oauth2"
+
+// profile selects the server, client and account used for credentials
+// handed to other tools (git, docker, ...). Empty fields keep the global
+// configuration.
+type profile struct {
+	ServerURL string   `json:"server_url,omitempty"`
+	ClientID  string   `json:"client_id,omitempty"`
+	Account   string   `json:"account,omitempty"`
+	Scope     string   `json:"scope,omitempty"`
+	Username  string   `json:"username,omitempty"` // default defaultCredentialUsername
+	Hosts     []string `json:"hosts,omitempty"`    // git hosts and registries served
+	// IdentityToken makes the docker credential helper hand out the refresh
+	// token as an identity token, for registries that redeem it themselves.
+	IdentityToken bool `json:"identity_token,omitempty"`
+}
+
+// profileFile is the format of PROFILES_FILE.
+type profileFile struct {
+	Profiles map[string]*profile `json:"profiles"`
+}
+
+// defaultProfilesFile returns profiles.json in the per-user config directory.
+func defaultProfilesFile() string {
+	if dir, err := os.UserConfigDir(); err == nil {
+		return filepath.Join(dir, "authgate", "profiles.json")
+	}
+	return "authgate-profiles.json"
+}
+
+// loadProfiles reads PROFILES_FILE. A missing file means no profiles.
+func loadProfiles() (map[string]*profile, error) {
+	data, err := os.ReadFile(profilesFile)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var pf profileFile
+	if err := json.Unmarshal(data, &pf); err != nil {
+		return nil, fmt.Errorf("failed to parse %s: %w", profilesFile, err)
+	}
+	for name, p := range pf.Profiles {
+		if p == nil {
+			return nil, fmt.Errorf("%s: profile %q is empty", profilesFile, name)
+		}
+		if p.ServerURL != "" {
+			if err := validateServerURL(p.ServerURL); err != nil {
+				return nil, fmt.Errorf("%s: profile %q: %w", profilesFile, name, err)
+			}
+		}
+		if p.Account != "" {
+			if err := validateAccountName(p.Account); err != nil {
+				return nil, fmt.Errorf("%s: profile %q: %w", profilesFile, name, err)
+			}
+		}
+	}
+	return pf.Profiles, nil
+}
+
+// profileForHost returns the profile serving host (case-insensitive, with the
+// port if the caller has one), or nil when no profile lists it. The profiles
+// are searched in name order, so the result does not depend on map order.
+func profileForHost(host string) (string, *profile, error) {
+	profiles, err := loadProfiles()
+	if err != nil {
+		return "", nil, err
+	}
+	for _, name := range sortedKeys(profiles) {
+		for _, h := range profiles[name].Hosts {
+			if strings.EqualFold(h, host) {
+				return name, profiles[name], nil
+			}
+		}
+	}
+	return "", nil, nil
+}
+
+// profileByName returns the profile called name.
+func profileByName(name string) (*profile, error) {
+	profiles, err := loadProfiles()
+	if err != nil {
+		return nil, err
+	}
+	p, ok := profiles[name]
+	if !ok {
+		return nil, fmt.Errorf("no profile %q in %s", name, profilesFile)
+	}
+	return p, nil
+}
+
+// apply makes p's settings the current configuration. The client secret
+// belongs to the global client on the global server, so a profile naming
+// another server or client runs as a public client.
+func (p *profile) apply() {
+	if (p.ServerURL != "" && normalizeServerURL(p.ServerURL) != normalizeServerURL(serverURL)) ||
+		(p.ClientID != "" && p.ClientID != clientID) {
+		clientSecret = ""
+	}
+	if p.ServerURL != "" {
+		serverURL = p.ServerURL
+	}
+	if p.ClientID != "" {
+		clientID = p.ClientID
+	}
+	if p.Account != "" {
+		accountOverride = p.Account
+	}
+	if p.Scope != "" {
+		scope = p.Scope
+	}
+}
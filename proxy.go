@@ -0,0 +1,305 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+
+	"golang.org/x/oauth2"
+)
+
+// proxyRetryBodyLimit is the largest request body the proxy keeps in memory
+// so that it can resend the request after refreshing a rejected token.
+// Requests with larger bodies are streamed, and a 401 reaches the client.
+const proxyRetryBodyLimit = 1 << 20
+
+// proxyRedactedParams are substrings of query parameter names whose values
+// are not logged.
+var proxyRedactedParams = []string{"token", "secret", "password", "code", "key", "assertion"}
+
+// proxyTransport sets the Authorization header of every upstream request from
+// source. When the upstream rejects the token with a plain 401 (not a step-up
+// challenge, which a refresh cannot satisfy), it refreshes the tokens and
+// resends the request once.
+type proxyTransport struct {
+	source *storedTokenSource
+	base   http.RoundTripper
+}
+
+func (t *proxyTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	ctx := req.Context()
+	storage, err := t.source.tokens(ctx, 0)
+	if storage == nil {
+		if req.Body != nil {
+			req.Body.Close()
+		}
+		return nil, err
+	}
+	replayable, err := bufferRequestBody(req)
+	if err != nil {
+		return nil, err
+	}
+
+	resp, err := t.send(req, req.Body, storage)
+	if err != nil || resp.StatusCode != http.StatusUnauthorized ||
+		stepUpChallenge(resp) != nil || !replayable {
+		return resp, err
+	}
+
+	refreshed, err := t.source.refreshRejected(ctx, storage)
+	if err != nil {
+		fmt.Printf("Warning: Upstream rejected the access token and refresh failed: %v\n", err)
+		return resp, nil
+	}
+	_, _ = io.Copy(io.Discard, resp.Body)
+	resp.Body.Close()
+
+	var body io.ReadCloser
+	if req.GetBody != nil {
+		if body, err = req.GetBody(); err != nil {
+			return nil, err
+		}
+	}
+	fmt.Printf(
+		"Upstream rejected the access token, retrying %s with a refreshed one\n",
+		redactURL(req.URL),
+	)
+	return t.send(req, body, refreshed)
+}
+
+// send sends a copy of req with body, authorized by storage's access token.
+func (t *proxyTransport) send(
+	req *http.Request,
+	body io.ReadCloser,
+	storage *TokenStorage,
+) (*http.Response, error) {
+	out := req.Clone(req.Context())
+	out.Body = body
+	token := &oauth2.Token{AccessToken: storage.AccessToken, TokenType: storage.TokenType}
+	token.SetAuthHeader(out)
+	return t.base.RoundTrip(out)
+}
+
+// bufferRequestBody reads a body of up to proxyRetryBodyLimit into memory and
+// sets req.GetBody to replay it. It reports whether the request can be resent.
+func bufferRequestBody(req *http.Request) (bool, error) {
+	if req.Body == nil || req.Body == http.NoBody {
+		return true, nil
+	}
+	if req.ContentLength > proxyRetryBodyLimit {
+		return false, nil
+	}
+	buf, err := io.ReadAll(io.LimitReader(req.Body, proxyRetryBodyLimit+1))
+	if err != nil {
+		req.Body.Close()
+		return false, fmt.Errorf("failed to read request body: %w", err)
+	}
+	if len(buf) > proxyRetryBodyLimit {
+		req.Body = struct {
+			io.Reader
+			io.Closer
+		}{io.MultiReader(bytes.NewReader(buf), req.Body), req.Body}
+		return false, nil
+	}
+	req.Body.Close()
+	req.GetBody = func() (io.ReadCloser, error) {
+		return io.NopCloser(bytes.NewReader(buf)), nil
+	}
+	req.Body, _ = req.GetBody()
+	return true, nil
+}
+
+// redactURL returns u's path and query for logging, with the values of
+// parameters that may carry credentials replaced.
+func redactURL(u *url.URL) string {
+	q := u.Query()
+	for name := range q {
+		lower := strings.ToLower(name)
+		for _, s := range proxyRedactedParams {
+			if strings.Contains(lower, s) {
+				q[name] = []string{"REDACTED"}
+				break
+			}
+		}
+	}
+	out := u.EscapedPath()
+	if len(q) > 0 {
+		out += "?" + q.Encode()
+	}
+	return out
+}
+
+// proxyHostAllowed reports whether r's Host header names the proxy: localhost
+// or a loopback address, with the port the request came in on. Other names
+// are refused so that a web page cannot reach the proxy by rebinding its own
+// domain name to 127.0.0.1 (DNS rebinding) and read responses sent with the
+// user's token.
+func proxyHostAllowed(r *http.Request) bool {
+	host, port, err := net.SplitHostPort(r.Host)
+	if err != nil {
+		return false
+	}
+	local, ok := r.Context().Value(http.LocalAddrContextKey).(net.Addr)
+	if !ok {
+		return false
+	}
+	_, localPort, err := net.SplitHostPort(local.String())
+	if err != nil || port != localPort {
+		return false
+	}
+	if strings.EqualFold(host, "localhost") {
+		return true
+	}
+	ip := net.ParseIP(host)
+	return ip != nil && ip.IsLoopback()
+}
+
+// newAuthProxy returns a handler that forwards requests to upstream with the
+// access token from source, replacing any credentials the client sent, and
+// logs each request. Requests whose Host header does not name the proxy are
+// refused (see proxyHostAllowed).
+func newAuthProxy(upstream *url.URL, source *storedTokenSource) http.Handler {
+	base := http.DefaultTransport.(*http.Transport).Clone()
+	base.TLSClientConfig = &tls.Config{MinVersion: tls.VersionTLS12}
+
+	rp := &httputil.ReverseProxy{
+		Rewrite: func(r *httputil.ProxyRequest) {
+			r.SetURL(upstream)
+			r.Out.Header.Del("Authorization")
+			r.Out.Header.Del("Proxy-Authorization")
+		},
+		Transport: &proxyTransport{source: source, base: base},
+		ErrorHandler: func(w http.ResponseWriter, r *http.Request, err error) {
+			status := http.StatusBadGateway
+			if errors.Is(err, ErrTokenNotFound) || errors.Is(err, ErrRefreshTokenExpired) {
+				status = http.StatusServiceUnavailable
+				err = fmt.Errorf("%w; run \"login\"", err)
+			}
+			fmt.Printf("Warning: %s %s: %v\n", r.Method, redactURL(r.URL), err)
+			http.Error(w, "authgate proxy: "+err.Error(), status)
+		},
+	}
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !proxyHostAllowed(r) {
+			fmt.Printf("Warning: refused %s %s for host %q\n", r.Method, redactURL(r.URL), r.Host)
+			http.Error(w, "authgate proxy: unexpected Host header", http.StatusForbidden)
+			return
+		}
+		start := time.Now()
+		rec := &statusRecorder{ResponseWriter: w, status: http.StatusOK}
+		rp.ServeHTTP(rec, r)
+		fmt.Printf(
+			"%s %s %s -> %d (%s)\n",
+			start.Format("15:04:05"),
+			r.Method,
+			redactURL(r.URL),
+			rec.status,
+			time.Since(start).Round(time.Millisecond),
+		)
+	})
+}
+
+// statusRecorder remembers the status code written through it.
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+}
+
+func (r *statusRecorder) WriteHeader(status int) {
+	r.status = status
+	r.ResponseWriter.WriteHeader(status)
+}
+
+func (r *statusRecorder) Unwrap() http.ResponseWriter { return r.ResponseWriter }
+
+// parseUpstream validates the --upstream URL.
+func parseUpstream(raw string) (*url.URL, error) {
+	u, err := url.Parse(raw)
+	if err != nil {
+		return nil, err
+	}
+	if (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return nil, fmt.Errorf("want an http or https URL, got %q", raw)
+	}
+	return u, nil
+}
+
+// checkLoopbackListen rejects listen addresses reachable from other hosts:
+// anyone who can connect to the proxy acts with the user's token.
+func checkLoopbackListen(addr string) error {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return err
+	}
+	if host == "localhost" {
+		return nil
+	}
+	if ip := net.ParseIP(host); ip == nil || !ip.IsLoopback() {
+		return fmt.Errorf("%s is not a loopback address", addr)
+	}
+	return nil
+}
+
+// runProxy runs a local reverse proxy that forwards requests to an upstream
+// API with the current account's access token.
+func runProxy(ctx context.Context, args []string) int {
+	fs := flag.NewFlagSet("proxy", flag.ContinueOnError)
+	listen := fs.String("listen", "127.0.0.1:9000", "Loopback address to listen on")
+	upstreamURL := fs.String("upstream", "", "Base URL of the API to forward to (required)")
+	if code, ok := parseCommandFlags(fs, args); !ok {
+		return code
+	}
+	if *upstreamURL == "" {
+		fmt.Fprintln(os.Stderr, "Usage: proxy --upstream URL [--listen ADDR]")
+		return 2
+	}
+	upstream, err := parseUpstream(*upstreamURL)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: invalid --upstream: %v\n", err)
+		return 2
+	}
+	if err := checkLoopbackListen(*listen); err != nil {
+		fmt.Fprintf(os.Stderr, "Error: invalid --listen: %v\n", err)
+		return 2
+	}
+
+	// Serve the account active now, even if "accounts use" switches later.
+	accountOverride = currentAccount()
+
+	source := newStoredTokenSource(os.Stdout)
+	if _, err := source.tokens(ctx, 0); err != nil {
+		fmt.Printf("Warning: %v; requests fail until you log in\n", err)
+	}
+	go source.refreshLoop(ctx)
+
+	ln, err := net.Listen("tcp", *listen)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to start proxy: %v\n", err)
+		return 1
+	}
+	fmt.Printf(
+		"Proxying http://%s to %s (account %s of %s)\n",
+		ln.Addr(),
+		upstream,
+		accountOverride,
+		clientID,
+	)
+
+	if err := serveHTTP(ctx, ln, newAuthProxy(upstream, source)); err != nil {
+		fmt.Fprintf(os.Stderr, "Proxy failed: %v\n", err)
+		return 1
+	}
+	return 0
+}
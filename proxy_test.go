@@ -0,0 +1,187 @@
+package main
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// startTestProxy serves the proxy for upstream with a memory store holding
+// storage, refreshing against authServer.
+func startTestProxy(t *testing.T, authServer, upstream string, storage *TokenStorage) string {
+	t.Helper()
+	origStore, origFile := tokenStore, tokenFile
+	origServer, origClient := serverURL, clientID
+	t.Cleanup(func() {
+		tokenStore, tokenFile = origStore, origFile
+		serverURL, clientID = origServer, origClient
+	})
+	tokenStore = newMemoryTokenStore()
+	tokenFile = filepath.Join(t.TempDir(), "tokens.json")
+	serverURL = authServer
+	clientID = "proxy-client"
+	if err := saveTokens(storage); err != nil {
+		t.Fatal(err)
+	}
+
+	u, err := parseUpstream(upstream)
+	if err != nil {
+		t.Fatal(err)
+	}
+	source := newStoredTokenSource(io.Discard)
+	srv := httptest.NewServer(newAuthProxy(u, source))
+	t.Cleanup(srv.Close)
+	return srv.URL
+}
+
+func TestProxy_InjectsTokenAndRetriesOn401(t *testing.T) {
+	var refreshes atomic.Int32
+	authServer := refreshServer(t, &refreshes)
+
+	var calls atomic.Int32
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls.Add(1)
+		body, _ := io.ReadAll(r.Body)
+		if r.URL.Path != "/base/items" || r.URL.Query().Get("q") != "1" {
+			t.Errorf("upstream got %s", r.URL)
+		}
+		if string(body) != "payload" {
+			t.Errorf("upstream got body %q", body)
+		}
+		if r.Header.Get("Authorization") != "Bearer refreshed-access-token-1" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		_, _ = io.WriteString(w, "ok")
+	}))
+	defer upstream.Close()
+
+	proxy := startTestProxy(t, authServer.URL, upstream.URL+"/base", &TokenStorage{
+		AccessToken:  "revoked-access-token",
+		RefreshToken: "refresh-token",
+		TokenType:    "Bearer",
+		ExpiresAt:    time.Now().Add(time.Hour),
+	})
+
+	req, _ := http.NewRequest(http.MethodPost, proxy+"/items?q=1", strings.NewReader("payload"))
+	req.Header.Set("Authorization", "Bearer client-supplied")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK || string(body) != "ok" {
+		t.Errorf("proxy answered %d %q, want 200 ok", resp.StatusCode, body)
+	}
+	if n := calls.Load(); n != 2 {
+		t.Errorf("upstream called %d times, want 2", n)
+	}
+	if n := refreshes.Load(); n != 1 {
+		t.Errorf("refreshed %d times, want 1", n)
+	}
+}
+
+func TestProxy_StepUpChallengePassedThrough(t *testing.T) {
+	var refreshes atomic.Int32
+	authServer := refreshServer(t, &refreshes)
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("WWW-Authenticate", `Bearer error="insufficient_scope", scope="admin"`)
+		w.WriteHeader(http.StatusUnauthorized)
+	}))
+	defer upstream.Close()
+
+	proxy := startTestProxy(t, authServer.URL, upstream.URL, &TokenStorage{
+		AccessToken:  "scoped-access-token",
+		RefreshToken: "refresh-token",
+		TokenType:    "Bearer",
+		ExpiresAt:    time.Now().Add(time.Hour),
+	})
+
+	resp, err := http.Get(proxy + "/admin")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusUnauthorized || resp.Header.Get("WWW-Authenticate") == "" {
+		t.Errorf("proxy answered %d, want the upstream's challenge", resp.StatusCode)
+	}
+	if n := refreshes.Load(); n != 0 {
+		t.Errorf("refreshed %d times for a step-up challenge", n)
+	}
+}
+
+func TestProxy_RejectsForeignHost(t *testing.T) {
+	var refreshes atomic.Int32
+	authServer := refreshServer(t, &refreshes)
+	var calls atomic.Int32
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls.Add(1)
+	}))
+	defer upstream.Close()
+
+	proxy := startTestProxy(t, authServer.URL, upstream.URL, &TokenStorage{
+		AccessToken:  "access-token",
+		RefreshToken: "refresh-token",
+		TokenType:    "Bearer",
+		ExpiresAt:    time.Now().Add(time.Hour),
+	})
+	u, _ := url.Parse(proxy)
+
+	for host, want := range map[string]int{
+		"localhost:" + u.Port():        http.StatusOK,
+		u.Host:                         http.StatusOK,
+		"attacker.example:" + u.Port(): http.StatusForbidden,
+		"127.0.0.1:1":                  http.StatusForbidden,
+		"localhost":                    http.StatusForbidden,
+	} {
+		req, _ := http.NewRequest(http.MethodGet, proxy+"/items", nil)
+		req.Host = host
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != want {
+			t.Errorf("Host %q: proxy answered %d, want %d", host, resp.StatusCode, want)
+		}
+	}
+	if n := calls.Load(); n != 2 {
+		t.Errorf("upstream got %d requests, want 2", n)
+	}
+}
+
+func TestRedactURL(t *testing.T) {
+	u, _ := url.Parse("/cb?access_token=secret1&code=abc&page=2&client_secret=x")
+	got := redactURL(u)
+	for _, leaked := range []string{"secret1", "abc", "=x"} {
+		if strings.Contains(got, leaked) {
+			t.Errorf("redactURL() = %q leaks %q", got, leaked)
+		}
+	}
+	if !strings.Contains(got, "page=2") {
+		t.Errorf("redactURL() = %q lost page=2", got)
+	}
+}
+
+func TestCheckLoopbackListen(t *testing.T) {
+	for addr, ok := range map[string]bool{
+		"127.0.0.1:9000": true,
+		"[::1]:9000":     true,
+		"localhost:9000": true,
+		"0.0.0.0:9000":   false,
+		":9000":          false,
+		"10.0.0.1:9000":  false,
+	} {
+		if err := checkLoopbackListen(addr); (err == nil) != ok {
+			t.Errorf("checkLoopbackListen(%q) = %v", addr, err)
+		}
+	}
+}
@@ -0,0 +1,178 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"slices"
+	"time"
+)
+
+// maxJournalEntries bounds the number of rotations kept in the journal.
+const maxJournalEntries = 20
+
+// journalEntry records one refresh token rotation.
+type journalEntry struct {
+	RotatedAt            time.Time `json:"rotated_at"`
+	ClientID             string    `json:"client_id"`
+	ServerURL            string    `json:"server_url,omitempty"`
+	PreviousRefreshToken string    `json:"previous_refresh_token"`
+	RefreshToken         string    `json:"refresh_token"`
+}
+
+// forCurrentClient reports whether the entry belongs to the configured server
+// and client. Entries written before server namespacing match any server.
+func (e journalEntry) forCurrentClient() bool {
+	return e.ClientID == clientID &&
+		(e.ServerURL == "" || e.ServerURL == normalizeServerURL(serverURL))
+}
+
+// refreshJournalPath returns the path of the rotation journal, which lives
+// next to the token file and shares its 0600 permissions and encryption. It
+// returns "" when tokens are not kept in a file: the memory and exec backends
+// exist precisely so that refresh tokens are not written to local disk.
+func refreshJournalPath() string {
+	fs, ok := activeTokenStore().(*fileTokenStore)
+	if !ok {
+		return ""
+	}
+	return fs.path + ".journal"
+}
+
+// loadRefreshJournal reads the rotation journal. A missing or disabled
+// journal is empty.
+func loadRefreshJournal() ([]journalEntry, error) {
+	path := refreshJournalPath()
+	if path == "" {
+		return nil, nil
+	}
+	return readRefreshJournal(path)
+}
+
+// readRefreshJournal reads the rotation journal at path. A missing journal is
+// empty.
+func readRefreshJournal(path string) ([]journalEntry, error) {
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	plain, _, err := tokenCipher.decode(data)
+	if err != nil {
+		return nil, err
+	}
+	var entries []journalEntry
+	if err := json.Unmarshal(plain, &entries); err != nil {
+		return nil, fmt.Errorf("failed to parse refresh journal: %w", err)
+	}
+	return entries, nil
+}
+
+// appendRefreshJournal records a rotation, keeping the most recent
+// maxJournalEntries entries. It is a no-op when the journal is disabled.
+func appendRefreshJournal(entry journalEntry) error {
+	path := refreshJournalPath()
+	if path == "" {
+		return nil
+	}
+	lock, err := acquireFileLock(context.Background(), path)
+	if err != nil {
+		return fmt.Errorf("failed to acquire lock: %w", err)
+	}
+	defer func() { _ = lock.release() }()
+
+	entries, err := loadRefreshJournal()
+	if err != nil {
+		// A damaged journal must not block recording the newest rotation.
+		entries = nil
+	}
+	return writeRefreshJournal(path, append(entries, entry))
+}
+
+// writeRefreshJournal writes the most recent maxJournalEntries of entries to
+// the journal at path. The caller holds the journal's lock.
+func writeRefreshJournal(path string, entries []journalEntry) error {
+	if len(entries) > maxJournalEntries {
+		entries = entries[len(entries)-maxJournalEntries:]
+	}
+
+	data, err := json.MarshalIndent(entries, "", "  ")
+	if err != nil {
+		return err
+	}
+	if data, err = tokenCipher.encode(data); err != nil {
+		return fmt.Errorf("failed to encrypt refresh journal: %w", err)
+	}
+	return writeFileAtomic(path, data, 0o600)
+}
+
+// mergeRefreshJournal adds the rotations of the journal at from to the one
+// at to, in rotation order, and removes from. A missing journal at from is
+// nothing to merge.
+func mergeRefreshJournal(from, to string) error {
+	if _, err := os.Stat(from); errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	moved, err := readRefreshJournal(from)
+	if err != nil {
+		return err
+	}
+
+	lock, err := acquireFileLock(context.Background(), to)
+	if err != nil {
+		return fmt.Errorf("failed to acquire lock: %w", err)
+	}
+	defer func() { _ = lock.release() }()
+
+	entries, err := readRefreshJournal(to)
+	if err != nil {
+		return err
+	}
+	entries = append(entries, moved...)
+	slices.SortStableFunc(entries, func(a, b journalEntry) int {
+		return a.RotatedAt.Compare(b.RotatedAt)
+	})
+	if err := writeRefreshJournal(to, entries); err != nil {
+		return err
+	}
+	return os.Remove(from)
+}
+
+// latestRotation follows the journal from refreshToken to the newest refresh
+// token it was rotated into. It returns refreshToken itself when the journal
+// has no rotation for it.
+func latestRotation(entries []journalEntry, refreshToken string) string {
+	current := refreshToken
+	// Each step consumes one entry, so len(entries) bounds the chain and
+	// guards against cycles.
+	for range entries {
+		next := ""
+		for i := len(entries) - 1; i >= 0; i-- {
+			e := entries[i]
+			if e.forCurrentClient() && e.PreviousRefreshToken == current {
+				next = e.RefreshToken
+				break
+			}
+		}
+		if next == "" || next == current {
+			return current
+		}
+		current = next
+	}
+	return current
+}
+
+// issuedByRotation reports whether the journal shows refreshToken was
+// obtained by rotating an earlier refresh token.
+func issuedByRotation(entries []journalEntry, refreshToken string) bool {
+	for _, e := range entries {
+		if e.forCurrentClient() && e.RefreshToken == refreshToken {
+			return true
+		}
+	}
+	return false
+}
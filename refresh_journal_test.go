@@ -0,0 +1,173 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// setupRefreshTest points the token file at path and the server URL at a
+// test server running handler.
+func setupRefreshTest(t *testing.T, path string, handler http.HandlerFunc) {
+	t.Helper()
+	origServerURL := serverURL
+	origClientID := clientID
+	origTokenFile := tokenFile
+	t.Cleanup(func() {
+		serverURL = origServerURL
+		clientID = origClientID
+		tokenFile = origTokenFile
+	})
+
+	srv := httptest.NewServer(handler)
+	t.Cleanup(srv.Close)
+
+	serverURL = srv.URL
+	clientID = "test-client-journal"
+	tokenFile = path
+}
+
+func writeTokenResponse(w http.ResponseWriter, refreshToken string) {
+	resp := map[string]interface{}{
+		"access_token": "new-access-token",
+		"token_type":   "Bearer",
+		"expires_in":   3600,
+	}
+	if refreshToken != "" {
+		resp["refresh_token"] = refreshToken
+	}
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(resp)
+}
+
+func TestLatestRotation(t *testing.T) {
+	origClientID := clientID
+	t.Cleanup(func() { clientID = origClientID })
+	clientID = "c1"
+
+	entries := []journalEntry{
+		{ClientID: "c1", PreviousRefreshToken: "a", RefreshToken: "b"},
+		{ClientID: "c2", PreviousRefreshToken: "b", RefreshToken: "other-client"},
+		{ClientID: "c1", PreviousRefreshToken: "b", RefreshToken: "c"},
+		{ClientID: "c1", PreviousRefreshToken: "x", RefreshToken: "x"},
+	}
+
+	tests := map[string]string{"a": "c", "b": "c", "c": "c", "unknown": "unknown", "x": "x"}
+	for in, want := range tests {
+		if got := latestRotation(entries, in); got != want {
+			t.Errorf("latestRotation(%q) = %q, want %q", in, got, want)
+		}
+	}
+	if !issuedByRotation(entries, "c") || issuedByRotation(entries, "a") {
+		t.Error("issuedByRotation() misclassified tokens")
+	}
+}
+
+func TestRefreshAccessToken_RotatedTokenSurvivesSaveFailure(t *testing.T) {
+	// A directory in place of the token file makes every save fail while the
+	// journal next to it stays writable.
+	path := filepath.Join(t.TempDir(), "tokens.json")
+	if err := os.Mkdir(path, 0o700); err != nil {
+		t.Fatal(err)
+	}
+
+	var presented []string
+	setupRefreshTest(t, path, func(w http.ResponseWriter, r *http.Request) {
+		if err := r.ParseForm(); err != nil {
+			http.Error(w, "bad form", http.StatusBadRequest)
+			return
+		}
+		presented = append(presented, r.FormValue("refresh_token"))
+		if len(presented) == 1 {
+			writeTokenResponse(w, "rotated-refresh-token")
+			return
+		}
+		writeTokenResponse(w, "") // fixed mode from now on
+	})
+
+	_, err := refreshAccessToken(context.Background(), io.Discard, "old-refresh-token")
+	if err == nil {
+		t.Fatal("expected error when a rotated refresh token cannot be saved")
+	}
+
+	// The next run still holds the old token; it must continue from the
+	// rotated one recorded in the journal instead of replaying the old one.
+	storage, err := refreshAccessToken(context.Background(), io.Discard, "old-refresh-token")
+	if err != nil {
+		t.Fatalf("refreshAccessToken() after recovery error: %v", err)
+	}
+	if len(presented) != 2 || presented[1] != "rotated-refresh-token" {
+		t.Errorf("presented refresh tokens = %q, want rotated token on second call", presented)
+	}
+	if storage.RefreshToken != "rotated-refresh-token" {
+		t.Errorf("RefreshToken = %q, want %q", storage.RefreshToken, "rotated-refresh-token")
+	}
+}
+
+func TestRefreshAccessToken_ReuseDetection(t *testing.T) {
+	setupRefreshTest(
+		t,
+		filepath.Join(t.TempDir(), "tokens.json"),
+		func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(http.StatusBadRequest)
+			_ = json.NewEncoder(w).Encode(map[string]string{"error": "invalid_grant"})
+		},
+	)
+
+	// A token that was never rotated is simply expired.
+	_, err := refreshAccessToken(context.Background(), io.Discard, "plain-refresh-token")
+	if !errors.Is(err, ErrRefreshTokenExpired) || errors.Is(err, ErrRefreshTokenReused) {
+		t.Errorf("plain token: got %v, want ErrRefreshTokenExpired only", err)
+	}
+
+	if err := appendRefreshJournal(journalEntry{
+		ClientID:             clientID,
+		PreviousRefreshToken: "old-refresh-token",
+		RefreshToken:         "rotated-refresh-token",
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = refreshAccessToken(context.Background(), io.Discard, "rotated-refresh-token")
+	if !errors.Is(err, ErrRefreshTokenReused) {
+		t.Errorf("rotated token: got %v, want ErrRefreshTokenReused", err)
+	}
+	if !errors.Is(err, ErrRefreshTokenExpired) {
+		t.Error("ErrRefreshTokenReused should wrap ErrRefreshTokenExpired")
+	}
+}
+
+func TestAppendRefreshJournal_Bounded(t *testing.T) {
+	origTokenFile := tokenFile
+	t.Cleanup(func() { tokenFile = origTokenFile })
+	tokenFile = filepath.Join(t.TempDir(), "tokens.json")
+
+	for i := 0; i < maxJournalEntries+5; i++ {
+		if err := appendRefreshJournal(journalEntry{ClientID: "c"}); err != nil {
+			t.Fatalf("appendRefreshJournal() error: %v", err)
+		}
+	}
+
+	entries, err := loadRefreshJournal()
+	if err != nil {
+		t.Fatalf("loadRefreshJournal() error: %v", err)
+	}
+	if len(entries) != maxJournalEntries {
+		t.Errorf("journal has %d entries, want %d", len(entries), maxJournalEntries)
+	}
+
+	info, err := os.Stat(refreshJournalPath())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if perm := info.Mode().Perm(); perm != 0o600 {
+		t.Errorf("journal permissions = %o, want 600", perm)
+	}
+}
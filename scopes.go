@@ -0,0 +1,57 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"strings"
+
+	"golang.org/x/oauth2"
+)
+
+// grantedScope returns the scopes held by storage. Tokens saved before
+// granted scopes were tracked are assumed to carry the configured scope.
+func grantedScope(storage *TokenStorage) string {
+	if storage.Scope != "" {
+		return storage.Scope
+	}
+	return scope
+}
+
+// missingScopes returns the scopes in required that are not in granted.
+func missingScopes(granted, required string) []string {
+	have := make(map[string]bool)
+	for _, s := range strings.Fields(granted) {
+		have[s] = true
+	}
+	var missing []string
+	for _, s := range strings.Fields(required) {
+		if !have[s] {
+			missing = append(missing, s)
+			have[s] = true
+		}
+	}
+	return missing
+}
+
+// recordGrantedScope fills in storage.Scope when the server omitted it from
+// the token response — in that case the granted scope equals the requested
+// one (RFC 6749 §5.1) — and warns when fewer scopes were granted than
+// requested.
+func recordGrantedScope(diag io.Writer, storage *TokenStorage, requested string) {
+	if storage.Scope == "" {
+		storage.Scope = requested
+		return
+	}
+	if missing := missingScopes(storage.Scope, requested); len(missing) > 0 {
+		fmt.Fprintf(diag,
+			"Warning: Server granted fewer scopes than requested (missing: %s)\n",
+			strings.Join(missing, " "),
+		)
+	}
+}
+
+// tokenScope returns the scope carried in an oauth2.Token's extra fields.
+func tokenScope(token *oauth2.Token) string {
+	s, _ := token.Extra("scope").(string)
+	return s
+}
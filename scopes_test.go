@@ -0,0 +1,150 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestMissingScopes(t *testing.T) {
+	tests := []struct {
+		granted  string
+		required string
+		want     []string
+	}{
+		{"read write", "read", nil},
+		{"read write", "", nil},
+		{"read", "read deploy admin", []string{"deploy", "admin"}},
+		{"", "deploy deploy", []string{"deploy"}},
+	}
+	for _, tc := range tests {
+		got := missingScopes(tc.granted, tc.required)
+		if !reflect.DeepEqual(got, tc.want) {
+			t.Errorf("missingScopes(%q, %q) = %q, want %q", tc.granted, tc.required, got, tc.want)
+		}
+	}
+}
+
+func TestRecordGrantedScope(t *testing.T) {
+	omitted := &TokenStorage{}
+	recordGrantedScope(io.Discard, omitted, "read write")
+	if omitted.Scope != "read write" {
+		t.Errorf("omitted scope: got %q, want requested scope", omitted.Scope)
+	}
+
+	reduced := &TokenStorage{Scope: "read"}
+	recordGrantedScope(io.Discard, reduced, "read write")
+	if reduced.Scope != "read" {
+		t.Errorf("reduced scope overwritten: got %q, want %q", reduced.Scope, "read")
+	}
+}
+
+func TestGrantedScope_LegacyToken(t *testing.T) {
+	origScope := scope
+	t.Cleanup(func() { scope = origScope })
+	scope = "read write"
+
+	if got := grantedScope(&TokenStorage{}); got != "read write" {
+		t.Errorf("grantedScope() = %q, want configured scope", got)
+	}
+	if got := grantedScope(&TokenStorage{Scope: "read"}); got != "read" {
+		t.Errorf("grantedScope() = %q, want %q", got, "read")
+	}
+}
+
+func TestExchangeDeviceCode_Scope(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		if err := json.NewEncoder(w).Encode(map[string]interface{}{
+			"access_token": testAccessToken,
+			"token_type":   "Bearer",
+			"expires_in":   3600,
+			"scope":        "read deploy",
+		}); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+		}
+	}))
+	defer server.Close()
+
+	token, err := exchangeDeviceCode(context.Background(), server.URL, "test-client", "code")
+	if err != nil {
+		t.Fatalf("exchangeDeviceCode() error: %v", err)
+	}
+	if got := tokenScope(token); got != "read deploy" {
+		t.Errorf("tokenScope() = %q, want %q", got, "read deploy")
+	}
+}
+
+func TestObtainToken_ReusesAndRefreshes(t *testing.T) {
+	origServerURL := serverURL
+	origClientID := clientID
+	origTokenFile := tokenFile
+	t.Cleanup(func() {
+		serverURL = origServerURL
+		clientID = origClientID
+		tokenFile = origTokenFile
+	})
+
+	tokenFile = filepath.Join(t.TempDir(), "tokens.json")
+	clientID = "test-client-obtain"
+
+	var refreshes int
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		refreshes++
+		w.Header().Set("Content-Type", "application/json")
+		// No scope in the response: the original grant must be preserved.
+		if err := json.NewEncoder(w).Encode(map[string]interface{}{
+			"access_token":  "refreshed-access-token",
+			"refresh_token": "rotated-refresh-token",
+			"token_type":    "Bearer",
+			"expires_in":    3600,
+		}); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+		}
+	}))
+	defer srv.Close()
+	serverURL = srv.URL
+
+	if err := saveTokens(&TokenStorage{
+		AccessToken:  "valid-access-token",
+		RefreshToken: "refresh-token",
+		TokenType:    "Bearer",
+		ExpiresAt:    time.Now().Add(time.Hour),
+		ClientID:     clientID,
+		Scope:        "read write deploy",
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	storage, err := obtainToken(context.Background(), io.Discard, "deploy", true)
+	if err != nil {
+		t.Fatalf("obtainToken() error: %v", err)
+	}
+	if storage.AccessToken != "valid-access-token" || refreshes != 0 {
+		t.Errorf("expected cached token to be reused, got %q after %d refreshes",
+			storage.AccessToken, refreshes)
+	}
+
+	storage.ExpiresAt = time.Now().Add(-time.Minute)
+	if err := saveTokens(storage); err != nil {
+		t.Fatal(err)
+	}
+
+	storage, err = obtainToken(context.Background(), io.Discard, "deploy", true)
+	if err != nil {
+		t.Fatalf("obtainToken() error: %v", err)
+	}
+	if storage.AccessToken != "refreshed-access-token" || refreshes != 1 {
+		t.Errorf("expected one refresh, got %q after %d refreshes",
+			storage.AccessToken, refreshes)
+	}
+	if storage.Scope != "read write deploy" {
+		t.Errorf("Scope after refresh = %q, want original grant", storage.Scope)
+	}
+}
@@ -0,0 +1,297 @@
+package main
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+
+	"golang.org/x/crypto/scrypt"
+)
+
+// Encrypted token file envelope (version 1).
+const (
+	encryptedFileFormat  = "authgate-tokens-encrypted"
+	encryptedFileVersion = 1
+	encryptedFileCipher  = "AES-256-GCM"
+
+	kdfScrypt = "scrypt" // key derived from TOKEN_PASSPHRASE
+	kdfNone   = "none"   // raw 256-bit key from TOKEN_KEY or TOKEN_KEY_FILE
+)
+
+// scrypt cost for passphrase-derived keys: about 32 MiB (128·N·r bytes) and
+// 100ms per derivation. Files asking for more than maxScryptMemory or
+// maxScryptP, which a tampered header could, are refused before deriving.
+const (
+	scryptN         = 1 << 15
+	scryptR         = 8
+	scryptP         = 1
+	maxScryptMemory = 256 << 20
+	maxScryptP      = 16
+)
+
+// errTokenFileEncrypted is returned when an encrypted file is read without a
+// configured key.
+var errTokenFileEncrypted = errors.New(
+	"token file is encrypted: set TOKEN_PASSPHRASE, TOKEN_KEY or TOKEN_KEY_FILE",
+)
+
+// scryptParams are the KDF parameters stored in the file header.
+type scryptParams struct {
+	N    int    `json:"n"`
+	R    int    `json:"r"`
+	P    int    `json:"p"`
+	Salt []byte `json:"salt"`
+}
+
+// encryptedHeader describes how the payload was encrypted. Its JSON encoding
+// is the AEAD additional data, so any change to it fails decryption.
+type encryptedHeader struct {
+	Format    string        `json:"format"`
+	Version   int           `json:"version"`
+	Cipher    string        `json:"cipher"`
+	KDF       string        `json:"kdf"`
+	KDFParams *scryptParams `json:"kdf_params,omitempty"`
+}
+
+// encryptedFile is the on-disk format of an encrypted token or journal file.
+// Ciphertext decrypts to the same JSON the plaintext file would contain.
+type encryptedFile struct {
+	encryptedHeader
+	Nonce      []byte `json:"nonce"`
+	Ciphertext []byte `json:"ciphertext"`
+}
+
+// tokenEncryption holds the key material for encrypting the token file. A
+// nil *tokenEncryption reads and writes plaintext.
+type tokenEncryption struct {
+	key        []byte // raw key; nil when a passphrase is used
+	passphrase []byte
+
+	// The most recently derived passphrase key, so that a read followed by
+	// a write pays for one scrypt derivation instead of two.
+	mu          sync.Mutex
+	derivedFrom scryptParams
+	derivedKey  []byte
+}
+
+// tokenCipher is the configured encryption for the token file and its
+// refresh journal; nil means plaintext.
+var tokenCipher *tokenEncryption
+
+// newTokenEncryption returns the encryption configured by at most one of a
+// passphrase, a base64-encoded 256-bit key, or a file containing one. It
+// returns nil when none is set.
+func newTokenEncryption(passphrase, encodedKey, keyFile string) (*tokenEncryption, error) {
+	set := 0
+	for _, v := range []string{passphrase, encodedKey, keyFile} {
+		if v != "" {
+			set++
+		}
+	}
+	switch {
+	case set == 0:
+		return nil, nil
+	case set > 1:
+		return nil, fmt.Errorf("set only one of TOKEN_PASSPHRASE, TOKEN_KEY and TOKEN_KEY_FILE")
+	case passphrase != "":
+		return &tokenEncryption{passphrase: []byte(passphrase)}, nil
+	}
+
+	source := "TOKEN_KEY"
+	if keyFile != "" {
+		data, err := os.ReadFile(keyFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read key file: %w", err)
+		}
+		encodedKey, source = string(data), keyFile
+	}
+	key, err := base64.StdEncoding.DecodeString(strings.TrimSpace(encodedKey))
+	if err != nil || len(key) != 32 {
+		return nil, fmt.Errorf(
+			"%s must contain a base64-encoded 32-byte key (e.g. openssl rand -base64 32)",
+			source,
+		)
+	}
+	return &tokenEncryption{key: key}, nil
+}
+
+// parseEncryptedFile returns the envelope when data is an encrypted file, and
+// nil for anything else (e.g. a plaintext TokenStorageMap).
+func parseEncryptedFile(data []byte) *encryptedFile {
+	var f encryptedFile
+	if err := json.Unmarshal(data, &f); err != nil || f.Format != encryptedFileFormat {
+		return nil
+	}
+	return &f
+}
+
+// decode returns the plaintext JSON stored in data, decrypting it if it is an
+// encrypted file. encrypted reports whether it was, so callers can migrate
+// plaintext files.
+func (e *tokenEncryption) decode(data []byte) (plain []byte, encrypted bool, err error) {
+	f := parseEncryptedFile(data)
+	if f == nil {
+		return data, false, nil
+	}
+	if e == nil {
+		return nil, true, errTokenFileEncrypted
+	}
+	plain, err = e.open(f)
+	return plain, true, err
+}
+
+// encode encrypts plain, or returns it unchanged when e is nil.
+func (e *tokenEncryption) encode(plain []byte) ([]byte, error) {
+	if e == nil {
+		return plain, nil
+	}
+	return e.seal(plain)
+}
+
+func (e *tokenEncryption) seal(plain []byte) ([]byte, error) {
+	header := encryptedHeader{
+		Format:  encryptedFileFormat,
+		Version: encryptedFileVersion,
+		Cipher:  encryptedFileCipher,
+		KDF:     kdfNone,
+	}
+	key := e.key
+	if e.passphrase != nil {
+		params, derived, err := e.writeKey()
+		if err != nil {
+			return nil, err
+		}
+		header.KDF, header.KDFParams, key = kdfScrypt, &params, derived
+	}
+
+	aead, err := newAEAD(key)
+	if err != nil {
+		return nil, err
+	}
+	aad, err := json.Marshal(header)
+	if err != nil {
+		return nil, err
+	}
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, fmt.Errorf("failed to generate nonce: %w", err)
+	}
+
+	return json.MarshalIndent(encryptedFile{
+		encryptedHeader: header,
+		Nonce:           nonce,
+		Ciphertext:      aead.Seal(nil, nonce, plain, aad),
+	}, "", "  ")
+}
+
+func (e *tokenEncryption) open(f *encryptedFile) ([]byte, error) {
+	if f.Version != encryptedFileVersion {
+		return nil, fmt.Errorf("unsupported encrypted token file version %d", f.Version)
+	}
+	if f.Cipher != encryptedFileCipher {
+		return nil, fmt.Errorf("unsupported token file cipher %q", f.Cipher)
+	}
+
+	var key []byte
+	switch f.KDF {
+	case kdfScrypt:
+		if e.passphrase == nil || f.KDFParams == nil {
+			return nil, fmt.Errorf(
+				"token file is encrypted with a passphrase: set TOKEN_PASSPHRASE",
+			)
+		}
+		var err error
+		if key, err = e.deriveKey(*f.KDFParams); err != nil {
+			return nil, err
+		}
+	case kdfNone:
+		if e.key == nil {
+			return nil, fmt.Errorf(
+				"token file is encrypted with a key: set TOKEN_KEY or TOKEN_KEY_FILE",
+			)
+		}
+		key = e.key
+	default:
+		return nil, fmt.Errorf("unsupported token file key derivation %q", f.KDF)
+	}
+
+	aead, err := newAEAD(key)
+	if err != nil {
+		return nil, err
+	}
+	if len(f.Nonce) != aead.NonceSize() {
+		return nil, fmt.Errorf("invalid nonce in encrypted token file")
+	}
+	aad, err := json.Marshal(f.encryptedHeader)
+	if err != nil {
+		return nil, err
+	}
+	plain, err := aead.Open(nil, f.Nonce, f.Ciphertext, aad)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decrypt token file: wrong key or file was modified")
+	}
+	return plain, nil
+}
+
+// writeKey returns the KDF parameters and key to encrypt with, reusing the
+// last derived key (and thus its salt) when there is one.
+func (e *tokenEncryption) writeKey() (scryptParams, []byte, error) {
+	e.mu.Lock()
+	params, key := e.derivedFrom, e.derivedKey
+	e.mu.Unlock()
+	if key != nil {
+		return params, key, nil
+	}
+
+	params = scryptParams{N: scryptN, R: scryptR, P: scryptP, Salt: make([]byte, 16)}
+	if _, err := rand.Read(params.Salt); err != nil {
+		return scryptParams{}, nil, fmt.Errorf("failed to generate salt: %w", err)
+	}
+	key, err := e.deriveKey(params)
+	return params, key, err
+}
+
+func (e *tokenEncryption) deriveKey(params scryptParams) ([]byte, error) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if e.derivedKey != nil && e.derivedFrom.N == params.N && e.derivedFrom.R == params.R &&
+		e.derivedFrom.P == params.P && string(e.derivedFrom.Salt) == string(params.Salt) {
+		return e.derivedKey, nil
+	}
+
+	if err := checkScryptParams(params); err != nil {
+		return nil, err
+	}
+	key, err := scrypt.Key(e.passphrase, params.Salt, params.N, params.R, params.P, 32)
+	if err != nil {
+		return nil, fmt.Errorf("failed to derive key: %w", err)
+	}
+	e.derivedFrom, e.derivedKey = params, key
+	return key, nil
+}
+
+// checkScryptParams rejects KDF parameters out of the bounds above. The
+// memory bound is checked as N·r <= maxScryptMemory/128 without overflowing.
+func checkScryptParams(params scryptParams) error {
+	const maxBlocks = maxScryptMemory / 128
+	if params.N < 2 || params.R < 1 || params.P < 1 || params.P > maxScryptP ||
+		params.N > maxBlocks || params.R > maxBlocks/params.N || len(params.Salt) == 0 {
+		return errors.New("invalid scrypt parameters in token file")
+	}
+	return nil
+}
+
+func newAEAD(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
@@ -0,0 +1,174 @@
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func testEncryptionKey() string {
+	return base64.StdEncoding.EncodeToString(bytes.Repeat([]byte{7}, 32))
+}
+
+func TestFileTokenStore_Encrypted(t *testing.T) {
+	enc, err := newTokenEncryption("", testEncryptionKey(), "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(t.TempDir(), "tokens.json")
+	testTokenStore(t, &fileTokenStore{path: path, enc: enc})
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if parseEncryptedFile(data) == nil {
+		t.Errorf("token file is not encrypted:\n%s", data)
+	}
+	if bytes.Contains(data, []byte("refresh-token-value")) {
+		t.Error("token file contains a plaintext refresh token")
+	}
+}
+
+func TestTokenEncryption_Passphrase(t *testing.T) {
+	enc, err := newTokenEncryption("correct horse", "", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	sealed, err := enc.encode([]byte(`{"tokens":{}}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// A fresh instance has no cached key and must derive it from the salt.
+	plain, encrypted, err := (&tokenEncryption{passphrase: []byte("correct horse")}).decode(sealed)
+	if err != nil || !encrypted || string(plain) != `{"tokens":{}}` {
+		t.Fatalf("decode() = %q, %v, %v", plain, encrypted, err)
+	}
+
+	wrong := &tokenEncryption{passphrase: []byte("wrong")}
+	if _, _, err := wrong.decode(sealed); err == nil {
+		t.Error("decode() with wrong passphrase succeeded")
+	}
+	if _, _, err := (*tokenEncryption)(nil).decode(sealed); !errors.Is(err, errTokenFileEncrypted) {
+		t.Errorf("decode() without key error = %v, want errTokenFileEncrypted", err)
+	}
+}
+
+func TestTokenEncryption_HeaderIsAuthenticated(t *testing.T) {
+	enc, _ := newTokenEncryption("", testEncryptionKey(), "")
+	sealed, err := enc.encode([]byte(`{"tokens":{}}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var f map[string]any
+	if err := json.Unmarshal(sealed, &f); err != nil {
+		t.Fatal(err)
+	}
+	f["cipher"] = encryptedFileCipher + " "
+	tampered, _ := json.Marshal(f)
+	if _, _, err := enc.decode(tampered); err == nil {
+		t.Error("decode() accepted a modified header")
+	}
+}
+
+func TestTokenEncryption_HostileScryptParams(t *testing.T) {
+	sealed, err := (&tokenEncryption{passphrase: []byte("pass")}).encode([]byte(`{}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for name, params := range map[string]map[string]int{
+		"huge r":     {"n": 1 << 20, "r": 65535, "p": 1},
+		"huge n":     {"n": 1 << 30, "r": 1, "p": 1},
+		"huge n·r":   {"n": 1 << 20, "r": 8, "p": 1},
+		"huge p":     {"n": 1 << 10, "r": 8, "p": 1 << 12},
+		"zero r":     {"n": 1 << 15, "r": 0, "p": 1},
+		"negative n": {"n": -1, "r": 8, "p": 1},
+	} {
+		var f map[string]any
+		if err := json.Unmarshal(sealed, &f); err != nil {
+			t.Fatal(err)
+		}
+		kdf := f["kdf_params"].(map[string]any)
+		for k, v := range params {
+			kdf[k] = v
+		}
+		hostile, _ := json.Marshal(f)
+
+		// A fresh instance has no cached key, so it would have to derive one.
+		fresh := &tokenEncryption{passphrase: []byte("pass")}
+		if _, _, err := fresh.decode(hostile); err == nil ||
+			!strings.Contains(err.Error(), "invalid scrypt parameters") {
+			t.Errorf("%s: decode() error = %v, want invalid scrypt parameters", name, err)
+		}
+	}
+}
+
+func TestNewTokenEncryption(t *testing.T) {
+	keyFile := filepath.Join(t.TempDir(), "key")
+	if err := os.WriteFile(keyFile, []byte(testEncryptionKey()+"\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	if enc, err := newTokenEncryption("", "", ""); enc != nil || err != nil {
+		t.Errorf("no settings = %v, %v; want nil, nil", enc, err)
+	}
+	if enc, err := newTokenEncryption("", "", keyFile); err != nil || len(enc.key) != 32 {
+		t.Errorf("key file = %v, %v", enc, err)
+	}
+	if _, err := newTokenEncryption("", "c2hvcnQ=", ""); err == nil {
+		t.Error("short key accepted")
+	}
+	if _, err := newTokenEncryption("pass", testEncryptionKey(), ""); err == nil {
+		t.Error("passphrase and key together accepted")
+	}
+}
+
+func TestFileTokenStore_MigratesPlaintext(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "tokens.json")
+	plain := &fileTokenStore{path: path}
+	want := &TokenStorage{
+		AccessToken:  "access-token-value",
+		RefreshToken: "refresh-token-value",
+		ExpiresAt:    time.Now().Add(time.Hour).UTC().Truncate(time.Second),
+		ClientID:     "client-a",
+	}
+	if err := plain.Put("client-a", want); err != nil {
+		t.Fatal(err)
+	}
+
+	enc, _ := newTokenEncryption("", testEncryptionKey(), "")
+	encrypted := &fileTokenStore{path: path, enc: enc}
+	got, err := encrypted.Get("client-a")
+	if err != nil {
+		t.Fatalf("Get() error: %v", err)
+	}
+	if got.RefreshToken != want.RefreshToken {
+		t.Errorf("RefreshToken = %q", got.RefreshToken)
+	}
+
+	data, _ := os.ReadFile(path)
+	if parseEncryptedFile(data) == nil {
+		t.Fatalf("token file was not migrated:\n%s", data)
+	}
+
+	// Without the key, reads fail and writes must not clobber the file.
+	if _, err := plain.Get("client-a"); !errors.Is(err, errTokenFileEncrypted) {
+		t.Errorf("Get() without key error = %v, want errTokenFileEncrypted", err)
+	}
+	if err := plain.Put("client-b", want); err == nil ||
+		!strings.Contains(err.Error(), "encrypted") {
+		t.Errorf("Put() without key error = %v", err)
+	}
+	if got, err := encrypted.Get("client-a"); err != nil || got.AccessToken != want.AccessToken {
+		t.Errorf("Get() after rejected write = %v, %v", got, err)
+	}
+}
@@ -0,0 +1,148 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/url"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+)
+
+// legacyTokenFile is the default token file of earlier versions, relative to
+// the working directory.
+const legacyTokenFile = ".authgate-tokens.json"
+
+// tokenKeySeparator joins the server URL and client ID in store keys.
+const tokenKeySeparator = "|"
+
+// defaultTokenFile returns the per-user token file location:
+// $XDG_STATE_HOME/authgate/tokens.json, ~/.local/state/authgate/tokens.json
+// on other Unix systems without XDG_STATE_HOME, and the user config directory
+// (Application Support, %AppData%) on macOS and Windows. It falls back to the
+// legacy relative path when no home directory is known.
+func defaultTokenFile() string {
+	if dir := os.Getenv("XDG_STATE_HOME"); filepath.IsAbs(dir) {
+		return filepath.Join(dir, "authgate", "tokens.json")
+	}
+	if runtime.GOOS != "darwin" && runtime.GOOS != "windows" {
+		if home, err := os.UserHomeDir(); err == nil {
+			return filepath.Join(home, ".local", "state", "authgate", "tokens.json")
+		}
+	}
+	if dir, err := os.UserConfigDir(); err == nil {
+		return filepath.Join(dir, "authgate", "tokens.json")
+	}
+	return legacyTokenFile
+}
+
+// normalizeServerURL returns the canonical form of a server URL used in
+// store keys: lower-case scheme and host, no trailing slash.
+func normalizeServerURL(raw string) string {
+	u, err := url.Parse(strings.TrimRight(raw, "/"))
+	if err != nil || u.Host == "" {
+		return strings.TrimRight(raw, "/")
+	}
+	u.Scheme = strings.ToLower(u.Scheme)
+	u.Host = strings.ToLower(u.Host)
+	return u.String()
+}
+
+// tokenStoreKey returns the store key for an account of a client on a server,
+// so the same client ID registered on two servers (e.g. staging and prod) does
+// not collide. The default account has no account suffix.
+func tokenStoreKey(server, client, account string) string {
+	key := normalizeServerURL(server) + tokenKeySeparator + client
+	if account != "" && account != defaultAccount {
+		key += tokenKeySeparator + account
+	}
+	return key
+}
+
+// splitTokenStoreKey is the inverse of tokenStoreKey. Legacy keys (a bare
+// client ID) have an empty server.
+func splitTokenStoreKey(key string) (server, client, account string) {
+	parts := strings.Split(key, tokenKeySeparator)
+	switch len(parts) {
+	case 1:
+		return "", parts[0], defaultAccount
+	case 2:
+		return parts[0], parts[1], defaultAccount
+	default:
+		n := len(parts)
+		return strings.Join(parts[:n-2], tokenKeySeparator), parts[n-2], parts[n-1]
+	}
+}
+
+// currentTokenKey is the store key for the current account of the configured
+// server and client.
+func currentTokenKey() string {
+	return tokenStoreKey(serverURL, clientID, currentAccount())
+}
+
+// migrateLegacyTokenKey moves an entry stored under the bare client ID, as
+// written by earlier versions, to the server-qualified key of the default
+// account. Such entries carry no server, so they are attributed to the
+// configured one.
+func migrateLegacyTokenKey(store TokenStore) (*TokenStorage, error) {
+	if currentAccount() != defaultAccount {
+		return nil, fmt.Errorf("%w for account %s", ErrTokenNotFound, currentAccount())
+	}
+	storage, err := store.Get(clientID)
+	if err != nil {
+		return nil, err
+	}
+	storage.ServerURL = normalizeServerURL(serverURL)
+	if err := store.Put(currentTokenKey(), storage); err != nil {
+		return nil, fmt.Errorf("failed to migrate tokens to %s: %w", currentTokenKey(), err)
+	}
+	if err := store.Delete(clientID); err != nil {
+		fmt.Fprintf(
+			os.Stderr,
+			"Warning: Failed to remove legacy token entry %s: %v\n",
+			clientID,
+			err,
+		)
+	}
+	return storage, nil
+}
+
+// migrateLegacyTokenFile moves a token file (and its refresh journal) from
+// the legacy location in the working directory to target. When target already
+// exists, e.g. after a migration in another working directory, the legacy
+// entries are merged into it, except for keys target already has: those are
+// newer. Keys are migrated later, on first load.
+func migrateLegacyTokenFile(legacy, target string) error {
+	if legacy == target {
+		return nil
+	}
+	legacyStore := &fileTokenStore{path: legacy, enc: tokenCipher}
+	storageMap, err := legacyStore.readMap()
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	targetStore := &fileTokenStore{path: target, enc: tokenCipher}
+	if err := targetStore.update(func(tokens map[string]*TokenStorage) {
+		for k, v := range storageMap.Tokens {
+			if _, ok := tokens[k]; !ok {
+				tokens[k] = v
+			}
+		}
+	}); err != nil {
+		return err
+	}
+
+	if err := mergeRefreshJournal(legacy+".journal", target+".journal"); err != nil {
+		return fmt.Errorf("failed to merge the refresh journal: %w", err)
+	}
+	if err := os.Remove(legacy); err != nil {
+		return fmt.Errorf("copied tokens to %s but failed to remove %s: %w", target, legacy, err)
+	}
+	fmt.Fprintf(os.Stderr, "Moved tokens from %s to %s\n", legacy, target)
+	return nil
+}
@@ -0,0 +1,186 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestDefaultTokenFile_XDGStateHome(t *testing.T) {
+	dir := t.TempDir()
+	t.Setenv("XDG_STATE_HOME", dir)
+	want := filepath.Join(dir, "authgate", "tokens.json")
+	if got := defaultTokenFile(); got != want {
+		t.Errorf("defaultTokenFile() = %q, want %q", got, want)
+	}
+
+	// Relative values are invalid per the XDG spec and ignored.
+	t.Setenv("XDG_STATE_HOME", "relative")
+	if got := defaultTokenFile(); got == filepath.Join("relative", "authgate", "tokens.json") {
+		t.Errorf("defaultTokenFile() used relative XDG_STATE_HOME: %q", got)
+	}
+}
+
+func TestTokenStoreKey(t *testing.T) {
+	tests := []struct {
+		server, client, account, want string
+	}{
+		{"https://auth.example.com", "abc", defaultAccount, "https://auth.example.com|abc"},
+		{"HTTPS://Auth.Example.com/", "abc", defaultAccount, "https://auth.example.com|abc"},
+		{
+			"https://example.com/authgate/", "abc", defaultAccount,
+			"https://example.com/authgate|abc",
+		},
+		{"https://auth.example.com", "abc", "admin", "https://auth.example.com|abc|admin"},
+	}
+	for _, tt := range tests {
+		key := tokenStoreKey(tt.server, tt.client, tt.account)
+		if key != tt.want {
+			t.Errorf("tokenStoreKey(%+v) = %q, want %q", tt, key, tt.want)
+		}
+		server, client, account := splitTokenStoreKey(key)
+		if server != normalizeServerURL(tt.server) || client != tt.client ||
+			account != tt.account {
+			t.Errorf("splitTokenStoreKey(%q) = %q, %q, %q", key, server, client, account)
+		}
+	}
+
+	if server, client, account := splitTokenStoreKey("legacy-client"); server != "" ||
+		client != "legacy-client" || account != defaultAccount {
+		t.Errorf("splitTokenStoreKey(legacy) = %q, %q, %q", server, client, account)
+	}
+}
+
+func TestLoadTokens_SeparatesServers(t *testing.T) {
+	origStore, origServer, origClient := tokenStore, serverURL, clientID
+	t.Cleanup(func() {
+		tokenStore, serverURL, clientID = origStore, origServer, origClient
+	})
+	tokenStore = newMemoryTokenStore()
+	clientID = "shared-client"
+
+	for _, server := range []string{"https://staging.example.com", "https://prod.example.com"} {
+		serverURL = server
+		if err := saveTokens(&TokenStorage{AccessToken: "token-for-" + server}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	serverURL = "https://staging.example.com"
+	got, err := loadTokens()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.AccessToken != "token-for-https://staging.example.com" {
+		t.Errorf("AccessToken = %q", got.AccessToken)
+	}
+}
+
+func TestLoadTokens_MigratesLegacyKey(t *testing.T) {
+	origStore, origServer, origClient := tokenStore, serverURL, clientID
+	t.Cleanup(func() {
+		tokenStore, serverURL, clientID = origStore, origServer, origClient
+	})
+	store := newMemoryTokenStore()
+	tokenStore = store
+	serverURL = "https://auth.example.com"
+	clientID = "legacy-client"
+
+	legacy := &TokenStorage{AccessToken: "legacy", ClientID: clientID}
+	if err := store.Put(clientID, legacy); err != nil {
+		t.Fatal(err)
+	}
+
+	got, err := loadTokens()
+	if err != nil {
+		t.Fatalf("loadTokens() error: %v", err)
+	}
+	if got.AccessToken != "legacy" || got.ServerURL != "https://auth.example.com" {
+		t.Errorf("loadTokens() = %+v", got)
+	}
+
+	keys, _ := store.List()
+	if len(keys) != 1 || keys[0] != "https://auth.example.com|legacy-client" {
+		t.Errorf("keys after migration = %q", keys)
+	}
+}
+
+func TestMigrateLegacyTokenFile(t *testing.T) {
+	dir := t.TempDir()
+	legacy := filepath.Join(dir, ".authgate-tokens.json")
+	target := filepath.Join(dir, "state", "authgate", "tokens.json")
+
+	legacyStore := &fileTokenStore{path: legacy}
+	if err := legacyStore.Put("client-a", &TokenStorage{
+		AccessToken: "access",
+		ExpiresAt:   time.Now().Add(time.Hour),
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(legacy+".journal", []byte("[]"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := migrateLegacyTokenFile(legacy, target); err != nil {
+		t.Fatalf("migrateLegacyTokenFile() error: %v", err)
+	}
+
+	got, err := (&fileTokenStore{path: target}).Get("client-a")
+	if err != nil || got.AccessToken != "access" {
+		t.Errorf("Get() from migrated file = %v, %v", got, err)
+	}
+	for _, path := range []string{legacy, legacy + ".journal"} {
+		if _, err := os.Stat(path); !errors.Is(err, os.ErrNotExist) {
+			t.Errorf("%s still exists after migration", path)
+		}
+	}
+	if _, err := os.Stat(target + ".journal"); err != nil {
+		t.Errorf("journal was not migrated: %v", err)
+	}
+	info, err := os.Stat(filepath.Dir(target))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Mode().Perm() != 0o700 {
+		t.Errorf("token directory mode = %v, want 0700", info.Mode().Perm())
+	}
+
+	// A legacy file in another working directory is merged into the existing
+	// target, without overwriting the newer entries there.
+	other := filepath.Join(t.TempDir(), ".authgate-tokens.json")
+	otherStore := &fileTokenStore{path: other}
+	for key, token := range map[string]string{"client-a": "stale", "client-b": "other"} {
+		if err := otherStore.Put(key, &TokenStorage{AccessToken: token}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	rotated := []journalEntry{{RotatedAt: time.Now(), ClientID: "client-b", RefreshToken: "r2"}}
+	if data, err := json.Marshal(rotated); err != nil {
+		t.Fatal(err)
+	} else if err := os.WriteFile(other+".journal", data, 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := migrateLegacyTokenFile(other, target); err != nil {
+		t.Fatalf("migrateLegacyTokenFile() into existing target error: %v", err)
+	}
+	targetStore := &fileTokenStore{path: target}
+	if got, err := targetStore.Get("client-a"); err != nil || got.AccessToken != "access" {
+		t.Errorf("Get(client-a) after merge = %v, %v; want the target's entry", got, err)
+	}
+	if got, err := targetStore.Get("client-b"); err != nil || got.AccessToken != "other" {
+		t.Errorf("Get(client-b) after merge = %v, %v; want the legacy entry", got, err)
+	}
+	entries, err := readRefreshJournal(target + ".journal")
+	if err != nil || len(entries) != 1 || entries[0].RefreshToken != "r2" {
+		t.Errorf("merged journal = %+v, %v", entries, err)
+	}
+	for _, path := range []string{other, other + ".journal"} {
+		if _, err := os.Stat(path); !errors.Is(err, os.ErrNotExist) {
+			t.Errorf("%s still exists after merge", path)
+		}
+	}
+}
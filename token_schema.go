@@ -0,0 +1,212 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+)
+
+// tokenFileVersion is the TokenStorageMap layout written by this build.
+//
+//	0: unversioned (earlier releases)
+//	1: "version" field; entries carry server_url
+const tokenFileVersion = 1
+
+// tokenFileMigrations[v] upgrades a version v document to version v+1. They
+// work on raw JSON so that a migration never depends on the current shape of
+// TokenStorage.
+var tokenFileMigrations = []func(doc map[string]json.RawMessage) error{
+	migrateTokenFileV0,
+}
+
+// ErrTokenFileCorrupt is returned (wrapped) when the token file cannot be
+// parsed. Such a file is never overwritten; it is moved aside first (see
+// repair).
+var ErrTokenFileCorrupt = errors.New("token file cannot be parsed")
+
+// ErrTokenFileTooNew is returned (wrapped) when the token file was written by
+// a newer release with a layout this build does not know.
+var ErrTokenFileTooNew = errors.New("token file was written by a newer version")
+
+// decodeTokenFile parses a plaintext token file, upgrading older layouts to
+// tokenFileVersion. An empty file (e.g. created with touch) holds no tokens.
+func decodeTokenFile(data []byte) (*TokenStorageMap, error) {
+	if len(bytes.TrimSpace(data)) == 0 {
+		return &TokenStorageMap{Tokens: make(map[string]*TokenStorage)}, nil
+	}
+
+	var doc map[string]json.RawMessage
+	if err := json.Unmarshal(data, &doc); err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrTokenFileCorrupt, err)
+	}
+	if doc == nil {
+		return nil, fmt.Errorf("%w: not a JSON object", ErrTokenFileCorrupt)
+	}
+
+	version := 0
+	if raw, ok := doc["version"]; ok {
+		if err := json.Unmarshal(raw, &version); err != nil || version < 0 {
+			return nil, fmt.Errorf("%w: invalid version %s", ErrTokenFileCorrupt, raw)
+		}
+	}
+	if version > tokenFileVersion {
+		return nil, fmt.Errorf(
+			"%w (version %d, this build supports up to %d); upgrade authgate-cli",
+			ErrTokenFileTooNew,
+			version,
+			tokenFileVersion,
+		)
+	}
+
+	for v := version; v < tokenFileVersion; v++ {
+		if err := tokenFileMigrations[v](doc); err != nil {
+			return nil, fmt.Errorf(
+				"%w: migration from version %d failed: %v",
+				ErrTokenFileCorrupt,
+				v,
+				err,
+			)
+		}
+		doc["version"] = json.RawMessage(fmt.Sprint(v + 1))
+	}
+
+	upgraded, err := json.Marshal(doc)
+	if err != nil {
+		return nil, err
+	}
+	var storageMap TokenStorageMap
+	if err := json.Unmarshal(upgraded, &storageMap); err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrTokenFileCorrupt, err)
+	}
+	if storageMap.Tokens == nil {
+		storageMap.Tokens = make(map[string]*TokenStorage)
+	}
+	return &storageMap, nil
+}
+
+// migrateTokenFileV0 drops null entries and fills in server_url from
+// server-qualified keys. Entries under a bare client ID keep their key; they
+// are re-keyed on first load (see migrateLegacyTokenKey).
+func migrateTokenFileV0(doc map[string]json.RawMessage) error {
+	tokens := map[string]map[string]json.RawMessage{}
+	if raw, ok := doc["tokens"]; ok && string(raw) != "null" {
+		if err := json.Unmarshal(raw, &tokens); err != nil {
+			return err
+		}
+	}
+	for key, entry := range tokens {
+		if entry == nil {
+			delete(tokens, key)
+			continue
+		}
+		if server, _, _ := splitTokenStoreKey(key); server != "" && entry["server_url"] == nil {
+			serverJSON, err := json.Marshal(server)
+			if err != nil {
+				return err
+			}
+			entry["server_url"] = serverJSON
+		}
+	}
+	raw, err := json.Marshal(tokens)
+	if err != nil {
+		return err
+	}
+	doc["tokens"] = raw
+	return nil
+}
+
+// repair moves an unparsable token file to a timestamped .corrupt
+// backup and writes a fresh file with every entry that could still be
+// decoded. It returns the backup path ("" when the file was fine) and the
+// number of entries recovered.
+func (s *fileTokenStore) repair() (backup string, recovered int, err error) {
+	lock, err := acquireFileLock(context.Background(), s.path)
+	if err != nil {
+		return "", 0, fmt.Errorf("failed to acquire lock: %w", err)
+	}
+	defer func() { _ = lock.release() }()
+	return s.repairLocked()
+}
+
+// repairLocked is repair for a caller that holds the lock.
+func (s *fileTokenStore) repairLocked() (backup string, recovered int, err error) {
+	data, err := os.ReadFile(s.path)
+	if err != nil {
+		return "", 0, err
+	}
+	plain, _, err := s.enc.decode(data)
+	if err != nil {
+		// A file we cannot decrypt is not corrupt, just not ours to read.
+		return "", 0, err
+	}
+	if _, err := decodeTokenFile(plain); !errors.Is(err, ErrTokenFileCorrupt) {
+		return "", 0, err
+	}
+
+	salvaged := salvageTokenEntries(plain)
+	backup = s.path + ".corrupt-" + time.Now().UTC().Format("20060102T150405Z")
+	if err := os.Rename(s.path, backup); err != nil {
+		return "", 0, fmt.Errorf("failed to back up token file: %w", err)
+	}
+
+	out, err := json.MarshalIndent(
+		TokenStorageMap{Version: tokenFileVersion, Tokens: salvaged},
+		"",
+		"  ",
+	)
+	if err != nil {
+		return backup, 0, err
+	}
+	if out, err = s.enc.encode(out); err != nil {
+		return backup, 0, fmt.Errorf("failed to encrypt token file: %w", err)
+	}
+	return backup, len(salvaged), writeFileAtomic(s.path, out, 0o600)
+}
+
+// recoverLocked repairs an unparsable token file (see repair), warning on
+// stderr, and loads the result, so that a damaged file costs the entries that
+// no longer decode rather than failing every command. The caller holds the
+// lock.
+func (s *fileTokenStore) recoverLocked() (*TokenStorageMap, bool, error) {
+	backup, recovered, err := s.repairLocked()
+	if err != nil {
+		return nil, false, fmt.Errorf("failed to recover damaged token file %s: %w", s.path, err)
+	}
+	if backup != "" {
+		fmt.Fprintf(
+			os.Stderr,
+			"Warning: Token file %s was damaged; moved it to %s and kept %d entries\n",
+			s.path,
+			backup,
+			recovered,
+		)
+	}
+	return s.load()
+}
+
+// salvageTokenEntries returns the entries of a damaged token file that still
+// decode on their own. It returns an empty map when the file is not even
+// valid JSON.
+func salvageTokenEntries(data []byte) map[string]*TokenStorage {
+	salvaged := make(map[string]*TokenStorage)
+	var doc struct {
+		Tokens map[string]json.RawMessage `json:"tokens"`
+	}
+	if err := json.Unmarshal(data, &doc); err != nil {
+		return salvaged
+	}
+	for key, raw := range doc.Tokens {
+		var storage TokenStorage
+		if err := json.Unmarshal(raw, &storage); err != nil ||
+			strings.TrimSpace(storage.AccessToken+storage.RefreshToken) == "" {
+			continue
+		}
+		salvaged[key] = &storage
+	}
+	return salvaged
+}
@@ -0,0 +1,140 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestDecodeTokenFile_MigratesUnversioned(t *testing.T) {
+	data := []byte(`{"tokens": {
+		"https://auth.example.com|client-a": {"access_token": "a", "client_id": "client-a"},
+		"client-b": {"access_token": "b", "client_id": "client-b"},
+		"client-c": null
+	}}`)
+
+	storageMap, err := decodeTokenFile(data)
+	if err != nil {
+		t.Fatalf("decodeTokenFile() error: %v", err)
+	}
+	if storageMap.Version != tokenFileVersion {
+		t.Errorf("Version = %d, want %d", storageMap.Version, tokenFileVersion)
+	}
+	if len(storageMap.Tokens) != 2 {
+		t.Errorf("got %d entries, want 2 (null entry dropped)", len(storageMap.Tokens))
+	}
+	if got := storageMap.Tokens["https://auth.example.com|client-a"].ServerURL; got !=
+		"https://auth.example.com" {
+		t.Errorf("ServerURL = %q", got)
+	}
+	if got := storageMap.Tokens["client-b"].ServerURL; got != "" {
+		t.Errorf("legacy entry ServerURL = %q, want empty", got)
+	}
+}
+
+func TestDecodeTokenFile_Errors(t *testing.T) {
+	tests := []struct {
+		name string
+		data string
+		want error
+	}{
+		{"truncated", `{"tokens": {"a": {`, ErrTokenFileCorrupt},
+		{"not an object", `[1, 2]`, ErrTokenFileCorrupt},
+		{"bad version", `{"version": "one", "tokens": {}}`, ErrTokenFileCorrupt},
+		{"bad entry", `{"version": 1, "tokens": {"a": "nope"}}`, ErrTokenFileCorrupt},
+		{"newer version", `{"version": 99, "tokens": {}}`, ErrTokenFileTooNew},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := decodeTokenFile([]byte(tt.data)); !errors.Is(err, tt.want) {
+				t.Errorf("decodeTokenFile() error = %v, want %v", err, tt.want)
+			}
+		})
+	}
+
+	if m, err := decodeTokenFile([]byte("\n")); err != nil || len(m.Tokens) != 0 {
+		t.Errorf("decodeTokenFile(empty) = %v, %v", m, err)
+	}
+}
+
+func TestTokenFileMigrations_CoverVersion(t *testing.T) {
+	if len(tokenFileMigrations) != tokenFileVersion {
+		t.Errorf("%d migrations for version %d", len(tokenFileMigrations), tokenFileVersion)
+	}
+}
+
+func TestFileTokenStore_RecoversCorruptFile(t *testing.T) {
+	for _, op := range []string{"Put", "Get"} {
+		t.Run(op, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "tokens.json")
+			corrupt := []byte(`{"version": 1, "tokens": {"keep": {"access_token": "x"`)
+			if err := os.WriteFile(path, corrupt, 0o600); err != nil {
+				t.Fatal(err)
+			}
+			store := &fileTokenStore{path: path}
+
+			if op == "Put" {
+				if err := store.Put("new", &TokenStorage{AccessToken: "new"}); err != nil {
+					t.Fatalf("Put() error: %v", err)
+				}
+				if got, err := store.Get("new"); err != nil || got.AccessToken != "new" {
+					t.Errorf("Get(new) = %+v, %v", got, err)
+				}
+			} else if _, err := store.Get("keep"); !errors.Is(err, ErrTokenNotFound) {
+				t.Errorf("Get(keep) error = %v, want ErrTokenNotFound", err)
+			}
+
+			backups, _ := filepath.Glob(path + ".corrupt-*")
+			if len(backups) != 1 {
+				t.Fatalf("backups = %v, want one", backups)
+			}
+			if data, _ := os.ReadFile(backups[0]); string(data) != string(corrupt) {
+				t.Errorf("backup = %q, want the corrupt file", data)
+			}
+		})
+	}
+}
+
+func TestFileTokenStore_Repair(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "tokens.json")
+	damaged := []byte(`{"version": 1, "tokens": {
+		"good": {"access_token": "access", "refresh_token": "refresh"},
+		"bad": {"expires_at": "not a time"}
+	}}`)
+	if err := os.WriteFile(path, damaged, 0o600); err != nil {
+		t.Fatal(err)
+	}
+	store := &fileTokenStore{path: path}
+
+	backup, recovered, err := store.repair()
+	if err != nil {
+		t.Fatalf("repair() error: %v", err)
+	}
+	if recovered != 1 {
+		t.Errorf("recovered = %d, want 1", recovered)
+	}
+	if data, err := os.ReadFile(backup); err != nil || string(data) != string(damaged) {
+		t.Errorf("backup %s = %q, %v", backup, data, err)
+	}
+	if !strings.Contains(filepath.Base(backup), "tokens.json.corrupt-") {
+		t.Errorf("backup name = %s", backup)
+	}
+
+	got, err := store.Get("good")
+	if err != nil || got.RefreshToken != "refresh" {
+		t.Errorf("Get(good) after repair = %v, %v", got, err)
+	}
+	var written TokenStorageMap
+	data, _ := os.ReadFile(path)
+	if err := json.Unmarshal(data, &written); err != nil || written.Version != tokenFileVersion {
+		t.Errorf("repaired file version = %d, %v", written.Version, err)
+	}
+
+	// A readable file is left alone.
+	if backup, _, err := store.repair(); backup != "" || err != nil {
+		t.Errorf("repair() of readable file = %q, %v", backup, err)
+	}
+}
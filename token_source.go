@@ -0,0 +1,184 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand/v2"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// refreshRetryDelay is how long a background refresher waits after a failed
+// refresh, and how often it looks for tokens while it has none.
+const refreshRetryDelay = 30 * time.Second
+
+// parseRefreshLeeway sets refreshLeeway and refreshLeewayPercent from their
+// configured values; empty values keep the defaults.
+func parseRefreshLeeway(leeway, percent string) error {
+	if leeway != "" {
+		d, err := time.ParseDuration(leeway)
+		if err != nil || d < 0 {
+			return fmt.Errorf("invalid REFRESH_LEEWAY %q: want a duration such as 60s", leeway)
+		}
+		refreshLeeway = d
+	}
+	if percent != "" {
+		p, err := strconv.Atoi(percent)
+		if err != nil || p < 0 || p > 50 {
+			return fmt.Errorf("invalid REFRESH_LEEWAY_PERCENT %q: want 0 to 50", percent)
+		}
+		refreshLeewayPercent = p
+	}
+	return nil
+}
+
+// refreshTime returns when storage should be refreshed: refreshLeeway, or
+// refreshLeewayPercent of its lifetime if that is longer, before it expires.
+// When the lifetime is known the leeway is capped at half of it, so that a
+// short-lived token is not due the moment it is issued.
+func refreshTime(storage *TokenStorage) time.Time {
+	leeway := refreshLeeway
+	if !storage.IssuedAt.IsZero() {
+		lifetime := storage.ExpiresAt.Sub(storage.IssuedAt)
+		leeway = max(leeway, lifetime*time.Duration(refreshLeewayPercent)/100)
+		leeway = min(leeway, lifetime/2)
+	}
+	return storage.ExpiresAt.Add(-leeway)
+}
+
+// refreshDue reports whether storage is within the refresh leeway of its
+// expiry. Such a token must not be handed out: it could expire in flight.
+func refreshDue(storage *TokenStorage) bool {
+	return !tokenNow(storage).Before(refreshTime(storage))
+}
+
+// refreshJitter returns a random part of the leeway window. Background
+// refreshers fire that much early so that a fleet of processes holding tokens
+// from the same login does not hit the server at the same instant.
+func refreshJitter(storage *TokenStorage) time.Duration {
+	window := storage.ExpiresAt.Sub(refreshTime(storage)) / 4
+	if window <= 0 {
+		return 0
+	}
+	return rand.N(window)
+}
+
+// -----------------------------------------------------------------------
+// TokenSource
+// -----------------------------------------------------------------------
+
+// storedTokenSource hands out tokens from the token store to long-running
+// processes (the token agent and the proxy). It keeps the current tokens in
+// memory, refreshes them once refreshDue, and never starts an interactive
+// flow: after a logout it waits for tokens from a new login to appear in the
+// store.
+type storedTokenSource struct {
+	diag    io.Writer // for messages of refreshes
+	mu      sync.Mutex
+	storage *TokenStorage // nil while logged out
+}
+
+func newStoredTokenSource(diag io.Writer) *storedTokenSource {
+	return &storedTokenSource{diag: diag}
+}
+
+// tokens returns the current tokens, reloading them from the store when they
+// are missing or due and refreshing them when they are due early from now.
+// It may return usable tokens together with an error when a refresh failed
+// before the access token expired.
+func (s *storedTokenSource) tokens(
+	ctx context.Context,
+	early time.Duration,
+) (*TokenStorage, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	due := func() bool {
+		return s.storage == nil || !tokenNow(s.storage).Add(early).Before(refreshTime(s.storage))
+	}
+	if due() {
+		// Another process may have logged in or refreshed in the meantime.
+		if stored, err := loadTokens(); err == nil {
+			s.storage = stored
+		}
+	}
+	if s.storage == nil {
+		return nil, ErrTokenNotFound
+	}
+	if !due() {
+		return s.storage, nil
+	}
+
+	refreshed, err := refreshStoredTokens(ctx, s.diag, s.storage)
+	if err != nil {
+		if !tokenExpired(s.storage) {
+			return s.storage, err
+		}
+		return nil, err
+	}
+	s.storage = refreshed
+	return refreshed, nil
+}
+
+// refreshRejected refreshes the tokens after a resource server rejected the
+// access token of rejected, unless they were replaced in the meantime.
+func (s *storedTokenSource) refreshRejected(
+	ctx context.Context,
+	rejected *TokenStorage,
+) (*TokenStorage, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.storage != nil && s.storage.AccessToken != rejected.AccessToken {
+		return s.storage, nil
+	}
+	refreshed, err := refreshStoredTokens(ctx, s.diag, rejected)
+	if err != nil {
+		return nil, err
+	}
+	s.storage = refreshed
+	return refreshed, nil
+}
+
+// peek returns the current tokens without loading or refreshing.
+func (s *storedTokenSource) peek() *TokenStorage {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.storage
+}
+
+// reset forgets the current tokens, e.g. after a logout.
+func (s *storedTokenSource) reset() {
+	s.mu.Lock()
+	s.storage = nil
+	s.mu.Unlock()
+}
+
+// refreshLoop refreshes the tokens in the background at the leeway point,
+// with jitter, until ctx is done. While there are no tokens, or after a
+// failed refresh, it retries every refreshRetryDelay.
+func (s *storedTokenSource) refreshLoop(ctx context.Context) {
+	failed := false
+	for {
+		wait, early := refreshRetryDelay, time.Duration(0)
+		if storage := s.peek(); storage != nil && !failed {
+			early = refreshJitter(storage)
+			wait = max(refreshTime(storage).Sub(tokenNow(storage))-early, 0)
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(wait):
+		}
+
+		_, err := s.tokens(ctx, early)
+		failed = err != nil
+		if failed && !errors.Is(err, ErrTokenNotFound) && ctx.Err() == nil {
+			fmt.Fprintf(s.diag, "Warning: Background refresh failed: %v\n", err)
+		}
+	}
+}
@@ -0,0 +1,125 @@
+package main
+
+import (
+	"context"
+	"io"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func setRefreshLeeway(t *testing.T, leeway time.Duration, percent int) {
+	t.Helper()
+	origLeeway, origPercent := refreshLeeway, refreshLeewayPercent
+	t.Cleanup(func() { refreshLeeway, refreshLeewayPercent = origLeeway, origPercent })
+	refreshLeeway, refreshLeewayPercent = leeway, percent
+}
+
+func TestRefreshTime(t *testing.T) {
+	setRefreshLeeway(t, time.Minute, 10)
+	issued := time.Date(2026, 1, 1, 12, 0, 0, 0, time.UTC)
+
+	tests := []struct {
+		name     string
+		lifetime time.Duration
+		issued   bool
+		want     time.Duration // before expiry
+	}{
+		{"fixed leeway dominates", 5 * time.Minute, true, time.Minute},
+		{"percentage dominates", 2 * time.Hour, true, 12 * time.Minute},
+		{"capped at half the lifetime", time.Minute, true, 30 * time.Second},
+		{"unknown lifetime", 2 * time.Hour, false, time.Minute},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			storage := &TokenStorage{ExpiresAt: issued.Add(tt.lifetime)}
+			if tt.issued {
+				storage.IssuedAt = issued
+			}
+			if got := storage.ExpiresAt.Sub(refreshTime(storage)); got != tt.want {
+				t.Errorf("leeway = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestRefreshDue(t *testing.T) {
+	setRefreshLeeway(t, time.Minute, 10)
+
+	almostExpired := &TokenStorage{ExpiresAt: time.Now().Add(2 * time.Second)}
+	if !refreshDue(almostExpired) {
+		t.Error("token with 2s left is not due")
+	}
+	fresh := &TokenStorage{IssuedAt: time.Now(), ExpiresAt: time.Now().Add(time.Hour)}
+	if refreshDue(fresh) {
+		t.Error("fresh token is due")
+	}
+
+	for range 100 {
+		jitter := refreshJitter(fresh)
+		if jitter < 0 || jitter >= fresh.ExpiresAt.Sub(refreshTime(fresh)) {
+			t.Fatalf("refreshJitter() = %v outside the leeway window", jitter)
+		}
+	}
+}
+
+func TestParseRefreshLeeway(t *testing.T) {
+	setRefreshLeeway(t, time.Minute, 10)
+
+	if err := parseRefreshLeeway("90s", "20"); err != nil {
+		t.Fatal(err)
+	}
+	if refreshLeeway != 90*time.Second || refreshLeewayPercent != 20 {
+		t.Errorf("leeway = %v, %d%%", refreshLeeway, refreshLeewayPercent)
+	}
+	for _, tt := range []struct{ leeway, percent string }{
+		{"soon", ""}, {"-1s", ""}, {"", "x"}, {"", "80"},
+	} {
+		if err := parseRefreshLeeway(tt.leeway, tt.percent); err == nil {
+			t.Errorf("parseRefreshLeeway(%q, %q) accepted", tt.leeway, tt.percent)
+		}
+	}
+}
+
+func TestStoredTokenSource_RefreshesWithinLeeway(t *testing.T) {
+	origStore, origFile := tokenStore, tokenFile
+	origServer, origClient := serverURL, clientID
+	t.Cleanup(func() {
+		tokenStore, tokenFile = origStore, origFile
+		serverURL, clientID = origServer, origClient
+	})
+	setRefreshLeeway(t, time.Minute, 10)
+
+	var refreshes atomic.Int32
+	authServer := refreshServer(t, &refreshes)
+	tokenStore = newMemoryTokenStore()
+	tokenFile = filepath.Join(t.TempDir(), "tokens.json")
+	serverURL = authServer.URL
+	clientID = "transport-client"
+
+	// Expires within the leeway, so the first request refreshes.
+	if err := saveTokens(&TokenStorage{
+		AccessToken:  "about-to-expire",
+		RefreshToken: "refresh-token",
+		TokenType:    "Bearer",
+		IssuedAt:     time.Now().Add(-time.Hour),
+		ExpiresAt:    time.Now().Add(10 * time.Second),
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	source := newStoredTokenSource(io.Discard)
+	for range 2 {
+		storage, err := source.tokens(context.Background(), 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if storage.AccessToken != "refreshed-access-token-1" {
+			t.Errorf("access token = %q, want the refreshed one", storage.AccessToken)
+		}
+	}
+	if n := refreshes.Load(); n != 1 {
+		t.Errorf("refreshed %d times, want 1", n)
+	}
+}
@@ -0,0 +1,305 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+)
+
+// TokenStore persists tokens by key. Keys are opaque to the store; the CLI
+// uses tokenStoreKey (server URL and client ID).
+type TokenStore interface {
+	// Get returns the tokens stored under key, or an error wrapping
+	// ErrTokenNotFound when there are none.
+	Get(key string) (*TokenStorage, error)
+	// Put stores tokens under key, replacing any previous entry.
+	Put(key string, storage *TokenStorage) error
+	// Delete removes the entry for key. Deleting a missing key is not an error.
+	Delete(key string) error
+	// List returns all keys in sorted order.
+	List() ([]string, error)
+}
+
+// ErrTokenNotFound is returned (wrapped) by TokenStore.Get for unknown keys.
+var ErrTokenNotFound = errors.New("no tokens found")
+
+// Values accepted by --token-store / TOKEN_STORE.
+const (
+	tokenStoreFile    = "file"
+	tokenStoreMemory  = "memory"
+	tokenStoreExec    = "exec"
+	tokenStoreKeyring = "keyring"
+)
+
+// tokenStore is the configured backend. When nil, the JSON file at tokenFile
+// is used.
+var tokenStore TokenStore
+
+// activeTokenStore returns the configured token store.
+func activeTokenStore() TokenStore {
+	if tokenStore != nil {
+		return tokenStore
+	}
+	return &fileTokenStore{path: tokenFile, enc: tokenCipher}
+}
+
+// tokenFileStore returns the token file behind the active store, or nil when
+// tokens are not kept in a file.
+func tokenFileStore() *fileTokenStore {
+	switch s := activeTokenStore().(type) {
+	case *fileTokenStore:
+		return s
+	case *keyringTokenStore:
+		return s.cache
+	default:
+		return nil
+	}
+}
+
+// newTokenStore creates the backend selected by kind. command is only used
+// by the exec backend. The keyring backend falls back to the file store when
+// no Secret Service is reachable.
+func newTokenStore(kind string, command []string) (TokenStore, error) {
+	switch kind {
+	case tokenStoreFile:
+		return nil, nil // resolved lazily against tokenFile by activeTokenStore
+	case tokenStoreMemory:
+		return newMemoryTokenStore(), nil
+	case tokenStoreExec:
+		if len(command) == 0 {
+			return nil, fmt.Errorf("TOKEN_STORE=exec requires TOKEN_STORE_COMMAND")
+		}
+		return &execTokenStore{command: command}, nil
+	case tokenStoreKeyring:
+		cache := &fileTokenStore{path: tokenFile, enc: tokenCipher}
+		store, err := newKeyringTokenStore(cache)
+		if err != nil {
+			fmt.Fprintf(
+				os.Stderr,
+				"Warning: Secret Service unavailable (%v); storing tokens in %s\n",
+				err,
+				tokenFile,
+			)
+			return nil, nil
+		}
+		return store, nil
+	default:
+		return nil, fmt.Errorf(
+			"unknown token store %q (must be file, memory, exec or keyring)",
+			kind,
+		)
+	}
+}
+
+// -----------------------------------------------------------------------
+// File store
+// -----------------------------------------------------------------------
+
+// fileTokenStore keeps all entries in one JSON file (TokenStorageMap).
+// Writes are serialized with a lock file and replace the file atomically.
+// When enc is set the file is encrypted; a plaintext file is read as usual and
+// rewritten encrypted on first access.
+type fileTokenStore struct {
+	path string
+	enc  *tokenEncryption
+}
+
+func (s *fileTokenStore) String() string { return s.path }
+
+// readMap reads the token file under a shared lock, so that it never sees a
+// write in progress.
+func (s *fileTokenStore) readMap() (*TokenStorageMap, error) {
+	if _, err := os.Stat(s.path); err != nil {
+		return nil, err
+	}
+	lock, err := acquireSharedFileLock(context.Background(), s.path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to acquire lock: %w", err)
+	}
+	storageMap, encrypted, err := s.load()
+	_ = lock.release()
+	if errors.Is(err, ErrTokenFileCorrupt) {
+		storageMap, encrypted, err = s.recover()
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if s.enc != nil && !encrypted {
+		// Migrate: rewriting the unchanged map encrypts it.
+		if err := s.update(func(map[string]*TokenStorage) {}); err != nil {
+			fmt.Fprintf(os.Stderr, "Warning: Failed to encrypt token file %s: %v\n", s.path, err)
+		}
+	}
+	return storageMap, nil
+}
+
+// recover takes the exclusive lock and recovers a damaged token file.
+func (s *fileTokenStore) recover() (*TokenStorageMap, bool, error) {
+	lock, err := acquireFileLock(context.Background(), s.path)
+	if err != nil {
+		return nil, false, fmt.Errorf("failed to acquire lock: %w", err)
+	}
+	defer func() { _ = lock.release() }()
+	return s.recoverLocked()
+}
+
+// load reads and decodes the token file. The caller holds the lock.
+func (s *fileTokenStore) load() (storageMap *TokenStorageMap, encrypted bool, err error) {
+	data, err := os.ReadFile(s.path)
+	if err != nil {
+		return nil, false, err
+	}
+	plain, encrypted, err := s.enc.decode(data)
+	if err != nil {
+		return nil, false, err
+	}
+	if storageMap, err = decodeTokenFile(plain); err != nil {
+		return nil, false, s.decodeError(err)
+	}
+	return storageMap, encrypted, nil
+}
+
+// decodeError adds the file path.
+func (s *fileTokenStore) decodeError(err error) error {
+	return fmt.Errorf("%s: %w", s.path, err)
+}
+
+func (s *fileTokenStore) Get(key string) (*TokenStorage, error) {
+	storageMap, err := s.readMap()
+	if os.IsNotExist(err) {
+		return nil, fmt.Errorf("%w: %s does not exist", ErrTokenNotFound, s.path)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if storage, ok := storageMap.Tokens[key]; ok {
+		return storage, nil
+	}
+	return nil, fmt.Errorf("%w for %s", ErrTokenNotFound, key)
+}
+
+func (s *fileTokenStore) Put(key string, storage *TokenStorage) error {
+	return s.update(func(tokens map[string]*TokenStorage) {
+		tokens[key] = storage
+	})
+}
+
+func (s *fileTokenStore) Delete(key string) error {
+	if _, err := os.Stat(s.path); os.IsNotExist(err) {
+		return nil
+	}
+	return s.update(func(tokens map[string]*TokenStorage) {
+		delete(tokens, key)
+	})
+}
+
+func (s *fileTokenStore) List() ([]string, error) {
+	storageMap, err := s.readMap()
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return sortedKeys(storageMap.Tokens), nil
+}
+
+// update applies fn to the stored map under the file lock and writes the
+// result back atomically.
+func (s *fileTokenStore) update(fn func(map[string]*TokenStorage)) error {
+	if err := os.MkdirAll(filepath.Dir(s.path), 0o700); err != nil {
+		return fmt.Errorf("failed to create token directory: %w", err)
+	}
+	lock, err := acquireFileLock(context.Background(), s.path)
+	if err != nil {
+		return fmt.Errorf("failed to acquire lock: %w", err)
+	}
+	defer func() { _ = lock.release() }()
+
+	// Never replace a file we cannot decrypt or parse: that would destroy
+	// every other client's tokens. An unparsable one is backed up first.
+	storageMap, _, err := s.load()
+	if errors.Is(err, ErrTokenFileCorrupt) {
+		storageMap, _, err = s.recoverLocked()
+	}
+	switch {
+	case os.IsNotExist(err):
+		storageMap = &TokenStorageMap{Tokens: make(map[string]*TokenStorage)}
+	case err != nil:
+		return err
+	}
+
+	fn(storageMap.Tokens)
+	storageMap.Version = tokenFileVersion
+
+	data, err := json.MarshalIndent(storageMap, "", "  ")
+	if err != nil {
+		return err
+	}
+	if data, err = s.enc.encode(data); err != nil {
+		return fmt.Errorf("failed to encrypt token file: %w", err)
+	}
+	return writeFileAtomic(s.path, data, 0o600)
+}
+
+// -----------------------------------------------------------------------
+// Memory store
+// -----------------------------------------------------------------------
+
+// memoryTokenStore keeps tokens in process memory only. It is meant for tests
+// and for ephemeral use where nothing may touch the disk.
+type memoryTokenStore struct {
+	mu     sync.Mutex
+	tokens map[string]TokenStorage
+}
+
+func newMemoryTokenStore() *memoryTokenStore {
+	return &memoryTokenStore{tokens: make(map[string]TokenStorage)}
+}
+
+func (s *memoryTokenStore) String() string { return "memory (not persisted)" }
+
+func (s *memoryTokenStore) Get(key string) (*TokenStorage, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	storage, ok := s.tokens[key]
+	if !ok {
+		return nil, fmt.Errorf("%w for %s", ErrTokenNotFound, key)
+	}
+	return &storage, nil
+}
+
+func (s *memoryTokenStore) Put(key string, storage *TokenStorage) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.tokens[key] = *storage
+	return nil
+}
+
+func (s *memoryTokenStore) Delete(key string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.tokens, key)
+	return nil
+}
+
+func (s *memoryTokenStore) List() ([]string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return sortedKeys(s.tokens), nil
+}
+
+func sortedKeys[V any](m map[string]V) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
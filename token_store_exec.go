@@ -0,0 +1,111 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"os/exec"
+	"strings"
+	"time"
+)
+
+// execStoreTimeout bounds a single invocation of the token helper.
+const execStoreTimeout = 30 * time.Second
+
+// execStoreRequest is written as JSON to the token helper's stdin.
+type execStoreRequest struct {
+	Action string        `json:"action"` // "get", "put", "delete" or "list"
+	Key    string        `json:"key,omitempty"`
+	Token  *TokenStorage `json:"token,omitempty"` // only for "put"
+}
+
+// execStoreResponse is read as JSON from the token helper's stdout. An empty
+// stdout is an empty response. Error "not_found" means the key is unknown;
+// any other non-empty Error fails the operation.
+type execStoreResponse struct {
+	Token *TokenStorage `json:"token,omitempty"`
+	Keys  []string      `json:"keys,omitempty"`
+	Error string        `json:"error,omitempty"`
+}
+
+// execTokenStore delegates storage to an external helper binary, e.g. a
+// bridge to a team's secret manager. The helper is started once per
+// operation and speaks the execStoreRequest / execStoreResponse protocol.
+type execTokenStore struct {
+	command []string
+}
+
+func (s *execTokenStore) String() string {
+	return "token helper " + strings.Join(s.command, " ")
+}
+
+func (s *execTokenStore) Get(key string) (*TokenStorage, error) {
+	resp, err := s.call(execStoreRequest{Action: "get", Key: key})
+	if err != nil {
+		return nil, err
+	}
+	if resp.Token == nil {
+		return nil, fmt.Errorf("%w for %s", ErrTokenNotFound, key)
+	}
+	return resp.Token, nil
+}
+
+func (s *execTokenStore) Put(key string, storage *TokenStorage) error {
+	_, err := s.call(execStoreRequest{Action: "put", Key: key, Token: storage})
+	return err
+}
+
+func (s *execTokenStore) Delete(key string) error {
+	_, err := s.call(execStoreRequest{Action: "delete", Key: key})
+	return err
+}
+
+func (s *execTokenStore) List() ([]string, error) {
+	resp, err := s.call(execStoreRequest{Action: "list"})
+	if err != nil {
+		return nil, err
+	}
+	return resp.Keys, nil
+}
+
+func (s *execTokenStore) call(req execStoreRequest) (*execStoreResponse, error) {
+	input, err := json.Marshal(req)
+	if err != nil {
+		return nil, err
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), execStoreTimeout)
+	defer cancel()
+
+	var stdout, stderr bytes.Buffer
+	cmd := exec.CommandContext(ctx, s.command[0], s.command[1:]...) //nolint:gosec
+	cmd.Stdin = bytes.NewReader(input)
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+
+	if err := cmd.Run(); err != nil {
+		return nil, fmt.Errorf(
+			"token helper %q %s failed: %w: %s",
+			s.command[0],
+			req.Action,
+			err,
+			strings.TrimSpace(stderr.String()),
+		)
+	}
+
+	var resp execStoreResponse
+	if out := bytes.TrimSpace(stdout.Bytes()); len(out) > 0 {
+		if err := json.Unmarshal(out, &resp); err != nil {
+			return nil, fmt.Errorf("failed to parse token helper response: %w", err)
+		}
+	}
+	switch resp.Error {
+	case "":
+		return &resp, nil
+	case "not_found":
+		return nil, fmt.Errorf("%w for %s", ErrTokenNotFound, req.Key)
+	default:
+		return nil, fmt.Errorf("token helper %s failed: %s", req.Action, resp.Error)
+	}
+}
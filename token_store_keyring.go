@@ -0,0 +1,354 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/godbus/dbus/v5"
+)
+
+// freedesktop Secret Service API (https://specifications.freedesktop.org/secret-service/).
+const (
+	secretServiceName     = "org.freedesktop.secrets"
+	secretServicePath     = dbus.ObjectPath("/org/freedesktop/secrets")
+	secretCollectionPath  = dbus.ObjectPath("/org/freedesktop/secrets/aliases/default")
+	secretServiceIface    = "org.freedesktop.Secret.Service"
+	secretCollectionIface = "org.freedesktop.Secret.Collection"
+	secretItemIface       = "org.freedesktop.Secret.Item"
+	secretPromptIface     = "org.freedesktop.Secret.Prompt"
+
+	// noPrompt is returned instead of a prompt path when none is needed.
+	noPrompt = dbus.ObjectPath("/")
+
+	keyringApplication   = "authgate-cli"
+	keyringPromptTimeout = 2 * time.Minute
+)
+
+// secretServiceSecret is the Secret struct of the Secret Service API (oayays).
+type secretServiceSecret struct {
+	Session     dbus.ObjectPath
+	Parameters  []byte
+	Value       []byte
+	ContentType string
+}
+
+// keyringTokenStore keeps refresh tokens in the desktop keyring through the
+// Secret Service D-Bus API, with the server URL and client ID of the store key
+// as item attributes. Everything else, including the short-lived access token,
+// is cached in a token file with the refresh token removed, so refresh tokens
+// never touch the disk.
+type keyringTokenStore struct {
+	cache   *fileTokenStore
+	conn    *dbus.Conn
+	session dbus.ObjectPath
+}
+
+// newKeyringTokenStore connects to the Secret Service on the session bus. It
+// fails when no session bus or Secret Service is reachable.
+func newKeyringTokenStore(cache *fileTokenStore) (*keyringTokenStore, error) {
+	conn, err := dbus.ConnectSessionBus()
+	if err != nil {
+		return nil, err
+	}
+
+	// The "plain" algorithm sends secrets unencrypted over the session bus,
+	// which only the current user can connect to.
+	var output dbus.Variant
+	var session dbus.ObjectPath
+	err = conn.Object(secretServiceName, secretServicePath).
+		Call(secretServiceIface+".OpenSession", 0, "plain", dbus.MakeVariant("")).
+		Store(&output, &session)
+	if err != nil {
+		_ = conn.Close()
+		return nil, err
+	}
+
+	return &keyringTokenStore{cache: cache, conn: conn, session: session}, nil
+}
+
+func (s *keyringTokenStore) String() string {
+	return "Secret Service keyring (access tokens cached in " + s.cache.path + ")"
+}
+
+func (s *keyringTokenStore) Get(key string) (*TokenStorage, error) {
+	refreshToken, err := s.readSecret(key)
+	if err != nil {
+		return nil, err
+	}
+
+	storage, err := s.cache.Get(key)
+	if errors.Is(err, ErrTokenNotFound) && refreshToken != "" {
+		// Only the refresh token survived (e.g. the cache file was removed):
+		// return it as an expired entry so that the caller refreshes.
+		server, client, account := splitTokenStoreKey(key)
+		storage, err = &TokenStorage{ClientID: client, ServerURL: server, Account: account}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if refreshToken == "" && storage.RefreshToken != "" {
+		// The entry was written by the file store before switching to the
+		// keyring: move its refresh token into the keyring.
+		if err := s.Put(key, storage); err != nil {
+			return nil, fmt.Errorf("failed to move the refresh token into the keyring: %w", err)
+		}
+		return storage, nil
+	}
+	storage.RefreshToken = refreshToken
+	return storage, nil
+}
+
+func (s *keyringTokenStore) Put(key string, storage *TokenStorage) error {
+	if storage.RefreshToken == "" {
+		if err := s.deleteSecret(key); err != nil {
+			return err
+		}
+	} else if err := s.writeSecret(key, storage.RefreshToken); err != nil {
+		return err
+	}
+
+	cached := *storage
+	cached.RefreshToken = ""
+	return s.cache.Put(key, &cached)
+}
+
+func (s *keyringTokenStore) Delete(key string) error {
+	if err := s.deleteSecret(key); err != nil {
+		return err
+	}
+	return s.cache.Delete(key)
+}
+
+func (s *keyringTokenStore) List() ([]string, error) {
+	keys := make(map[string]struct{})
+
+	cached, err := s.cache.List()
+	if err != nil {
+		return nil, err
+	}
+	for _, k := range cached {
+		keys[k] = struct{}{}
+	}
+
+	items, err := s.search(map[string]string{"application": keyringApplication})
+	if err != nil {
+		return nil, err
+	}
+	for _, item := range items {
+		attrs, err := s.itemAttributes(item)
+		if err != nil {
+			return nil, err
+		}
+		if attrs["client_id"] == "" {
+			continue
+		}
+		if attrs["server"] == "" {
+			keys[attrs["client_id"]] = struct{}{}
+		} else {
+			keys[tokenStoreKey(attrs["server"], attrs["client_id"], attrs["account"])] = struct{}{}
+		}
+	}
+	return sortedKeys(keys), nil
+}
+
+func (s *keyringTokenStore) attributes(key string) map[string]string {
+	server, client, account := splitTokenStoreKey(key)
+	return map[string]string{
+		"application": keyringApplication,
+		"server":      server,
+		"client_id":   client,
+		"account":     account,
+	}
+}
+
+func (s *keyringTokenStore) itemAttributes(item dbus.ObjectPath) (map[string]string, error) {
+	v, err := s.conn.Object(secretServiceName, item).GetProperty(secretItemIface + ".Attributes")
+	if err != nil {
+		return nil, fmt.Errorf("failed to read keyring item attributes: %w", err)
+	}
+	attrs, _ := v.Value().(map[string]string)
+	return attrs, nil
+}
+
+// items returns the keyring items holding the refresh token for key. Items
+// written before accounts existed have no account attribute, and those written
+// before keys were qualified by server URL have no server attribute either.
+// They belong to the default account, and are re-tagged with the current
+// attributes when found.
+func (s *keyringTokenStore) items(key string) ([]dbus.ObjectPath, error) {
+	attrs := s.attributes(key)
+	items, err := s.search(attrs)
+	if err != nil || len(items) > 0 || attrs["account"] != defaultAccount {
+		return items, err
+	}
+
+	legacy, err := s.search(map[string]string{
+		"application": keyringApplication,
+		"client_id":   attrs["client_id"],
+	})
+	if err != nil {
+		return nil, err
+	}
+	for _, item := range legacy {
+		itemAttrs, err := s.itemAttributes(item)
+		if err != nil {
+			return nil, err
+		}
+		if _, ok := itemAttrs["account"]; ok {
+			continue
+		}
+		if server, ok := itemAttrs["server"]; ok && server != attrs["server"] {
+			continue
+		}
+		err = s.conn.Object(secretServiceName, item).
+			SetProperty(secretItemIface+".Attributes", dbus.MakeVariant(attrs))
+		if err != nil {
+			return nil, fmt.Errorf("failed to update keyring item attributes: %w", err)
+		}
+		items = append(items, item)
+	}
+	return items, nil
+}
+
+// readSecret returns the refresh token stored for key, or "" when there is
+// none.
+func (s *keyringTokenStore) readSecret(key string) (string, error) {
+	items, err := s.items(key)
+	if err != nil || len(items) == 0 {
+		return "", err
+	}
+
+	var secret secretServiceSecret
+	err = s.conn.Object(secretServiceName, items[0]).
+		Call(secretItemIface+".GetSecret", 0, s.session).
+		Store(&secret)
+	if err != nil {
+		return "", fmt.Errorf("failed to read keyring secret: %w", err)
+	}
+	return string(secret.Value), nil
+}
+
+func (s *keyringTokenStore) writeSecret(key, refreshToken string) error {
+	if err := s.unlock([]dbus.ObjectPath{secretCollectionPath}); err != nil {
+		return err
+	}
+
+	server, client, account := splitTokenStoreKey(key)
+	properties := map[string]dbus.Variant{
+		secretItemIface + ".Label": dbus.MakeVariant(
+			fmt.Sprintf("AuthGate refresh token (%s, %s, %s)", server, client, account),
+		),
+		secretItemIface + ".Attributes": dbus.MakeVariant(s.attributes(key)),
+	}
+	secret := secretServiceSecret{
+		Session:     s.session,
+		Parameters:  []byte{},
+		Value:       []byte(refreshToken),
+		ContentType: "text/plain",
+	}
+
+	var item, prompt dbus.ObjectPath
+	err := s.conn.Object(secretServiceName, secretCollectionPath).
+		Call(secretCollectionIface+".CreateItem", 0, properties, secret, true).
+		Store(&item, &prompt)
+	if err != nil {
+		return fmt.Errorf("failed to store refresh token in keyring: %w", err)
+	}
+	return s.prompt(prompt)
+}
+
+func (s *keyringTokenStore) deleteSecret(key string) error {
+	items, err := s.items(key)
+	if err != nil {
+		return err
+	}
+	for _, item := range items {
+		var prompt dbus.ObjectPath
+		err := s.conn.Object(secretServiceName, item).
+			Call(secretItemIface+".Delete", 0).
+			Store(&prompt)
+		if err != nil {
+			return fmt.Errorf("failed to delete keyring item: %w", err)
+		}
+		if err := s.prompt(prompt); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// search returns the items matching attrs, unlocking locked ones.
+func (s *keyringTokenStore) search(attrs map[string]string) ([]dbus.ObjectPath, error) {
+	var unlocked, locked []dbus.ObjectPath
+	err := s.conn.Object(secretServiceName, secretServicePath).
+		Call(secretServiceIface+".SearchItems", 0, attrs).
+		Store(&unlocked, &locked)
+	if err != nil {
+		return nil, fmt.Errorf("failed to search keyring: %w", err)
+	}
+	if len(locked) > 0 {
+		if err := s.unlock(locked); err != nil {
+			return nil, err
+		}
+	}
+	return append(unlocked, locked...), nil
+}
+
+// unlock unlocks objects, letting the Secret Service prompt the user if
+// necessary.
+func (s *keyringTokenStore) unlock(objects []dbus.ObjectPath) error {
+	var unlocked []dbus.ObjectPath
+	var prompt dbus.ObjectPath
+	err := s.conn.Object(secretServiceName, secretServicePath).
+		Call(secretServiceIface+".Unlock", 0, objects).
+		Store(&unlocked, &prompt)
+	if err != nil {
+		return fmt.Errorf("failed to unlock keyring: %w", err)
+	}
+	return s.prompt(prompt)
+}
+
+// prompt shows a Secret Service prompt (e.g. the keyring password dialog) and
+// waits for the user to complete it.
+func (s *keyringTokenStore) prompt(path dbus.ObjectPath) error {
+	if path == noPrompt || path == "" {
+		return nil
+	}
+
+	match := []dbus.MatchOption{
+		dbus.WithMatchObjectPath(path),
+		dbus.WithMatchInterface(secretPromptIface),
+		dbus.WithMatchMember("Completed"),
+	}
+	if err := s.conn.AddMatchSignal(match...); err != nil {
+		return fmt.Errorf("failed to watch keyring prompt: %w", err)
+	}
+	defer func() { _ = s.conn.RemoveMatchSignal(match...) }()
+
+	signals := make(chan *dbus.Signal, 1)
+	s.conn.Signal(signals)
+	defer s.conn.RemoveSignal(signals)
+
+	if err := s.conn.Object(secretServiceName, path).
+		Call(secretPromptIface+".Prompt", 0, "").Err; err != nil {
+		return fmt.Errorf("failed to show keyring prompt: %w", err)
+	}
+
+	timeout := time.NewTimer(keyringPromptTimeout)
+	defer timeout.Stop()
+	for {
+		select {
+		case sig := <-signals:
+			if sig.Path != path || sig.Name != secretPromptIface+".Completed" {
+				continue
+			}
+			if len(sig.Body) > 0 && sig.Body[0] == true {
+				return fmt.Errorf("keyring prompt was dismissed")
+			}
+			return nil
+		case <-timeout.C:
+			return fmt.Errorf("timed out waiting for keyring prompt")
+		}
+	}
+}
@@ -0,0 +1,389 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/godbus/dbus/v5"
+)
+
+// startPrivateSessionBus starts a dbus-daemon for the test and points
+// DBUS_SESSION_BUS_ADDRESS at it. The test is skipped without dbus-daemon.
+func startPrivateSessionBus(t *testing.T) string {
+	t.Helper()
+	daemon, err := exec.LookPath("dbus-daemon")
+	if err != nil {
+		t.Skip("dbus-daemon not installed")
+	}
+
+	dir := t.TempDir()
+	config := filepath.Join(dir, "session.conf")
+	err = os.WriteFile(config, []byte(`<!DOCTYPE busconfig PUBLIC
+ "-//freedesktop//DTD D-Bus Bus Configuration 1.0//EN"
+ "http://www.freedesktop.org/standards/dbus/1.0/busconfig.dtd">
+<busconfig>
+  <type>session</type>
+  <listen>unix:dir=`+dir+`</listen>
+  <auth>EXTERNAL</auth>
+  <policy context="default">
+    <allow send_destination="*" eavesdrop="true"/>
+    <allow eavesdrop="true"/>
+    <allow own="*"/>
+  </policy>
+</busconfig>`), 0o600)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cmd := exec.Command(daemon, "--config-file="+config, "--nofork", "--print-address")
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := cmd.Start(); err != nil {
+		t.Fatalf("failed to start dbus-daemon: %v", err)
+	}
+	t.Cleanup(func() {
+		_ = cmd.Process.Kill()
+		_ = cmd.Wait()
+	})
+
+	address, err := bufio.NewReader(stdout).ReadString('\n')
+	if err != nil {
+		t.Fatalf("failed to read bus address: %v", err)
+	}
+	address = strings.TrimSpace(address)
+	t.Setenv("DBUS_SESSION_BUS_ADDRESS", address)
+	return address
+}
+
+// fakeSecretService implements the parts of the Secret Service API used by
+// keyringTokenStore.
+type fakeSecretService struct {
+	conn *dbus.Conn
+
+	mu    sync.Mutex
+	next  int
+	items map[dbus.ObjectPath]*fakeSecretItem
+}
+
+type fakeSecretItem struct {
+	service *fakeSecretService
+	path    dbus.ObjectPath
+	attrs   map[string]string
+	secret  []byte
+}
+
+func startFakeSecretService(t *testing.T, address string) *fakeSecretService {
+	t.Helper()
+	conn, err := dbus.Connect(address)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = conn.Close() })
+
+	f := &fakeSecretService{conn: conn, items: make(map[dbus.ObjectPath]*fakeSecretItem)}
+	if err := conn.Export(f, secretServicePath, secretServiceIface); err != nil {
+		t.Fatal(err)
+	}
+	if err := conn.Export(f, secretCollectionPath, secretCollectionIface); err != nil {
+		t.Fatal(err)
+	}
+	reply, err := conn.RequestName(secretServiceName, dbus.NameFlagDoNotQueue)
+	if err != nil || reply != dbus.RequestNameReplyPrimaryOwner {
+		t.Fatalf("RequestName() = %v, %v", reply, err)
+	}
+	return f
+}
+
+func (f *fakeSecretService) OpenSession(
+	algorithm string,
+	_ dbus.Variant,
+) (dbus.Variant, dbus.ObjectPath, *dbus.Error) {
+	if algorithm != "plain" {
+		return dbus.Variant{}, "", dbus.MakeFailedError(fmt.Errorf("unsupported %s", algorithm))
+	}
+	return dbus.MakeVariant(""), "/org/freedesktop/secrets/session/1", nil
+}
+
+func (f *fakeSecretService) SearchItems(
+	attrs map[string]string,
+) ([]dbus.ObjectPath, []dbus.ObjectPath, *dbus.Error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	found := []dbus.ObjectPath{}
+	for path, item := range f.items {
+		if item.matches(attrs) {
+			found = append(found, path)
+		}
+	}
+	return found, []dbus.ObjectPath{}, nil
+}
+
+func (f *fakeSecretService) Unlock(
+	objects []dbus.ObjectPath,
+) ([]dbus.ObjectPath, dbus.ObjectPath, *dbus.Error) {
+	return objects, noPrompt, nil
+}
+
+func (f *fakeSecretService) CreateItem(
+	properties map[string]dbus.Variant,
+	secret secretServiceSecret,
+	replace bool,
+) (dbus.ObjectPath, dbus.ObjectPath, *dbus.Error) {
+	attrs, _ := properties[secretItemIface+".Attributes"].Value().(map[string]string)
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if replace {
+		for _, item := range f.items {
+			if item.matches(attrs) && len(item.attrs) == len(attrs) {
+				item.secret = secret.Value
+				return item.path, noPrompt, nil
+			}
+		}
+	}
+
+	f.next++
+	path := fmt.Sprintf("/org/freedesktop/secrets/collection/login/%d", f.next)
+	item := &fakeSecretItem{
+		service: f,
+		path:    dbus.ObjectPath(path),
+		attrs:   attrs,
+		secret:  secret.Value,
+	}
+	if err := f.conn.Export(item, item.path, secretItemIface); err != nil {
+		return "", "", dbus.MakeFailedError(err)
+	}
+	if err := f.conn.Export(item, item.path, "org.freedesktop.DBus.Properties"); err != nil {
+		return "", "", dbus.MakeFailedError(err)
+	}
+	f.items[item.path] = item
+	return item.path, noPrompt, nil
+}
+
+func (i *fakeSecretItem) matches(attrs map[string]string) bool {
+	for k, v := range attrs {
+		if i.attrs[k] != v {
+			return false
+		}
+	}
+	return true
+}
+
+func (i *fakeSecretItem) GetSecret(session dbus.ObjectPath) (secretServiceSecret, *dbus.Error) {
+	i.service.mu.Lock()
+	defer i.service.mu.Unlock()
+	return secretServiceSecret{
+		Session:     session,
+		Parameters:  []byte{},
+		Value:       i.secret,
+		ContentType: "text/plain",
+	}, nil
+}
+
+func (i *fakeSecretItem) Delete() (dbus.ObjectPath, *dbus.Error) {
+	i.service.mu.Lock()
+	defer i.service.mu.Unlock()
+	delete(i.service.items, i.path)
+	_ = i.service.conn.Export(nil, i.path, secretItemIface)
+	_ = i.service.conn.Export(nil, i.path, "org.freedesktop.DBus.Properties")
+	return noPrompt, nil
+}
+
+// Get implements org.freedesktop.DBus.Properties.Get for the Attributes
+// property.
+func (i *fakeSecretItem) Get(iface, property string) (dbus.Variant, *dbus.Error) {
+	if iface != secretItemIface || property != "Attributes" {
+		return dbus.Variant{}, dbus.MakeFailedError(fmt.Errorf("unknown property %s", property))
+	}
+	i.service.mu.Lock()
+	defer i.service.mu.Unlock()
+	return dbus.MakeVariant(i.attrs), nil
+}
+
+// Set implements org.freedesktop.DBus.Properties.Set for the Attributes
+// property.
+func (i *fakeSecretItem) Set(iface, property string, value dbus.Variant) *dbus.Error {
+	attrs, ok := value.Value().(map[string]string)
+	if iface != secretItemIface || property != "Attributes" || !ok {
+		return dbus.MakeFailedError(fmt.Errorf("cannot set property %s", property))
+	}
+	i.service.mu.Lock()
+	defer i.service.mu.Unlock()
+	i.attrs = attrs
+	return nil
+}
+
+func newTestKeyringStore(t *testing.T) (*keyringTokenStore, *fakeSecretService) {
+	t.Helper()
+	fake := startFakeSecretService(t, startPrivateSessionBus(t))
+	cache := &fileTokenStore{path: filepath.Join(t.TempDir(), "tokens.json")}
+	store, err := newKeyringTokenStore(cache)
+	if err != nil {
+		t.Fatalf("newKeyringTokenStore() error: %v", err)
+	}
+	t.Cleanup(func() { _ = store.conn.Close() })
+	return store, fake
+}
+
+func TestKeyringTokenStore(t *testing.T) {
+	store, _ := newTestKeyringStore(t)
+	testTokenStore(t, store)
+}
+
+func TestKeyringTokenStore_RefreshTokenOnlyInKeyring(t *testing.T) {
+	store, fake := newTestKeyringStore(t)
+	storage := &TokenStorage{
+		AccessToken:  "access-token-value",
+		RefreshToken: "refresh-token-value",
+		ExpiresAt:    time.Now().Add(time.Hour),
+		ClientID:     "client-a",
+	}
+	key := tokenStoreKey("https://auth.example.com", "client-a", defaultAccount)
+	if err := store.Put(key, storage); err != nil {
+		t.Fatalf("Put() error: %v", err)
+	}
+
+	data, err := os.ReadFile(store.cache.path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bytes.Contains(data, []byte("refresh-token-value")) {
+		t.Error("cache file contains the refresh token")
+	}
+	if !bytes.Contains(data, []byte("access-token-value")) {
+		t.Error("cache file does not contain the access token")
+	}
+
+	fake.mu.Lock()
+	if len(fake.items) != 1 {
+		t.Errorf("keyring has %d items, want 1", len(fake.items))
+	}
+	for _, item := range fake.items {
+		if item.attrs["server"] != "https://auth.example.com" ||
+			item.attrs["client_id"] != "client-a" {
+			t.Errorf("item attributes = %v", item.attrs)
+		}
+	}
+	fake.mu.Unlock()
+
+	// Losing the cache file leaves a refresh-only entry that is already
+	// expired, so the caller refreshes.
+	if err := os.Remove(store.cache.path); err != nil {
+		t.Fatal(err)
+	}
+	got, err := store.Get(key)
+	if err != nil {
+		t.Fatalf("Get() error: %v", err)
+	}
+	if got.RefreshToken != "refresh-token-value" || time.Now().Before(got.ExpiresAt) {
+		t.Errorf("Get() = %+v, want expired entry with refresh token", got)
+	}
+}
+
+func TestKeyringTokenStore_MovesCachedRefreshToken(t *testing.T) {
+	store, fake := newTestKeyringStore(t)
+	key := tokenStoreKey("https://auth.example.com", "client-a", defaultAccount)
+	// Written by the file store before switching to the keyring.
+	err := store.cache.Put(key, &TokenStorage{
+		AccessToken:  "access-token-value",
+		RefreshToken: "refresh-token-value",
+		ExpiresAt:    time.Now().Add(time.Hour),
+		ClientID:     "client-a",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	got, err := store.Get(key)
+	if err != nil {
+		t.Fatalf("Get() error: %v", err)
+	}
+	if got.RefreshToken != "refresh-token-value" {
+		t.Errorf("Get() refresh token = %q, want the cached one", got.RefreshToken)
+	}
+
+	fake.mu.Lock()
+	if len(fake.items) != 1 {
+		t.Errorf("keyring has %d items, want 1", len(fake.items))
+	}
+	fake.mu.Unlock()
+	data, err := os.ReadFile(store.cache.path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bytes.Contains(data, []byte("refresh-token-value")) {
+		t.Error("cache file still contains the refresh token")
+	}
+	if got, err := store.Get(key); err != nil || got.RefreshToken != "refresh-token-value" {
+		t.Errorf("Get() after the move = %+v, %v", got, err)
+	}
+}
+
+func TestNewTokenStore_KeyringFallsBackToFile(t *testing.T) {
+	t.Setenv("DBUS_SESSION_BUS_ADDRESS", "unix:path="+filepath.Join(t.TempDir(), "none"))
+
+	store, err := newTokenStore(tokenStoreKeyring, nil)
+	if err != nil {
+		t.Fatalf("newTokenStore() error: %v", err)
+	}
+	if store != nil {
+		t.Errorf("newTokenStore() = %v, want nil (file store)", store)
+	}
+}
+
+func TestKeyringTokenStore_LegacyItems(t *testing.T) {
+	store, fake := newTestKeyringStore(t)
+	const server = "https://auth.example.com"
+	legacy := map[string]map[string]string{
+		// Written before accounts: no account attribute.
+		"server-token": {"application": keyringApplication, "server": server, "client_id": "a"},
+		// Written before server-qualified keys: no server attribute either.
+		"bare-token": {"application": keyringApplication, "client_id": "b"},
+		// Another server's item must not be picked up.
+		"other-token": {"application": keyringApplication, "server": "https://x", "client_id": "c"},
+	}
+	for secret, attrs := range legacy {
+		properties := map[string]dbus.Variant{
+			secretItemIface + ".Attributes": dbus.MakeVariant(attrs),
+		}
+		_, _, err := fake.CreateItem(properties, secretServiceSecret{Value: []byte(secret)}, false)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for client, want := range map[string]string{"a": "server-token", "b": "bare-token"} {
+		got, err := store.Get(tokenStoreKey(server, client, defaultAccount))
+		if err != nil || got.RefreshToken != want {
+			t.Errorf("Get(%s) = %+v, %v; want refresh token %q", client, got, err, want)
+		}
+	}
+	for _, key := range []string{
+		tokenStoreKey(server, "a", "work"),
+		tokenStoreKey(server, "c", defaultAccount),
+	} {
+		if got, err := store.Get(key); err == nil {
+			t.Errorf("Get(%s) = %+v, want ErrTokenNotFound", key, got)
+		}
+	}
+
+	// The items found were re-tagged with the current attributes.
+	fake.mu.Lock()
+	defer fake.mu.Unlock()
+	for _, item := range fake.items {
+		if string(item.secret) != "other-token" &&
+			(item.attrs["account"] != defaultAccount || item.attrs["server"] != server) {
+			t.Errorf("item attributes = %v, want re-tagged", item.attrs)
+		}
+	}
+}
@@ -0,0 +1,155 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// testTokenStore runs the TokenStore contract against store.
+func testTokenStore(t *testing.T, store TokenStore) {
+	t.Helper()
+
+	if _, err := store.Get("missing"); !errors.Is(err, ErrTokenNotFound) {
+		t.Errorf("Get(missing) error = %v, want ErrTokenNotFound", err)
+	}
+
+	want := &TokenStorage{
+		AccessToken:  "access-token-value",
+		RefreshToken: "refresh-token-value",
+		TokenType:    "Bearer",
+		ExpiresAt:    time.Now().Add(time.Hour).UTC().Truncate(time.Second),
+		ClientID:     "client-a",
+		Scope:        "read write",
+	}
+	for _, key := range []string{"client-b", "client-a"} {
+		if err := store.Put(key, want); err != nil {
+			t.Fatalf("Put(%s) error: %v", key, err)
+		}
+	}
+
+	got, err := store.Get("client-a")
+	if err != nil {
+		t.Fatalf("Get() error: %v", err)
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("Get() = %+v, want %+v", got, want)
+	}
+
+	keys, err := store.List()
+	if err != nil {
+		t.Fatalf("List() error: %v", err)
+	}
+	if !reflect.DeepEqual(keys, []string{"client-a", "client-b"}) {
+		t.Errorf("List() = %q", keys)
+	}
+
+	if err := store.Delete("client-a"); err != nil {
+		t.Fatalf("Delete() error: %v", err)
+	}
+	if err := store.Delete("client-a"); err != nil {
+		t.Errorf("Delete() of missing key error: %v", err)
+	}
+	if _, err := store.Get("client-a"); !errors.Is(err, ErrTokenNotFound) {
+		t.Errorf("Get() after Delete error = %v, want ErrTokenNotFound", err)
+	}
+}
+
+func TestFileTokenStore(t *testing.T) {
+	testTokenStore(t, &fileTokenStore{path: filepath.Join(t.TempDir(), "tokens.json")})
+}
+
+func TestMemoryTokenStore(t *testing.T) {
+	testTokenStore(t, newMemoryTokenStore())
+}
+
+func TestMemoryTokenStore_ReturnsCopies(t *testing.T) {
+	store := newMemoryTokenStore()
+	storage := &TokenStorage{AccessToken: "original"}
+	if err := store.Put("k", storage); err != nil {
+		t.Fatal(err)
+	}
+	storage.AccessToken = "mutated"
+
+	got, _ := store.Get("k")
+	if got.AccessToken != "original" {
+		t.Errorf("stored entry changed through caller's pointer: %q", got.AccessToken)
+	}
+}
+
+func TestExecTokenStore(t *testing.T) {
+	t.Setenv("AUTHGATE_TEST_TOKEN_HELPER", filepath.Join(t.TempDir(), "helper.json"))
+	testTokenStore(t, &execTokenStore{
+		command: []string{os.Args[0], "-test.run=TestExecTokenStoreHelper"},
+	})
+}
+
+func TestExecTokenStore_HelperFailure(t *testing.T) {
+	store := &execTokenStore{command: []string{"false"}}
+	if _, err := store.Get("k"); err == nil || errors.Is(err, ErrTokenNotFound) {
+		t.Errorf("Get() error = %v, want helper failure", err)
+	}
+}
+
+func TestNewTokenStore(t *testing.T) {
+	if store, err := newTokenStore(tokenStoreFile, nil); err != nil || store != nil {
+		t.Errorf("file: got %v, %v; want nil store (resolved lazily)", store, err)
+	}
+	if _, err := newTokenStore(tokenStoreMemory, nil); err != nil {
+		t.Errorf("memory: %v", err)
+	}
+	if _, err := newTokenStore(tokenStoreExec, nil); err == nil {
+		t.Error("exec without command: expected error")
+	}
+	if _, err := newTokenStore("vault", nil); err == nil {
+		t.Error("unknown backend: expected error")
+	}
+}
+
+// TestExecTokenStoreHelper is not a real test: TestExecTokenStore runs the
+// test binary as a token helper, backed by the JSON file named in
+// AUTHGATE_TEST_TOKEN_HELPER.
+func TestExecTokenStoreHelper(t *testing.T) {
+	path := os.Getenv("AUTHGATE_TEST_TOKEN_HELPER")
+	if path == "" {
+		t.Skip("only runs as a token helper subprocess")
+	}
+
+	var req execStoreRequest
+	if err := json.NewDecoder(os.Stdin).Decode(&req); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+
+	tokens := make(map[string]*TokenStorage)
+	if data, err := os.ReadFile(path); err == nil {
+		_ = json.Unmarshal(data, &tokens)
+	}
+
+	var resp execStoreResponse
+	switch req.Action {
+	case "get":
+		if resp.Token = tokens[req.Key]; resp.Token == nil {
+			resp.Error = "not_found"
+		}
+	case "put":
+		tokens[req.Key] = req.Token
+	case "delete":
+		delete(tokens, req.Key)
+	case "list":
+		resp.Keys = sortedKeys(tokens)
+	}
+
+	data, _ := json.Marshal(tokens)
+	if err := os.WriteFile(path, data, 0o600); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	_ = json.NewEncoder(os.Stdout).Encode(resp)
+	os.Exit(0)
+}
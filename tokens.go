@@ -1,7 +1,7 @@
 package main
 
 import (
-	"encoding/json"
+	"errors"
 	"fmt"
 	"os"
 	"time"
@@ -16,72 +16,121 @@ type ErrorResponse struct {
 // ErrRefreshTokenExpired indicates the refresh token has expired or is invalid.
 var ErrRefreshTokenExpired = fmt.Errorf("refresh token expired or invalid")
 
-// TokenStorage holds persisted OAuth tokens for one client.
+// ErrRefreshTokenReused indicates the server rejected a refresh token that it
+// issued by rotation. This usually means an older copy of the token family was
+// presented somewhere and the server revoked the whole family. It wraps
+// ErrRefreshTokenExpired, so callers re-authenticate as usual.
+var ErrRefreshTokenReused = fmt.Errorf(
+	"%w: rejected after rotation, probable refresh token reuse "+
+		"(the server may have revoked the token family); re-authentication required",
+	ErrRefreshTokenExpired,
+)
+
+// TokenStorage holds persisted OAuth tokens for one account of a client.
+// IssuedAt and ExpiresAt are on the server's clock, which was ClockSkew ahead
+// of the local clock when the tokens were issued.
 type TokenStorage struct {
-	AccessToken  string    `json:"access_token"`
-	RefreshToken string    `json:"refresh_token"`
-	TokenType    string    `json:"token_type"`
-	ExpiresAt    time.Time `json:"expires_at"`
-	ClientID     string    `json:"client_id"`
-	Flow         string    `json:"flow,omitempty"` // "browser" or "device"
+	AccessToken  string        `json:"access_token"`
+	RefreshToken string        `json:"refresh_token"`
+	TokenType    string        `json:"token_type"`
+	ExpiresAt    time.Time     `json:"expires_at"`
+	IssuedAt     time.Time     `json:"issued_at,omitzero"`
+	ClockSkew    time.Duration `json:"clock_skew,omitempty"` // server clock minus local clock
+	ClientID     string        `json:"client_id"`
+	ServerURL    string        `json:"server_url,omitempty"`
+	Account      string        `json:"account,omitempty"`
+	IDToken      string        `json:"id_token,omitempty"`
+	Identity     *Identity     `json:"identity,omitempty"` // claims from the ID token, if any
+	LastUsed     time.Time     `json:"last_used,omitzero"`
+	Flow         string        `json:"flow,omitempty"`  // "browser" or "device"
+	Scope        string        `json:"scope,omitempty"` // space-separated granted scopes
 }
 
-// TokenStorageMap manages tokens for multiple clients in one file.
+// tokenResponse is a successful token endpoint response (RFC 6749 §5.1).
+type tokenResponse struct {
+	AccessToken  string `json:"access_token"`
+	RefreshToken string `json:"refresh_token"`
+	TokenType    string `json:"token_type"`
+	ExpiresIn    int    `json:"expires_in"`
+	Scope        string `json:"scope"`
+	IDToken      string `json:"id_token,omitempty"`
+}
+
+// TokenStorageMap manages tokens for multiple servers and clients in one
+// file, keyed by tokenStoreKey.
 type TokenStorageMap struct {
-	Tokens map[string]*TokenStorage `json:"tokens"`
+	Version int                      `json:"version"` // see tokenFileVersion
+	Tokens  map[string]*TokenStorage `json:"tokens"`
 }
 
+// loadTokens returns the stored tokens for the configured server and client.
+// An entry written by an earlier version under the bare client ID is migrated
+// to the server-qualified key.
 func loadTokens() (*TokenStorage, error) {
-	data, err := os.ReadFile(tokenFile)
-	if err != nil {
-		return nil, err
-	}
-	var storageMap TokenStorageMap
-	if err := json.Unmarshal(data, &storageMap); err != nil {
-		return nil, fmt.Errorf("failed to parse token file: %w", err)
-	}
-	if storageMap.Tokens == nil {
-		return nil, fmt.Errorf("no tokens in file")
-	}
-	if storage, ok := storageMap.Tokens[clientID]; ok {
-		return storage, nil
+	store := activeTokenStore()
+	storage, err := store.Get(currentTokenKey())
+	if errors.Is(err, ErrTokenNotFound) {
+		if legacy, legacyErr := migrateLegacyTokenKey(store); legacyErr == nil {
+			return legacy, nil
+		}
 	}
-	return nil, fmt.Errorf("no tokens found for client_id: %s", clientID)
+	return storage, err
 }
 
+// saveTokens stores tokens under their server, client ID and account (the
+// current ones when unset) and stamps them as last used now.
 func saveTokens(storage *TokenStorage) error {
 	if storage.ClientID == "" {
 		storage.ClientID = clientID
 	}
-
-	lock, err := acquireFileLock(tokenFile)
-	if err != nil {
-		return fmt.Errorf("failed to acquire lock: %w", err)
+	if storage.ServerURL == "" {
+		storage.ServerURL = normalizeServerURL(serverURL)
+	}
+	if storage.Account == "" {
+		storage.Account = currentAccount()
 	}
-	defer func() { _ = lock.release() }()
+	storage.LastUsed = time.Now().UTC()
+	key := tokenStoreKey(storage.ServerURL, storage.ClientID, storage.Account)
+	return activeTokenStore().Put(key, storage)
+}
 
-	var storageMap TokenStorageMap
-	if existing, err := os.ReadFile(tokenFile); err == nil {
-		if unmarshalErr := json.Unmarshal(existing, &storageMap); unmarshalErr != nil {
-			storageMap.Tokens = make(map[string]*TokenStorage)
-		}
+// deleteTokens removes the stored tokens for the current account of the
+// configured server and client, including a not yet migrated legacy entry.
+func deleteTokens() error {
+	store := activeTokenStore()
+	if err := store.Delete(currentTokenKey()); err != nil {
+		return err
 	}
-	if storageMap.Tokens == nil {
-		storageMap.Tokens = make(map[string]*TokenStorage)
+	if currentAccount() != defaultAccount {
+		return nil
 	}
+	return store.Delete(clientID)
+}
 
-	storageMap.Tokens[storage.ClientID] = storage
-
-	data, err := json.MarshalIndent(storageMap, "", "  ")
-	if err != nil {
-		return err
+// saveTokensWithRetry calls saveTokens up to three times with a short
+// backoff, for writes that must not be lost (e.g. a rotated refresh token).
+func saveTokensWithRetry(storage *TokenStorage) error {
+	const attempts = 3
+	var err error
+	for i := 1; i <= attempts; i++ {
+		if err = saveTokens(storage); err == nil {
+			return nil
+		}
+		if i < attempts {
+			time.Sleep(time.Duration(i) * 100 * time.Millisecond)
+		}
 	}
+	return fmt.Errorf("after %d attempts: %w", attempts, err)
+}
 
-	tempFile := tokenFile + ".tmp"
-	if err := os.WriteFile(tempFile, data, 0o600); err != nil {
+// writeFileAtomic writes data to a temp file next to path and renames it into
+// place, so readers never observe a partially written file.
+func writeFileAtomic(path string, data []byte, perm os.FileMode) error {
+	tempFile := path + ".tmp"
+	if err := os.WriteFile(tempFile, data, perm); err != nil {
 		return fmt.Errorf("failed to write temp file: %w", err)
 	}
-	if err := os.Rename(tempFile, tokenFile); err != nil {
+	if err := os.Rename(tempFile, path); err != nil {
 		if removeErr := os.Remove(tempFile); removeErr != nil {
 			return fmt.Errorf(
 				"failed to rename temp file: %v; also failed to remove temp file: %w",